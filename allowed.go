@@ -1,17 +1,83 @@
 package seven5
 
+import (
+	"fmt"
+	"net/http"
+)
+
 //Authorizer is a type that allows implementors to control authorization and thus circumvent the usual
 //rest dispatch machinery.  This type is consumed by RawDispatcher and should only be implemented by
 //other dispatchers.  Applications should typically use the "Allow*" methods on their own resource
-//implementation in combinations with the BaseDispatcher.
+//implementation in combinations with the BaseDispatcher.  Each method returns a Decision and
+//RawDispatcher answers refused requests with a 401 or 403 based on its Kind.
 type Authorizer interface {
-	Index(d *restObj, bundle PBundle) bool
-	Post(d *restObj, bundle PBundle) bool
-	Find(d *restObj,num Id,  bundle PBundle) bool	
-	Put(d *restObj,num Id,  bundle PBundle) bool	
-	Delete(d *restObj, num Id, bundle PBundle) bool
+	Index(d *restObj, bundle PBundle) Decision
+	Post(d *restObj, bundle PBundle) Decision
+	Find(d *restObj,num Id,  bundle PBundle) Decision
+	Put(d *restObj,num Id,  bundle PBundle) Decision
+	Delete(d *restObj, num Id, bundle PBundle) Decision
+}
+
+//DecisionKind is the outcome of an authorization check.  The zero value is FORBIDDEN so that
+//a Decision that was never filled in refuses the request.
+type DecisionKind int
+
+const (
+	//FORBIDDEN means the caller is known (or it doesn't matter who they are) and may not make
+	//the request.  RawDispatcher responds with 403.
+	FORBIDDEN DecisionKind = iota
+	//UNAUTHENTICATED means the request has no session and might be allowed after logging in.
+	//RawDispatcher responds with 401 and a WWW-Authenticate challenge.
+	UNAUTHENTICATED
+	//ALLOW lets the request through.
+	ALLOW
+)
+
+//Decision is what an Authorizer decides about a request.  The Reason is sent to the client
+//when the request is refused, so it should not give away anything secret.
+type Decision struct {
+	Kind   DecisionKind
+	Reason string
+}
+
+//ALLOWED is the Decision that lets a request through.
+var ALLOWED = Decision{Kind: ALLOW}
+
+//Allowed is true if the request may proceed.
+func (self Decision) Allowed() bool {
+	return self.Kind == ALLOW
 }
 
+//StatusCode is the http status for a refusal: 401 for UNAUTHENTICATED and 403 otherwise.
+func (self Decision) StatusCode() int {
+	if self.Kind == UNAUTHENTICATED {
+		return http.StatusUnauthorized
+	}
+	return http.StatusForbidden
+}
+
+//Decide turns the boolean answer of an Allow* method into a Decision.  A refusal is
+//UNAUTHENTICATED if the bundle has no session and FORBIDDEN if it has one.
+func Decide(ok bool, bundle PBundle, reason string) Decision {
+	switch {
+	case ok:
+		return ALLOWED
+	case bundle.Session() == nil:
+		return Decision{Kind: UNAUTHENTICATED, Reason: reason}
+	}
+	return Decision{Kind: FORBIDDEN, Reason: reason}
+}
+
+//String is used in logs and error messages.
+func (self Decision) String() string {
+	switch self.Kind {
+	case ALLOW:
+		return "allowed"
+	case UNAUTHENTICATED:
+		return fmt.Sprintf("unauthenticated: %s", self.Reason)
+	}
+	return fmt.Sprintf("forbidden: %s", self.Reason)
+}
 
 //AllowReader is an interface that allows a particular resource to express permissions about what users
 //or types of requests are allowed on it.  This is a good place to put gross-level kinds of "policy"
@@ -41,3 +107,21 @@ type AllowWriter interface {
 type Allower interface {
 	Allow(Id, string, PBundle) bool
 }
+
+//RowFilter is an interface that a resource can implement to decide which of the objects it returns
+//a particular request may see, for policies like "staff see every element but normal users see only
+//the elements they own."  AllowRow is called with each element of the slice returned by RestIndex, and
+//elements for which it returns false are dropped.  It is also called with the result of RestFind, and
+//if it returns false the request gets a 404, as if the object did not exist.  The RowFilter is found
+//by type assertion on the RestIndex or RestFind.
+type RowFilter interface {
+	AllowRow(interface{}, PBundle) bool
+}
+
+//Fields of wire types can be restricted to some roles (see RoleSource) with a seven5 tag:
+//
+//	Salary Money `seven5:"read=admin|staff,write=admin"`
+//
+//Fields a request may not read are left out of what is sent to the client and a request
+//that includes a field it may not write is refused with a 403.  A field with no "read" (or
+//"write") part can be read (or written) by anyone.
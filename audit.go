@@ -0,0 +1,452 @@
+package seven5
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FieldChange is the value of one field of a wire object before and after a change.  Before
+//is nil for a Post and After is nil for a Delete.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+//AuditEntry records one successful Post, Put or Delete on a REST resource.  User is the
+//UserKey of the session, or "" if there was none.  Actor is the UserKey of the staff member
+//if the session was impersonating User (see ImpersonationSession).  Session identifies the
+//session without giving it away: it is the start of the sha256 of the session id.
+type AuditEntry struct {
+	Id         Id             `json:"id"`
+	Time       time.Time      `json:"time"`
+	User       string         `json:"user"`
+	Actor      string         `json:"actor,omitempty"`
+	Session    string         `json:"session"`
+	Resource   string         `json:"resource"`
+	ResourceId Id             `json:"resource_id"`
+	Method     string         `json:"method"`
+	RemoteAddr string         `json:"remote_addr"`
+	Changes    []*FieldChange `json:"changes"`
+}
+
+//AuditSink receives the entries of the audit log.  Record must be safe to call from multiple
+//goroutines and should set the Id of the entry.  Set RawDispatcher.Audit to enable auditing.
+type AuditSink interface {
+	Record(e *AuditEntry) error
+}
+
+//AuditFilter selects entries from an AuditLog.  Empty fields match everything.  Limit, if
+//positive, keeps only the most recent entries.
+type AuditFilter struct {
+	Id       Id
+	User     string
+	Actor    string
+	Resource string
+	Method   string
+	Since    time.Time
+	Limit    int
+}
+
+func (self *AuditFilter) matches(e *AuditEntry) bool {
+	return (self.Id == 0 || e.Id == self.Id) &&
+		(self.User == "" || e.User == self.User) &&
+		(self.Actor == "" || e.Actor == self.Actor) &&
+		(self.Resource == "" || strings.EqualFold(e.Resource, self.Resource)) &&
+		(self.Method == "" || strings.EqualFold(e.Method, self.Method)) &&
+		!e.Time.Before(self.Since)
+}
+
+//AuditLog is an AuditSink that can also be searched, as AuditResource needs.
+type AuditLog interface {
+	AuditSink
+	Query(f *AuditFilter) ([]*AuditEntry, error)
+}
+
+//filterEntries returns the entries (which are oldest first) that match f.
+func filterEntries(all []*AuditEntry, f *AuditFilter) []*AuditEntry {
+	result := []*AuditEntry{}
+	for _, e := range all {
+		result = f.add(result, e)
+	}
+	return result
+}
+
+//add appends e to result if it matches, dropping the oldest entry if that makes too many.
+func (self *AuditFilter) add(result []*AuditEntry, e *AuditEntry) []*AuditEntry {
+	if !self.matches(e) {
+		return result
+	}
+	result = append(result, e)
+	if self.Limit > 0 && len(result) > self.Limit {
+		result = result[1:]
+	}
+	return result
+}
+
+//SimpleAuditLog is an AuditLog kept in memory.
+type SimpleAuditLog struct {
+	sync.Mutex
+	entries []*AuditEntry
+}
+
+//NewSimpleAuditLog returns an empty, in-memory AuditLog.
+func NewSimpleAuditLog() *SimpleAuditLog {
+	return &SimpleAuditLog{}
+}
+
+func (self *SimpleAuditLog) Record(e *AuditEntry) error {
+	self.Lock()
+	defer self.Unlock()
+	e.Id = Id(len(self.entries) + 1)
+	self.entries = append(self.entries, e)
+	return nil
+}
+
+func (self *SimpleAuditLog) Query(f *AuditFilter) ([]*AuditEntry, error) {
+	self.Lock()
+	defer self.Unlock()
+	return filterEntries(self.entries, f), nil
+}
+
+//FileAuditLog is an AuditLog that appends entries to a file as JSON, one entry per line.
+//Query reads the file a line at a time and keeps only the entries it returns, but it reads
+//the whole file every time, so rotate the file with other tools when it gets large.  Lines
+//that are not entries, such as the end of a write cut short by a crash, are skipped and
+//reported on stderr.
+type FileAuditLog struct {
+	sync.Mutex
+	path   string
+	file   *os.File
+	nextId Id
+	//partial is true if the file may not end with a newline, so the next entry has to
+	//start a line of its own
+	partial bool
+}
+
+//NewFileAuditLog opens (or creates) the log at path.  Ids continue from the largest id
+//already in the file.
+func NewFileAuditLog(path string) (*FileAuditLog, error) {
+	result := &FileAuditLog{path: path, nextId: 1}
+	err := result.scan(func(e *AuditEntry) {
+		if e.Id >= result.nextId {
+			result.nextId = e.Id + 1
+		}
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	result.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := result.file.Stat()
+	if err != nil {
+		result.file.Close()
+		return nil, err
+	}
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := result.file.ReadAt(last, info.Size()-1); err != nil {
+			result.file.Close()
+			return nil, err
+		}
+		result.partial = last[0] != '\n'
+	}
+	return result, nil
+}
+
+//Record writes the entry as one line with a single write to the file, which is opened for
+//appending, so entries are not interleaved.  If an earlier write failed part way, the entry
+//starts on a new line so that only the partial line is lost.
+func (self *FileAuditLog) Record(e *AuditEntry) error {
+	self.Lock()
+	defer self.Unlock()
+	e.Id = self.nextId
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if self.partial {
+		line = append([]byte{'\n'}, line...)
+	}
+	if _, err := self.file.Write(line); err != nil {
+		self.partial = true
+		return err
+	}
+	self.partial = false
+	self.nextId++
+	return nil
+}
+
+func (self *FileAuditLog) Query(f *AuditFilter) ([]*AuditEntry, error) {
+	self.Lock()
+	defer self.Unlock()
+	result := []*AuditEntry{}
+	err := self.scan(func(e *AuditEntry) {
+		result = f.add(result, e)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Close closes the file.  The log can't be used after this.
+func (self *FileAuditLog) Close() error {
+	return self.file.Close()
+}
+
+//scan calls fn with each entry of the file in turn, oldest first.  Lines that can't be
+//decoded are skipped and reported on stderr.
+func (self *FileAuditLog) scan(fn func(e *AuditEntry)) error {
+	f, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*MAX_FORM_SIZE)
+	for n := 1; scanner.Scan(); n++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		e := &AuditEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			fmt.Fprintf(os.Stderr, "skipping bad line %d of audit log %s: %s\n", n, self.path, err)
+			continue
+		}
+		fn(e)
+	}
+	return scanner.Err()
+}
+
+//wireChanges compares two wire objects (pointers to the same struct type, either may be nil)
+//field by field and returns the fields that differ.
+func wireChanges(before interface{}, after interface{}) []*FieldChange {
+	b := wireStruct(before)
+	a := wireStruct(after)
+	var t reflect.Type
+	switch {
+	case a.IsValid():
+		t = a.Type()
+	case b.IsValid():
+		t = b.Type()
+	default:
+		return nil
+	}
+	result := []*FieldChange{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		change := &FieldChange{Field: f.Name}
+		if b.IsValid() {
+			change.Before = b.Field(i).Interface()
+		}
+		if a.IsValid() {
+			change.After = a.Field(i).Interface()
+		}
+		if !reflect.DeepEqual(change.Before, change.After) {
+			result = append(result, change)
+		}
+	}
+	return result
+}
+
+func wireStruct(i interface{}) reflect.Value {
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}
+	}
+	return v.Elem()
+}
+
+//audit records a successful mutation.  Failures of the sink are logged but do not change
+//the response, since the change has already been made.
+func (self *RawDispatcher) audit(r *http.Request, d *restObj, method string, num Id, before interface{}, after interface{}, bundle PBundle) {
+	e := &AuditEntry{
+		Time:       time.Now(),
+		Resource:   d.name,
+		ResourceId: num,
+		Method:     method,
+		RemoteAddr: r.RemoteAddr,
+		Changes:    wireChanges(before, after),
+	}
+	if s := bundle.Session(); s != nil {
+		e.User = UserKey(s)
+		e.Session = sessionDigest(s)
+		if imp, ok := UnwrapSession(s).(*ImpersonationSession); ok {
+			e.Actor = UserKey(imp.actor)
+		}
+	}
+	if method == "POST" {
+		if v := wireStruct(after); v.IsValid() {
+			if f := v.FieldByName("Id"); f.IsValid() && f.Kind() == reflect.Int64 {
+				e.ResourceId = Id(f.Int())
+			}
+		}
+	}
+	if err := self.Audit.Record(e); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to record audit entry for %s %s %d: %s\n", method, d.name, e.ResourceId, err)
+	}
+}
+
+//sessionDigest identifies a session in the audit log without revealing the session id.
+func sessionDigest(s Session) string {
+	sum := sha256.Sum256([]byte(s.SessionId()))
+	return hex.EncodeToString(sum[:8])
+}
+
+//auditBefore uses the Find of the resource to get the object that a Put or Delete is about
+//to change, so the audit log can show the difference.  It returns nil if the resource has
+//no Find or auditing is off.  Find is called as the caller of the Put or Delete (see
+//RawDispatcher.Audit).  The object is copied by encoding and decoding it, since resources
+//often change the object they return from Find in place, including its slices and maps.
+func (self *RawDispatcher) auditBefore(d *restObj, num Id, bundle PBundle) interface{} {
+	if self.Audit == nil || d.find == nil {
+		return nil
+	}
+	before, err := d.find.Find(num, bundle)
+	if err != nil {
+		return nil
+	}
+	v := wireStruct(before)
+	if !v.IsValid() {
+		return nil
+	}
+	data, err := json.Marshal(before)
+	if err != nil {
+		return nil
+	}
+	c := reflect.New(v.Type())
+	if err := json.Unmarshal(data, c.Interface()); err != nil {
+		return nil
+	}
+	return c.Interface()
+}
+
+//AuditWire is the wire type of AuditResource.  The fields are those of AuditEntry, except
+//that Changes is the json encoding of a list of FieldChange.
+type AuditWire struct {
+	Id         Id
+	Time       DateTime
+	User       String255
+	Actor      String255
+	Session    String255
+	Resource   String255
+	ResourceId Id
+	Method     String255
+	RemoteAddr String255
+	Changes    Textblob
+}
+
+//AuditResource lets administrators read the audit log.  Index accepts the query parameters
+//user, actor, resource, method, since (seconds since the epoch) and limit.  Only sessions with
+//ROLE_ADMIN (see BundleRoles) may use it.  Map it with ResourceSeparate:
+//
+//	disp.ResourceSeparate("AuditWire", &AuditWire{}, res, res, nil, nil, nil)
+type AuditResource struct {
+	Log   AuditLog
+	Roles RoleStore
+}
+
+//NewAuditResource returns a resource for log.  The roles may be nil if admins get their
+//role from their sessions (see RoleHolder).
+func NewAuditResource(log AuditLog, roles RoleStore) *AuditResource {
+	return &AuditResource{Log: log, Roles: roles}
+}
+
+func (self *AuditResource) isAdmin(bundle PBundle) bool {
+	for _, r := range BundleRoles(bundle, self.Roles) {
+		if r == ROLE_ADMIN {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *AuditResource) AllowRead(bundle PBundle) bool {
+	return self.isAdmin(bundle)
+}
+
+func (self *AuditResource) Allow(id Id, method string, bundle PBundle) bool {
+	return method == "GET" && self.isAdmin(bundle)
+}
+
+func (self *AuditResource) Index(bundle PBundle) (interface{}, error) {
+	f := &AuditFilter{}
+	f.User, _ = bundle.Query("user")
+	f.Actor, _ = bundle.Query("actor")
+	f.Resource, _ = bundle.Query("resource")
+	f.Method, _ = bundle.Query("method")
+	if s, ok := bundle.Query("since"); ok {
+		secs, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, HTTPError(http.StatusBadRequest, "since must be seconds since the epoch")
+		}
+		f.Since = time.Unix(secs, 0)
+	}
+	if s, ok := bundle.Query("limit"); ok {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil, HTTPError(http.StatusBadRequest, "limit must be a number")
+		}
+		f.Limit = n
+	}
+	all, err := self.Log.Query(f)
+	if err != nil {
+		return nil, err
+	}
+	result := []*AuditWire{}
+	for _, e := range all {
+		w, err := auditWire(e)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, w)
+	}
+	return result, nil
+}
+
+func (self *AuditResource) Find(id Id, bundle PBundle) (interface{}, error) {
+	found, err := self.Log.Query(&AuditFilter{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	if len(found) > 0 && id != 0 {
+		return auditWire(found[0])
+	}
+	return nil, HTTPError(http.StatusNotFound, "no such audit entry")
+}
+
+func auditWire(e *AuditEntry) (*AuditWire, error) {
+	changes, err := json.Marshal(e.Changes)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditWire{
+		Id:         e.Id,
+		Time:       DateTime(float64(e.Time.UnixNano()) / float64(time.Second)),
+		User:       String255(e.User),
+		Actor:      String255(e.Actor),
+		Session:    String255(e.Session),
+		Resource:   String255(e.Resource),
+		ResourceId: e.ResourceId,
+		Method:     String255(e.Method),
+		RemoteAddr: String255(e.RemoteAddr),
+		Changes:    Textblob(changes),
+	}, nil
+}
@@ -0,0 +1,222 @@
+package seven5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//noteStore is a RestAll that keeps NoteWires in memory and lets any session change them.
+type noteStore struct {
+	notes map[Id]*NoteWire
+	next  Id
+}
+
+func (self *noteStore) AllowRead(pb PBundle) bool  { return pb.Session() != nil }
+func (self *noteStore) AllowWrite(pb PBundle) bool { return pb.Session() != nil }
+func (self *noteStore) Allow(id Id, method string, pb PBundle) bool {
+	return pb.Session() != nil
+}
+
+func (self *noteStore) Index(pb PBundle) (interface{}, error) {
+	return []*NoteWire{}, nil
+}
+
+func (self *noteStore) Find(id Id, pb PBundle) (interface{}, error) {
+	n, ok := self.notes[id]
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, "no such note")
+	}
+	return n, nil
+}
+
+func (self *noteStore) Post(i interface{}, pb PBundle) (interface{}, error) {
+	self.next++
+	n := i.(*NoteWire)
+	n.Id = self.next
+	self.notes[n.Id] = n
+	return n, nil
+}
+
+func (self *noteStore) Put(id Id, i interface{}, pb PBundle) (interface{}, error) {
+	n, ok := self.notes[id]
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, "no such note")
+	}
+	n.Text = i.(*NoteWire).Text
+	return n, nil
+}
+
+func (self *noteStore) Delete(id Id, pb PBundle) (interface{}, error) {
+	n, ok := self.notes[id]
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, "no such note")
+	}
+	delete(self.notes, id)
+	return n, nil
+}
+
+//TaggedWire has a slice, which resources may change in place.
+type TaggedWire struct {
+	Id   Id
+	Tags []String255
+}
+
+//taggedStore keeps a single TaggedWire and updates its tags in place.
+type taggedStore struct {
+	tagged *TaggedWire
+}
+
+func (self *taggedStore) Find(id Id, pb PBundle) (interface{}, error) {
+	return self.tagged, nil
+}
+
+func (self *taggedStore) Put(id Id, i interface{}, pb PBundle) (interface{}, error) {
+	copy(self.tagged.Tags, i.(*TaggedWire).Tags)
+	return self.tagged, nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5audit")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	log, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("can't open audit log: %s", err)
+	}
+
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	disp.Audit = log
+	roles := NewSimpleRoleStore()
+	disp.Resource("NoteWire", &NoteWire{}, &noteStore{notes: make(map[Id]*NoteWire)})
+	audit := NewAuditResource(log, roles)
+	disp.ResourceSeparate("AuditWire", &AuditWire{}, audit, audit, nil, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	session, _ := sm.Generate(nil, "", nil, "", "")
+	do := func(method string, path string, body string) *http.Response {
+		return sendRequest(t, srv, method, path, body, sessionCookie(disp, session))
+	}
+	do("POST", "/rest/notewire", `{"Text":"first"}`)
+	do("PUT", "/rest/notewire/1", `{"Id":1,"Text":"second"}`)
+	do("PUT", "/rest/notewire/7", `{"Id":7,"Text":"missing"}`)
+	do("DELETE", "/rest/notewire/1", "")
+
+	all, err := log.Query(&AuditFilter{})
+	if err != nil || len(all) != 3 {
+		t.Fatalf("expected three entries (failed put not recorded): %v %v", all, err)
+	}
+	for i, m := range []string{"POST", "PUT", "DELETE"} {
+		e := all[i]
+		if e.Method != m || e.Resource != "NoteWire" || e.ResourceId != 1 || e.User != session.SessionId() ||
+			e.RemoteAddr == "" || e.Session == "" || strings.Contains(e.Session, session.SessionId()) {
+			t.Errorf("bad entry for %s: %+v", m, e)
+		}
+	}
+	if c := all[1].Changes; len(c) != 1 || c[0].Field != "Text" || c[0].Before != "first" || c[0].After != "second" {
+		t.Errorf("bad diff for put: %+v", c)
+	}
+	if c := all[2].Changes; len(c) != 2 || c[1].Before != "second" || c[1].After != nil {
+		t.Errorf("bad diff for delete: %+v", c)
+	}
+
+	//the file survives a restart and ids continue
+	log.Close()
+	log, err = NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("can't reopen audit log: %s", err)
+	}
+	defer log.Close()
+	disp.Audit = log
+	audit.Log = log
+	do("POST", "/rest/notewire", `{"Text":"third"}`)
+	if all, _ := log.Query(&AuditFilter{Since: time.Now().Add(-time.Minute), Limit: 1}); len(all) != 1 || all[0].Id != 4 {
+		t.Errorf("expected id to continue after reopening: %+v", all)
+	}
+
+	//only admins can read the log
+	if resp := do("GET", "/rest/auditwire", ""); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected non-admin to be refused but got %s", resp.Status)
+	}
+	roles.Assign(UserKey(session), ROLE_ADMIN)
+	resp := do("GET", "/rest/auditwire?method=put&resource=notewire", "")
+	var list []*AuditWire
+	json.NewDecoder(resp.Body).Decode(&list)
+	if resp.StatusCode != http.StatusOK || len(list) != 1 || list[0].Id != 2 || !strings.Contains(string(list[0].Changes), "second") {
+		t.Errorf("bad audit query: %s %+v", resp.Status, list)
+	}
+	if resp := do("GET", "/rest/auditwire/3", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("unable to find audit entry: %s", resp.Status)
+	}
+	if resp := do("GET", "/rest/auditwire/99", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected unknown audit entry to be not found: %s", resp.Status)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestAuditBeforeIsACopy(t *testing.T) {
+	log := NewSimpleAuditLog()
+	raw := NewRawDispatcher(NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil), nil, nil, NewSimpleTypeHolder(), "/rest")
+	raw.Audit = log
+	store := &taggedStore{&TaggedWire{Id: 1, Tags: []String255{"old"}}}
+	raw.ResourceSeparate("TaggedWire", &TaggedWire{}, nil, store, nil, store, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("PUT", "/rest/taggedwire/1", strings.NewReader(`{"Id":1,"Tags":["new"]}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("put failed: %d %s", w.Code, w.Body.String())
+	}
+	all, _ := log.Query(&AuditFilter{})
+	if len(all) != 1 || len(all[0].Changes) != 1 {
+		t.Fatalf("expected the change to the tags to be recorded: %+v", all)
+	}
+	if before := all[0].Changes[0].Before.([]String255); before[0] != "old" {
+		t.Errorf("change made in place should not alter the before value: %v", before)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestAuditLogBadLines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5audit")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	//a good entry, a corrupt line and an entry cut short without its newline
+	content := `{"id":1,"method":"POST","resource":"NoteWire"}` + "\n" + "not json\n" + `{"id":2,"method":"PU`
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("can't write audit log: %s", err)
+	}
+	log, err := NewFileAuditLog(path)
+	if err != nil {
+		t.Fatalf("expected bad lines to be skipped when opening: %s", err)
+	}
+	defer log.Close()
+	if err := log.Record(&AuditEntry{Method: "DELETE", Resource: "NoteWire"}); err != nil {
+		t.Fatalf("can't record: %s", err)
+	}
+	all, err := log.Query(&AuditFilter{})
+	if err != nil || len(all) != 2 {
+		t.Fatalf("expected the two good entries: %+v %v", all, err)
+	}
+	if all[0].Method != "POST" || all[1].Method != "DELETE" || all[1].Id != 2 {
+		t.Errorf("expected the new entry on its own line after the good one: %+v %+v", all[0], all[1])
+	}
+}
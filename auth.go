@@ -49,6 +49,17 @@ type OauthConnector interface {
 	Name() string
 }
 
+//PKCEConnector is implemented by OauthConnectors that support Proof Key for Code Exchange
+//(RFC 7636).  The AuthDispatcher checks for this interface when a login starts; if present,
+//it generates a fresh code verifier, remembers it against the state of the login, and uses
+//these methods in place of UserInteractionURL and Phase2.  The challenge is always the
+//S256 transform of the verifier.
+type PKCEConnector interface {
+	OauthConnector
+	UserInteractionURLWithChallenge(p1creds OauthCred, state string, callbackPath string, challenge string) string
+	Phase2WithVerifier(clientToken string, code string, verifier string) (OauthConnection, error)
+}
+
 //OauthClientDetail is an interface for finding the specific information needed to connect to
 //an Oauth server.  If you don't want to use environment variables as the way you store
 //these, you can provide your own implementation of this class.  
@@ -1,10 +1,13 @@
 package seven5
 
 import (
+	"bytes"
 	"code.google.com/p/gomock/gomock"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"strings"
 	"testing"
@@ -231,6 +234,43 @@ func createReqAndDo(t *testing.T, client *http.Client, targ string, c *http.Cook
 	return result
 }
 
+/*-------------------------------------------------------------------------------*/
+//sendRequest sends a request to srv with c as its cookie (if c isn't nil) and the headers
+//given as name, value pairs.  The body of the response is read and closed here and the
+//result has a copy of it, so callers don't need to close anything.
+func sendRequest(t *testing.T, srv *httptest.Server, method string, path string, body string, c *http.Cookie, header ...string) *http.Response {
+	req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to create %s request for %s: %s", method, path, err)
+	}
+	if c != nil {
+		req.AddCookie(c)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %s", method, path, err)
+	}
+	defer resp.Body.Close()
+	all, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unable to read response to %s %s: %s", method, path, err)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(all))
+	return resp
+}
+
+//sessionCookie is the cookie that the dispatcher understands as session s, or nil if
+//there is no session.
+func sessionCookie(disp *BaseDispatcher, s Session) *http.Cookie {
+	if s == nil {
+		return nil
+	}
+	return &http.Cookie{Name: disp.IO.CookieMapper().CookieName(), Value: s.SessionId()}
+}
+
 /*-------------------------------------------------------------------------------*/
 func createDispatcherWithMocks(ctrl *gomock.Controller, pm PageMapper, cm CookieMapper,
 	sm SessionManager) (*ServeMux, *MockOauthConnector) {
@@ -1,10 +1,12 @@
 package seven5
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 const (
@@ -19,10 +21,15 @@ type AuthDispatcher struct {
 	PageMap    PageMapper
 	CookieMap  CookieMapper
 	SessionMgr SessionManager
+	//Tokens, if not nil, is where the credentials of connections are saved after login
+	Tokens    TokenStore
+	//ReturnTo is the allow-list for the return_to parameter of login and logout (see
+	//ValidReturnTo).  If it is empty, return_to is ignored.
+	ReturnTo  []string
+	verifiers *expiringMap
+	returns   *expiringMap
 }
 
-
-
 //NewAuthDispatcherRaw returns a new auth dispatcher which assumes it is mapped at the prefix provided.
 //This should not end with / so mapping at / is passed as "".  Note that this Dispatcher should
 //not be added to the mux since it uses the "AddConnector" method to register particular
@@ -35,6 +42,8 @@ func NewAuthDispatcherRaw(prefix string, pm PageMapper, cm CookieMapper,
 		PageMap:    pm,
 		CookieMap:  cm,
 		SessionMgr: sm,
+		verifiers:  newExpiringMap(PKCE_VERIFIER_TTL),
+		returns:    newExpiringMap(PKCE_VERIFIER_TTL),
 	}
 
 }
@@ -49,6 +58,18 @@ func (self *AuthDispatcher) AddConnector(p OauthConnector, mux *ServeMux) {
 	self.provider = append(self.provider, p)
 }
 
+//AddPasswordAuthenticator maps the URLs for local accounts, /auth/local/{login,logout,register,
+//reset,resetconfirm}.  All but logout must be POSTed as forms: login and register take
+//username and password, reset takes username and resetconfirm takes token and password.
+//Successful logins go through the SessionManager and CookieMapper just like oauth logins.
+func (self *AuthDispatcher) AddPasswordAuthenticator(p *PasswordAuthenticator, mux *ServeMux) {
+	pref := self.prefix + "/" + p.Name() + "/"
+	for _, op := range []string{"login", "logout", "register", "reset", "resetconfirm"} {
+		mux.Dispatch(pref+op, self)
+	}
+	self.provider = append(self.provider, p)
+}
+
 //Dispatch is the main entry point for dispating an http request.  This is typically called
 //with /auth/connectorName/{login,logout,oauth2callback}
 func (self *AuthDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
@@ -75,6 +96,9 @@ func (self *AuthDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *ht
 		http.Error(w, fmt.Sprintf("Could not dispatch authentication URL: %s", r.URL), http.StatusNotFound)
 		return nil
 	}
+	if pw, ok := targ.(*PasswordAuthenticator); ok && split[2] != "logout" {
+		return self.dispatchPassword(pw, split[2], w, r)
+	}
 	switch split[2] {
 	case "login":
 		return self.Login(targ, w, r)
@@ -92,11 +116,38 @@ func (self *AuthDispatcher) Login(conn OauthConnector, w http.ResponseWriter, r
 	state := r.URL.Query().Get(conn.StateValueName())
 	p1cred, err:=conn.Phase1(state, self.callback(conn))
 	if err!=nil {
-		http.Redirect(w, r, self.PageMap.ErrorPage(conn, err.Error()), http.StatusTemporaryRedirect)
+		self.fail(conn, state, err.Error(), http.StatusTemporaryRedirect, w, r)
+		return nil
+	}
+	//remember where to go back to until the callback, and for connectors that understand
+	//PKCE the verifier; both are tied to this browser by a cookie
+	rt := self.returnTo(r)
+	pkce, isPKCE := conn.(PKCEConnector)
+	key := ""
+	if rt != "" || isPKCE {
+		if key, err = self.startPending(conn, state, w); err != nil {
+			self.fail(conn, state, err.Error(), http.StatusTemporaryRedirect, w, r)
+			return nil
+		}
+	}
+	if rt != "" {
+		self.returns.Put(key, rt)
+	}
+	if isPKCE {
+		verifier, err := NewPKCEVerifier()
+		if err != nil {
+			self.fail(conn, state, err.Error(), http.StatusTemporaryRedirect, w, r)
+			return nil
+		}
+		self.verifiers.Put(key, verifier)
+		self.respond(&AuthOutcome{Service: conn.Name(), Action: "redirect", State: state,
+			Location: pkce.UserInteractionURLWithChallenge(p1cred, state, self.callback(conn),
+				PKCEChallenge(verifier))}, http.StatusFound, w, r)
 		return nil
 	}
 	//everything is ok, so proceed to user interaction
-	http.Redirect(w, r, conn.UserInteractionURL(p1cred,state,self.callback(conn)), http.StatusFound)
+	self.respond(&AuthOutcome{Service: conn.Name(), Action: "redirect", State: state,
+		Location: conn.UserInteractionURL(p1cred, state, self.callback(conn))}, http.StatusFound, w, r)
 	return nil
 }
 
@@ -107,10 +158,16 @@ func (self *AuthDispatcher) Logout(conn OauthConnector, w http.ResponseWriter, r
 		return nil
 	}
 	if err != NO_SUCH_COOKIE {
+		self.forgetTokens(conn, id)
 		self.CookieMap.RemoveCookie(w)
 		self.SessionMgr.Destroy(id)
 	}
-	http.Redirect(w, r, self.PageMap.LogoutLandingPage(conn), http.StatusTemporaryRedirect)
+	location := self.returnTo(r)
+	if location == "" {
+		location = self.PageMap.LogoutLandingPage(conn)
+	}
+	self.respond(&AuthOutcome{Service: conn.Name(), Action: "logout", Location: location},
+		http.StatusTemporaryRedirect, w, r)
 	return nil
 }
 
@@ -119,7 +176,7 @@ func (self *AuthDispatcher) Callback(conn OauthConnector, w http.ResponseWriter,
 	e := r.URL.Query().Get(conn.ErrorValueName())
 	tok := r.URL.Query().Get(conn.ClientTokenValueName())
 	if e != "" {
-		http.Redirect(w, r, self.PageMap.ErrorPage(conn, e), http.StatusTemporaryRedirect)
+		self.fail(conn, "", e, http.StatusTemporaryRedirect, w, r)
 		return nil
 	}
 	return self.Connect(conn, tok, code, w, r)
@@ -129,31 +186,189 @@ func (self *AuthDispatcher) callback(conn OauthConnector) string {
 	return self.prefix + "/" + conn.Name() + "/" + callbackURL
 }
 
+//loginCookie is the name of the cookie that ties a login in progress to the browser that
+//started it.
+func (self *AuthDispatcher) loginCookie() string {
+	return self.CookieMap.CookieName() + "-login"
+}
+
+//startPending returns the key used to remember values between the login and callback
+//halves of the handshake.  The state is all the provider sends back to us, but it is chosen
+//by whoever made the login link, so the key also has a random nonce that is sent to the
+//browser in a short-lived cookie.  A callback only finds the values of a login started by
+//the same browser.
+func (self *AuthDispatcher) startPending(conn OauthConnector, state string, w http.ResponseWriter) (string, error) {
+	nonce, err := NewPKCEVerifier()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     self.loginCookie(),
+		Value:    nonce,
+		Path:     self.prefix + "/" + conn.Name() + "/",
+		MaxAge:   int(PKCE_VERIFIER_TTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return conn.Name() + ":" + nonce + ":" + state, nil
+}
+
+//finishPending returns the key that startPending created for this browser, or "" if it has
+//no login in progress, and removes the cookie.
+func (self *AuthDispatcher) finishPending(conn OauthConnector, state string, w http.ResponseWriter, r *http.Request) string {
+	c, err := r.Cookie(self.loginCookie())
+	if err != nil || c.Value == "" {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: self.loginCookie(), Path: self.prefix + "/" + conn.Name() + "/", MaxAge: -1})
+	return conn.Name() + ":" + c.Value + ":" + state
+}
+
+//phase2 calls the connector's Phase2, or if it supports PKCE, Phase2WithVerifier with the
+//verifier that was created when the login started.
+func (self *AuthDispatcher) phase2(conn OauthConnector, key string, clientTok string, code string) (OauthConnection, error) {
+	pkce, ok := conn.(PKCEConnector)
+	if !ok {
+		return conn.Phase2(clientTok, code)
+	}
+	v, ok := self.verifiers.Take(key)
+	if !ok {
+		return nil, errors.New("no login in progress for this state (or it took too long)")
+	}
+	return pkce.Phase2WithVerifier(clientTok, code, v.(string))
+}
+
 func (self *AuthDispatcher) Connect(conn OauthConnector, clientTok string, code string, w http.ResponseWriter, r *http.Request) *ServeMux {
-	connection, err := conn.Phase2(clientTok, code,)
+	state := r.URL.Query().Get(conn.StateValueName())
+	key := self.finishPending(conn, state, w, r)
+	connection, err := self.phase2(conn, key, clientTok, code)
 	if err != nil {
-		http.Redirect(w, r, self.PageMap.ErrorPage(conn, err.Error()), http.StatusTemporaryRedirect)
+		self.fail(conn, state, err.Error(), http.StatusTemporaryRedirect, w, r)
 		return nil
 	}
-	state := r.URL.Query().Get(conn.StateValueName())
+	returnTo := ""
+	if rt, ok := self.returns.Take(key); ok {
+		returnTo = rt.(string)
+	}
+	return self.establish(conn, connection, state, code, returnTo, w, r)
+}
+
+//establish creates a session for a newly authenticated connection, sets the cookie and sends
+//the browser to the return_to page (already validated) or else the login landing page.
+func (self *AuthDispatcher) establish(conn OauthConnector, connection OauthConnection, state string, code string,
+	returnTo string, w http.ResponseWriter, r *http.Request) *ServeMux {
 	v, err:=self.CookieMap.Value(r)
 	if err!=nil && err!=NO_SUCH_COOKIE {
-		http.Redirect(w, r, self.PageMap.ErrorPage(conn, err.Error()), http.StatusTemporaryRedirect)
+		self.fail(conn, state, err.Error(), http.StatusTemporaryRedirect, w, r)
 		return nil
 	}
 	session, err := self.SessionMgr.Generate(connection, v, r, state, code)
 	if err != nil {
 		error_msg := fmt.Sprintf("failed to create session")
-		http.Redirect(w, r, self.PageMap.ErrorPage(conn, error_msg), http.StatusTemporaryRedirect)
+		self.fail(conn, state, error_msg, http.StatusTemporaryRedirect, w, r)
 		return nil
 	}
 	if session!=nil {
 		self.CookieMap.AssociateCookie(w, session)
+		if self.Tokens != nil {
+			if err := SaveConnection(self.Tokens, connection, tokenKey(session), conn.Name()); err != nil {
+				fmt.Fprintf(os.Stderr, "unable to save credentials for %s: %s\n", conn.Name(), err)
+			}
+		}
 	}
-	http.Redirect(w, r, self.PageMap.LoginLandingPage(conn, state, code), http.StatusTemporaryRedirect)
+	location := returnTo
+	if location == "" {
+		location = self.PageMap.LoginLandingPage(conn, state, code)
+	}
+	self.respond(&AuthOutcome{Service: conn.Name(), Action: "login", State: state, Location: location},
+		http.StatusTemporaryRedirect, w, r)
 	return nil
 }
 
+//respond sends the outcome to the PageMapper if it is an AuthResponder, and otherwise
+//redirects the browser to its Location with the status given.
+func (self *AuthDispatcher) respond(outcome *AuthOutcome, status int, w http.ResponseWriter, r *http.Request) {
+	if responder, ok := self.PageMap.(AuthResponder); ok {
+		responder.Respond(outcome, w, r)
+		return
+	}
+	http.Redirect(w, r, outcome.Location, status)
+}
+
+//fail sends an "error" outcome, with the ErrorPage as the Location.
+func (self *AuthDispatcher) fail(conn OauthConnector, state string, msg string, status int, w http.ResponseWriter, r *http.Request) {
+	self.respond(&AuthOutcome{Service: conn.Name(), Action: "error", State: state, Error: msg,
+		Location: self.PageMap.ErrorPage(conn, msg)}, status, w, r)
+}
+
+//returnTo is the return_to parameter of the request if it is in the ReturnTo allow-list,
+//and otherwise "".
+func (self *AuthDispatcher) returnTo(r *http.Request) string {
+	rt := r.FormValue(RETURN_TO_PARAM)
+	if len(self.ReturnTo) == 0 || !ValidReturnTo(rt, self.ReturnTo) {
+		return ""
+	}
+	return rt
+}
+
+//dispatchPassword handles the form posts for local accounts.  Note that the password is not
+//passed on to the SessionManager or PageMapper as the "code".
+func (self *AuthDispatcher) dispatchPassword(pw *PasswordAuthenticator, op string, w http.ResponseWriter, r *http.Request) *ServeMux {
+	if r.Method != "POST" {
+		http.Error(w, fmt.Sprintf("%s must be POSTed", r.URL.Path), http.StatusMethodNotAllowed)
+		return nil
+	}
+	var connection OauthConnection
+	var err error
+	switch op {
+	case "login":
+		connection, err = pw.Authenticate(r.PostFormValue("username"), r.PostFormValue("password"))
+	case "register":
+		connection, err = pw.Register(r.PostFormValue("username"), r.PostFormValue("password"))
+	case "reset":
+		if err = pw.StartReset(r.PostFormValue("username")); err == nil {
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		}
+	case "resetconfirm":
+		connection, err = pw.FinishReset(r.PostFormValue("token"), r.PostFormValue("password"))
+	default:
+		http.Error(w, fmt.Sprintf("Could not dispatch authentication URL: %s", r.URL), http.StatusNotFound)
+		return nil
+	}
+	state := r.FormValue(pw.StateValueName())
+	if err != nil {
+		self.fail(pw, state, err.Error(), http.StatusSeeOther, w, r)
+		return nil
+	}
+	return self.establish(pw, connection, state, "", self.returnTo(r), w, r)
+}
+
+//Connection returns a connection to the service of conn on behalf of the session s, created
+//from the credentials saved when the user logged in.  This requires that Tokens be set.
+func (self *AuthDispatcher) Connection(conn OauthConnector, s Session) (OauthConnection, error) {
+	if self.Tokens == nil {
+		return nil, NO_SUCH_TOKEN
+	}
+	return RestoreConnection(self.Tokens, conn, tokenKey(s))
+}
+
+//forgetTokens removes the saved credentials of a session that is logging out.  Credentials
+//saved under a key other than the session id (see TokenKeyer) belong to the user, not
+//the session, so they are kept.
+func (self *AuthDispatcher) forgetTokens(conn OauthConnector, id string) {
+	if self.Tokens == nil {
+		return
+	}
+	s, err := self.SessionMgr.Find(id)
+	if err != nil || s == nil || tokenKey(s) != s.SessionId() {
+		return
+	}
+	if err := self.Tokens.Remove(id, conn.Name()); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to remove credentials for %s: %s\n", conn.Name(), err)
+	}
+}
+
 func toWebUIPath(s string) string {
 	return fmt.Sprintf("/out%s", s)
 }
@@ -1,11 +1,12 @@
 package seven5
 
 import (
-	_ "fmt"
+	"fmt"
 )
 
 //NewBaseDispatcher returns a raw dispatcher that has several defaults set.  
 //* The Allow() interfaces are used for authorization checks
+//* Requests refused because there is no session get a 401 with a "Cookie" WWW-Authenticate challenge
 //* The application will keep a single cookie on the browser (that's why the name is passed in)
 //* The application will keep a session associated with the cookie for each "logged in" user (in memory)
 //* Json is used to encode and decode the wire types
@@ -22,9 +23,10 @@ func NewBaseDispatcher(appName string, optionalSm SessionManager) *BaseDispatche
 	}
 	cm := NewSimpleCookieMapper(appName)
 	holder:=NewSimpleTypeHolder()
-	result :=&BaseDispatcher{}
-	io:=&RawIOHook{&JsonDecoder{},&JsonEncoder{}, cm}
+	result :=&BaseDispatcher{appName: appName}
+	io:=NewRawIOHook(&JsonDecoder{},&JsonEncoder{}, cm)
 	result.RawDispatcher = NewRawDispatcher(io, sm, result, holder, prefix)
+	result.Challenge = fmt.Sprintf("Cookie realm=%q", appName)
 	return result
 }
 
@@ -32,57 +34,87 @@ func NewBaseDispatcher(appName string, optionalSm SessionManager) *BaseDispatche
 //understands how to dispatch to REST resources (like Raw) but can also handle the Allower protocol for
 //primitive, coarse-grained authorization.  Additionally, it allows easy creation of a BaseDispatcher
 //with a custom SessionManager, as this is often used with user roles (and Allow protocol).
+//When an Allow method returns false the request is refused with 401 if there is no session and
+//with 403 if there is one.  MissingAllow is the decision for resources that don't implement the
+//Allow interface needed; the zero value, FORBIDDEN, refuses them with 403.
 type BaseDispatcher struct {
 	*RawDispatcher
+	MissingAllow DecisionKind
+	appName      string
 }
 
+func (self *BaseDispatcher) missing(iface string) Decision {
+	return Decision{Kind: self.MissingAllow, Reason: fmt.Sprintf("resource does not implement %s", iface)}
+}
 
 //Index checks with AllowReader.AllowRead to allow/refuse access to this method on _any_ resource
 //associated with this BaseDispatcher.
-func (self *BaseDispatcher) Index(d *restObj, bundle PBundle) bool {
+func (self *BaseDispatcher) Index(d *restObj, bundle PBundle) Decision {
 	allowReader, ok := d.index.(AllowReader)
 	if !ok {
-		return false
+		return self.missing("AllowReader")
 	}
-	return allowReader.AllowRead(bundle)
+	return Decide(allowReader.AllowRead(bundle), bundle, "")
 }
 
 //Post checks with AllowWriter.AllowWrite to allow/refuse access to this method on _any_ resource
 //associated with this BaseDispatcher.
-func (self *BaseDispatcher) Post(d *restObj, bundle PBundle) bool {
+func (self *BaseDispatcher) Post(d *restObj, bundle PBundle) Decision {
 	allowWriter, ok := d.post.(AllowWriter)
 	if !ok {
-		return false
+		return self.missing("AllowWriter")
 	}
-	return allowWriter.AllowWrite(bundle)
+	return Decide(allowWriter.AllowWrite(bundle), bundle, "")
 }
 
 //Find checks with Allower.Allow(FIND) to allow/refuse access to this method on _any_ resource
 //associated with this BaseDispatcher.
-func (self *BaseDispatcher) Find(d *restObj,num Id,  bundle PBundle) bool {
+func (self *BaseDispatcher) Find(d *restObj,num Id,  bundle PBundle) Decision {
 	allow, ok := d.find.(Allower)
 	if !ok {
-		return false
+		return self.missing("Allower")
 	}
-	return allow.Allow(num, "GET", bundle)
+	return Decide(allow.Allow(num, "GET", bundle), bundle, "")
 }
 
 //Find checks with Allower.Allow(PUT) to allow/refuse access to this method on _any_ resource
 //associated with this BaseDispatcher.
-func (self *BaseDispatcher) Put(d *restObj,num Id,  bundle PBundle) bool {
+func (self *BaseDispatcher) Put(d *restObj,num Id,  bundle PBundle) Decision {
 	allow, ok := d.put.(Allower)
 	if !ok {
-		return false
+		return self.missing("Allower")
 	}
-	return allow.Allow(num, "PUT", bundle)
+	return Decide(allow.Allow(num, "PUT", bundle), bundle, "")
 }
 
 //Find checks with Allower.Allow(DELETE) to allow/refuse access to this method on _any_ resource
 //associated with this BaseDispatcher.
-func (self *BaseDispatcher) Delete(d *restObj, num Id, bundle PBundle) bool {
+func (self *BaseDispatcher) Delete(d *restObj, num Id, bundle PBundle) Decision {
 	allow, ok := d.del.(Allower)
 	if !ok {
-		return false
+		return self.missing("Allower")
+	}
+	return Decide(allow.Allow(num, "DELETE", bundle), bundle, "")
+}
+
+//UseBearer allows REST requests to authenticate with an "Authorization: Bearer" header
+//resolved by b, in addition to the session cookie.  This only works with the default
+//RawIOHook.  Unauthenticated requests are then challenged for a bearer token.
+func (self *BaseDispatcher) UseBearer(b BearerResolver) {
+	if io, ok := self.IO.(*RawIOHook); ok {
+		io.Bearer = b
+		self.Challenge = fmt.Sprintf("Bearer realm=%q", self.appName)
+	}
+}
+
+//UseAuthorizer replaces the Allow*() checks on resources with a different Authorizer, such
+//as a RoleAuthorizer.  If the Authorizer is also a RoleSource, its roles are used for the
+//field restrictions of the default RawIOHook as well.
+func (self *BaseDispatcher) UseAuthorizer(a Authorizer) {
+	self.Auth = a
+	if rs, ok := a.(RoleSource); ok {
+		if io, ok := self.IO.(*RawIOHook); ok {
+			io.Roles = rs
+		}
 	}
-	return allow.Allow(num, "DELETE", bundle)
 }
@@ -3,6 +3,7 @@ package seven5
 import (
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"io/ioutil"
 	"strings"
@@ -114,3 +115,92 @@ func makeRequestCheckStatusNullBody(t *testing.T, client *http.Client, method st
 		}
 	}
 }
+
+type TicketWire struct {
+	Id    Id
+	Title String255
+}
+
+//ticketResource needs a session with the "read" scope (or no scopes) to list tickets.
+type ticketResource struct {
+}
+
+func (self *ticketResource) AllowRead(pb PBundle) bool {
+	return pb.Session() != nil && HasScope(pb, "read")
+}
+
+func (self *ticketResource) Index(pb PBundle) (interface{}, error) {
+	return []*TicketWire{&TicketWire{Id: 1, Title: "first"}}, nil
+}
+
+type LedgerWire struct {
+	Id    Id
+	Total Integer
+}
+
+//ledgerResource has no Allower, so Find depends on MissingAllow.
+type ledgerResource struct {
+}
+
+func (self *ledgerResource) Find(id Id, pb PBundle) (interface{}, error) {
+	return &LedgerWire{Id: id, Total: 10}, nil
+}
+
+func TestAuthorizationDecisions(t *testing.T) {
+	sm := NewSimpleSessionManager()
+	base := NewBaseDispatcher("myappname", sm)
+	tickets := &ticketResource{}
+	base.ResourceSeparate("TicketWire", &TicketWire{}, tickets, nil, nil, nil, nil)
+	ledger := &ledgerResource{}
+	base.ResourceSeparate("LedgerWire", &LedgerWire{}, nil, ledger, nil, nil, nil)
+	serveMux := NewServeMux()
+	serveMux.Dispatch("/rest/", base)
+	srv := httptest.NewServer(serveMux)
+	defer srv.Close()
+
+	session, _ := sm.Generate(nil, "", nil, "", "")
+	get := func(path string, logged bool) (*http.Response, string) {
+		var c *http.Cookie
+		if logged {
+			c = sessionCookie(base, session)
+		}
+		resp := sendRequest(t, srv, "GET", path, "", c)
+		all, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(all)
+	}
+
+	//no session: log in and try again
+	resp, _ := get("/rest/ticketwire", false)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") != `Cookie realm="myappname"` {
+		t.Errorf("expected 401 with challenge but got %s %v", resp.Status, resp.Header)
+	}
+	//session without the "read" scope is a simple bundle, so this is allowed
+	if resp, _ := get("/rest/ticketwire", true); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected logged in read to be allowed but got %s", resp.Status)
+	}
+
+	resp, body := get("/rest/ledgerwire/1", true)
+	if resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "Allower") {
+		t.Errorf("expected 403 for missing Allower but got %s '%s'", resp.Status, body)
+	}
+	base.MissingAllow = UNAUTHENTICATED
+	if resp, _ := get("/rest/ledgerwire/1", true); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected configured 401 for missing Allower but got %s", resp.Status)
+	}
+	base.MissingAllow = ALLOW
+	if resp, _ := get("/rest/ledgerwire/1", true); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected missing Allower to be allowed but got %s", resp.Status)
+	}
+
+	//a session that the resource refuses is forbidden, not unauthenticated
+	store := NewSimpleAPITokenStore()
+	base.UseBearer(store)
+	_, token, _ := store.Issue(session, "ro", []string{"other"})
+	resp = sendRequest(t, srv, "GET", "/rest/ticketwire", "", nil, "Authorization", "Bearer "+token)
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for token without scope but got %s", resp.Status)
+	}
+	if resp, _ := get("/rest/ticketwire", false); resp.Header.Get("WWW-Authenticate") != `Bearer realm="myappname"` {
+		t.Errorf("expected bearer challenge but got %v", resp.Header)
+	}
+}
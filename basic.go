@@ -4,10 +4,16 @@ import (
 	"errors"
 	_ "fmt"
 	"net/http"
+	"sync"
+	"time"
 )
 
 var BAD_ID = errors.New("Bad id supplied in request")
 
+//NOT_LOGGED_IN is the reason given when a request reaches a resource that needs the logged in
+//user but there is none, such as when an Authorizer lets an anonymous request through.
+var NOT_LOGGED_IN = errors.New("A logged in user is required")
+
 //BasicUser is an interface representing a "basic" user and only understands the value of
 //"email" field on the user.  It requires the implementor to return his Id field (the wire type's Id)
 //and to be able to convert to a "wire type" in an application defined way.
@@ -35,16 +41,32 @@ type BasicUserSupport interface {
 
 //BasicResource is a REST stateless resource.  It does have a field, but this field is set once
 //at creation time.  BasicResource represents a user.
+//If Roles is set, users with ROLE_ADMIN or ROLE_STAFF there are privileged, instead of
+//asking the BasicUserSupport.
 type BasicResource struct {
-	Sup BasicUserSupport
+	Sup   BasicUserSupport
+	Roles RoleStore
 }
 
 //BasicManager stores a copy of the BasicUserSupport object and creates the necessary resources that are
 //going to be needed by the application code.
+//If Identities is set, users may have several identities (one per provider) and logging in
+//with any of them logs in the same user; see IdentitySupport.
+//Staff may impersonate other users (see Impersonate) for ImpersonationTTL; the start and end
+//of each impersonation is recorded in Audit, if it is set.
 type BasicManager struct {
-	Sup     BasicUserSupport
-	Wrapped *SimpleSessionManager
-	Mux     *ServeMux
+	Sup              BasicUserSupport
+	Wrapped          *SimpleSessionManager
+	Mux              *ServeMux
+	Identities       IdentityTable
+	Merge            MergePolicy
+	Roles            RoleStore
+	ImpersonationTTL time.Duration
+	Audit            AuditSink
+	lock             sync.Mutex
+	acting           map[string]*ImpersonationSession
+	links            *expiringMap
+	linkCookie       string
 }
 
 //NewBasicManager creates a new basic user manager with the given supporting object.  This should
@@ -54,30 +76,50 @@ func NewBasicManager(support BasicUserSupport) *BasicManager {
 		Wrapped: NewSimpleSessionManager(),
 		Sup:     support,
 		Mux:     NewServeMux(),
+		acting:  make(map[string]*ImpersonationSession),
+		links:   newExpiringMap(IDENTITY_LINK_TTL),
 	}
 	return result
 }
 
-//Find is required by Session.  Delegated to wrapped simple session manager.
+//Find is required by Session.  Delegated to wrapped simple session manager, except that
+//the session of a staff member who is impersonating someone is an ImpersonationSession.
 func (self *BasicManager) Find(id string) (Session, error) {
-	return self.Wrapped.Find(id)
+	s, err := self.Wrapped.Find(id)
+	if err != nil || s == nil {
+		return s, err
+	}
+	if imp := self.impersonating(id); imp != nil {
+		return imp, nil
+	}
+	return s, nil
 }
 
-//Delete is required by Session.  Delegated to wrapped simple session manager.
+//Delete is required by Session.  Delegated to wrapped simple session manager.  Logging out
+//ends any impersonation.
 func (self *BasicManager) Destroy(id string) error {
+	self.lock.Lock()
+	delete(self.acting, id)
+	self.lock.Unlock()
 	return self.Wrapped.Destroy(id)
 }
 
 //Generate is our override of the default implementation in the SimpleSessionManager.  This
 //ends up calling the BasicUserSupport method of the same name.
-func (self *BasicManager) Generate(c OauthConnection, existingId string, ignore_req *http.Request,
+func (self *BasicManager) Generate(c OauthConnection, existingId string, r *http.Request,
 	ignore_state string, ignore_code string) (Session, error) {
 
-	existing, err := self.Find(existingId)
+	//an impersonation does not carry over to a new login
+	existing, err := self.Wrapped.Find(existingId)
 	if err != nil {
 		return nil, err
 	}
-	s, err := self.Sup.Generate(c, existing)
+	var s Session
+	if ic, ok := c.(IdentityConnection); ok && self.Identities != nil {
+		s, err = self.generateWithIdentity(ic, existing, r)
+	} else {
+		s, err = self.Sup.Generate(c, existing)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -91,20 +133,22 @@ func (self *BasicManager) Generate(c OauthConnection, existingId string, ignore_
 //UserResource produces an implementation of a rest resource that is hooked to the BasicUserSupport object
 //that was passed to this BasicManager at creation-time.
 func (self *BasicManager) UserResource() RestAll {
-	return &BasicResource{self.Sup}
+	return &BasicResource{Sup: self.Sup, Roles: self.Roles}
 }
 
 //This index a list of size one which is the currently logged in user unless the user is staff.
 //Staff users are shown all users, unless the query string specifies self=true.  Because of
 //AllowRead this will never be called unless the user at least has a session.
 func (self *BasicResource) Index(bundle PBundle) (interface{}, error) {
-
-	b := bundle.Session().(BasicUser)
+	b, err := loggedInUser(bundle)
+	if err != nil {
+		return nil, err
+	}
 
 	//normal case, should be a list of size one with the _current_ user's info
 	list := []interface{}{b.ToWire()}
 	_, haveSelf := bundle.Query("self")
-	priv := self.Sup.IsStaff(b) || self.Sup.IsAdmin(b)
+	priv := self.privileged(b)
 	if haveSelf || !priv {
 		return list, nil
 	}
@@ -118,7 +162,10 @@ func (self *BasicResource) Index(bundle PBundle) (interface{}, error) {
 //Because of Allow, this resource is _only_ called when the logged in user asks
 //about himself or if the user is priviledged they can ask about anyone.
 func (self *BasicResource) Find(id Id, bundle PBundle) (interface{}, error) {
-	b := bundle.Session().(BasicUser)
+	b, err := loggedInUser(bundle)
+	if err != nil {
+		return nil, err
+	}
 
 	//simple case avoids the search
 	if b.WireId() == id {
@@ -181,11 +228,11 @@ func (self *BasicResource) AllowWrite(bundle PBundle) bool {
 //Users can only call Find, and Put methods on themselves.  Users cannot call DELETE, even on self.  
 //Priviledged members can call any method on any id.
 func (self *BasicResource) Allow(id Id, method string, bundle PBundle) bool {
-	if bundle.Session() == nil {
+	u, ok := UnwrapSession(bundle.Session()).(BasicUser)
+	if !ok {
 		return false
 	}
-	u := bundle.Session().(BasicUser)
-	if self.Sup.IsStaff(u) || self.Sup.IsAdmin(u) {
+	if self.privileged(u) {
 		return true
 	}
 	//this is to prevent someone deleting themself
@@ -194,3 +241,19 @@ func (self *BasicResource) Allow(id Id, method string, bundle PBundle) bool {
 	}
 	return u.WireId() == id
 }
+
+//loggedInUser returns the BasicUser of the bundle, or a 401 error if there isn't one.  The
+//Allow methods of the resources normally prevent this, but an Authorizer replaces them.
+func loggedInUser(bundle PBundle) (BasicUser, error) {
+	u, ok := UnwrapSession(bundle.Session()).(BasicUser)
+	if !ok {
+		return nil, HTTPError(http.StatusUnauthorized, NOT_LOGGED_IN.Error())
+	}
+	return u, nil
+}
+
+//privileged is true for staff and admin users.  A staff member impersonating a user is
+//not privileged.
+func (self *BasicResource) privileged(u BasicUser) bool {
+	return privilegedUser(self.Sup, self.Roles, u)
+}
@@ -0,0 +1,318 @@
+package seven5
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//API_TOKEN_PREFIX is put on the front of every token we issue so that leaked tokens are
+//easy to recognize (e.g. by secret scanners).
+const API_TOKEN_PREFIX = "s5_"
+
+const (
+	//SCOPE_READ and SCOPE_WRITE are the scopes RoleAuthorizer asks a bearer token for by
+	//default: reading (index and find) and changing (post, put and delete) resources.
+	SCOPE_READ  = "read"
+	SCOPE_WRITE = "write"
+)
+
+var (
+	BAD_BEARER_TOKEN  = errors.New("Bearer token is not valid")
+	NO_SUCH_API_TOKEN = errors.New("No such API token")
+)
+
+//BearerResolver turns the token from an "Authorization: Bearer" header into the session it
+//acts for and the scopes it was granted.  It should return BAD_BEARER_TOKEN if the token
+//is unknown, expired, or revoked.  A nil slice of scopes means the token is not limited
+//to any scopes; it is as good as the session cookie.  Set RawIOHook.Bearer to enable
+//bearer tokens.
+type BearerResolver interface {
+	ResolveBearer(token string) (Session, []string, error)
+}
+
+//MultiBearerResolver tries each of its resolvers in turn, so that (for example) both API
+//tokens and JWT access tokens can be accepted.
+type MultiBearerResolver []BearerResolver
+
+func (self MultiBearerResolver) ResolveBearer(token string) (Session, []string, error) {
+	for _, b := range self {
+		s, scopes, err := b.ResolveBearer(token)
+		if err != BAD_BEARER_TOKEN {
+			return s, scopes, err
+		}
+	}
+	return nil, nil, BAD_BEARER_TOKEN
+}
+
+//ScopedBundle is implemented by PBundles that can be limited to a set of scopes.  Requests
+//authenticated with a cookie are not limited (Scoped returns false) since the user is
+//present; requests authenticated with a bearer token may only do what the token's scopes
+//allow.
+type ScopedBundle interface {
+	Scoped() bool
+	Scopes() []string
+}
+
+//HasScope is for use in Allower (and friends) implementations.  It returns true if the
+//request is allowed to act with the given scope: it is not limited by scopes at all or
+//the token used includes the scope.  Note that this says nothing about whether there is
+//a session; check that separately.
+func HasScope(pb PBundle, scope string) bool {
+	sb, ok := pb.(ScopedBundle)
+	if !ok || !sb.Scoped() {
+		return true
+	}
+	for _, s := range sb.Scopes() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//bearerToken returns the token in the Authorization header, if it is a bearer token.
+func bearerToken(r *http.Request) (string, bool) {
+	h := r.Header.Get("Authorization")
+	if len(h) < 7 || !strings.EqualFold(h[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(h[7:]), true
+}
+
+//APIToken is the record of a personal access token.  The secret itself is never stored,
+//only a hash of it, so it can only be shown to the user when it is issued.
+type APIToken struct {
+	Id      Id
+	Name    string
+	Scopes  []string
+	Created time.Time
+	Owner   string
+	session Session
+	hash    [sha256.Size]byte
+}
+
+//APITokenStore issues, resolves and revokes API tokens.  Tokens belong to the owner of the
+//session that issued them (see TokenKeyer) and resolve to that session.
+type APITokenStore interface {
+	BearerResolver
+	Issue(s Session, name string, scopes []string) (*APIToken, string, error)
+	List(s Session) ([]*APIToken, error)
+	Revoke(s Session, id Id) error
+}
+
+//SimpleAPITokenStore is an APITokenStore that keeps tokens in memory.  Since the tokens
+//refer to live sessions, it is only useful if sessions last as long as the tokens; a
+//persistent implementation should map the owner to a new session instead.
+type SimpleAPITokenStore struct {
+	sync.Mutex
+	nextId Id
+	tokens map[[sha256.Size]byte]*APIToken
+}
+
+//NewSimpleAPITokenStore returns an empty, in-memory token store.
+func NewSimpleAPITokenStore() *SimpleAPITokenStore {
+	return &SimpleAPITokenStore{
+		nextId: 1,
+		tokens: make(map[[sha256.Size]byte]*APIToken),
+	}
+}
+
+//Issue creates a new token and returns its record and the secret to hand to the user.
+func (self *SimpleAPITokenStore) Issue(s Session, name string, scopes []string) (*APIToken, string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	secret := API_TOKEN_PREFIX + base64.RawURLEncoding.EncodeToString(b)
+	if scopes == nil {
+		//nil would mean "unlimited" to BearerResolver
+		scopes = []string{}
+	}
+	self.Lock()
+	defer self.Unlock()
+	t := &APIToken{
+		Id:      self.nextId,
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now(),
+		Owner:   tokenKey(s),
+		session: s,
+		hash:    sha256.Sum256([]byte(secret)),
+	}
+	self.nextId++
+	self.tokens[t.hash] = t
+	return t, secret, nil
+}
+
+func (self *SimpleAPITokenStore) ResolveBearer(token string) (Session, []string, error) {
+	self.Lock()
+	defer self.Unlock()
+	t, ok := self.tokens[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, nil, BAD_BEARER_TOKEN
+	}
+	return t.session, t.Scopes, nil
+}
+
+//List returns the tokens owned by the owner of s, oldest first.
+func (self *SimpleAPITokenStore) List(s Session) ([]*APIToken, error) {
+	self.Lock()
+	defer self.Unlock()
+	result := []*APIToken{}
+	owner := tokenKey(s)
+	for _, t := range self.tokens {
+		if t.Owner == owner {
+			result = append(result, t)
+		}
+	}
+	sort.Sort(tokensById(result))
+	return result, nil
+}
+
+//Revoke removes a token.  Only the owner may revoke a token; for anyone else the token
+//does not exist.
+func (self *SimpleAPITokenStore) Revoke(s Session, id Id) error {
+	self.Lock()
+	defer self.Unlock()
+	owner := tokenKey(s)
+	for h, t := range self.tokens {
+		if t.Id == id && t.Owner == owner {
+			delete(self.tokens, h)
+			return nil
+		}
+	}
+	return NO_SUCH_API_TOKEN
+}
+
+type tokensById []*APIToken
+
+func (self tokensById) Len() int           { return len(self) }
+func (self tokensById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self tokensById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+//ApiTokenWire is the wire type for the API token resource.  Scopes are separated by spaces,
+//as in oauth.  Token is only filled in on the response to the POST that creates it.
+type ApiTokenWire struct {
+	Id      Id
+	Name    String255
+	Scopes  String255
+	Token   String255
+	Created DateTime
+}
+
+//APITokenResource lets a logged-in user issue (POST), list (GET) and revoke (DELETE) their
+//API tokens.  Only sessions established with a cookie may manage tokens, so a token can
+//never be used to create more tokens.  If AllowedScopes is not empty, requested scopes
+//must come from it.  Map it with ResourceSeparate, since it does not support Find or Put:
+//
+//	disp.ResourceSeparate("ApiToken", &ApiTokenWire{}, res, nil, res, nil, res)
+type APITokenResource struct {
+	Store         APITokenStore
+	AllowedScopes []string
+}
+
+//NewAPITokenResource returns a resource that manages the tokens in store.
+func NewAPITokenResource(store APITokenStore, allowedScopes []string) *APITokenResource {
+	return &APITokenResource{Store: store, AllowedScopes: allowedScopes}
+}
+
+func (self *APITokenResource) toWire(t *APIToken) *ApiTokenWire {
+	return &ApiTokenWire{
+		Id:      t.Id,
+		Name:    String255(t.Name),
+		Scopes:  String255(strings.Join(t.Scopes, " ")),
+		Created: DateTime(float64(t.Created.UnixNano()) / float64(time.Second)),
+	}
+}
+
+//interactive is true if the request comes from a user with a session cookie.
+func (self *APITokenResource) interactive(pb PBundle) bool {
+	if pb.Session() == nil {
+		return false
+	}
+	sb, ok := pb.(ScopedBundle)
+	return !ok || !sb.Scoped()
+}
+
+func (self *APITokenResource) AllowRead(pb PBundle) bool {
+	return self.interactive(pb)
+}
+
+func (self *APITokenResource) AllowWrite(pb PBundle) bool {
+	return self.interactive(pb)
+}
+
+func (self *APITokenResource) Allow(id Id, method string, pb PBundle) bool {
+	return self.interactive(pb)
+}
+
+func (self *APITokenResource) Index(pb PBundle) (interface{}, error) {
+	if pb.Session() == nil {
+		return nil, HTTPError(http.StatusUnauthorized, NOT_LOGGED_IN.Error())
+	}
+	tokens, err := self.Store.List(pb.Session())
+	if err != nil {
+		return nil, err
+	}
+	result := []*ApiTokenWire{}
+	for _, t := range tokens {
+		result = append(result, self.toWire(t))
+	}
+	return result, nil
+}
+
+func (self *APITokenResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	if pb.Session() == nil {
+		return nil, HTTPError(http.StatusUnauthorized, NOT_LOGGED_IN.Error())
+	}
+	in, ok := i.(*ApiTokenWire)
+	if !ok || in == nil {
+		return nil, HTTPError(http.StatusBadRequest, "a name and scopes are required to create a token")
+	}
+	scopes := strings.Fields(string(in.Scopes))
+	for _, s := range scopes {
+		if !self.allowed(s) {
+			return nil, HTTPError(http.StatusBadRequest, fmt.Sprintf("unknown scope: %s", s))
+		}
+	}
+	t, secret, err := self.Store.Issue(pb.Session(), string(TrimSpace(in.Name)), scopes)
+	if err != nil {
+		return nil, err
+	}
+	result := self.toWire(t)
+	result.Token = String255(secret)
+	return result, nil
+}
+
+func (self *APITokenResource) Delete(id Id, pb PBundle) (interface{}, error) {
+	if pb.Session() == nil {
+		return nil, HTTPError(http.StatusUnauthorized, NOT_LOGGED_IN.Error())
+	}
+	if err := self.Store.Revoke(pb.Session(), id); err != nil {
+		if err == NO_SUCH_API_TOKEN {
+			return nil, HTTPError(http.StatusNotFound, err.Error())
+		}
+		return nil, err
+	}
+	return &ApiTokenWire{Id: id}, nil
+}
+
+func (self *APITokenResource) allowed(scope string) bool {
+	if len(self.AllowedScopes) == 0 {
+		return true
+	}
+	for _, s := range self.AllowedScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
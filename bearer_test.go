@@ -0,0 +1,127 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//NoteWire is the wire type of scopedResource.
+type NoteWire struct {
+	Id   Id
+	Text String255
+}
+
+//scopedResource lets anyone with a session read but needs the "write" scope to post.
+type scopedResource struct {
+}
+
+func (self *scopedResource) AllowRead(pb PBundle) bool {
+	return pb.Session() != nil && HasScope(pb, "read")
+}
+
+func (self *scopedResource) AllowWrite(pb PBundle) bool {
+	return pb.Session() != nil && HasScope(pb, "write")
+}
+
+func (self *scopedResource) Index(pb PBundle) (interface{}, error) {
+	return []*NoteWire{&NoteWire{Id: 1, Text: String255(pb.Session().SessionId())}}, nil
+}
+
+func (self *scopedResource) Post(i interface{}, pb PBundle) (interface{}, error) {
+	n := i.(*NoteWire)
+	n.Id = 2
+	return n, nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestBearerTokens(t *testing.T) {
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	store := NewSimpleAPITokenStore()
+	disp.UseBearer(store)
+	res := &scopedResource{}
+	disp.ResourceSeparate("NoteWire", &NoteWire{}, res, nil, res, nil, nil)
+	tokens := NewAPITokenResource(store, []string{"read", "write"})
+	disp.ResourceSeparate("ApiToken", &ApiTokenWire{}, tokens, nil, tokens, nil, tokens)
+
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	session, _ := sm.Generate(nil, "", nil, "", "")
+	cookie := &http.Cookie{Name: disp.IO.CookieMapper().CookieName(), Value: session.SessionId()}
+	do := func(method string, path string, body string, c *http.Cookie, bearer string) *http.Response {
+		if bearer == "" {
+			return sendRequest(t, srv, method, path, body, c)
+		}
+		return sendRequest(t, srv, method, path, body, c, "Authorization", "Bearer "+bearer)
+	}
+	issue := func(scopes string) *ApiTokenWire {
+		resp := do("POST", "/rest/apitoken", fmt.Sprintf(`{"Name":"script","Scopes":"%s"}`, scopes), cookie, "")
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("unable to issue token: %s", resp.Status)
+		}
+		w := &ApiTokenWire{}
+		json.NewDecoder(resp.Body).Decode(w)
+		if !strings.HasPrefix(string(w.Token), API_TOKEN_PREFIX) {
+			t.Fatalf("bad token issued: %+v", w)
+		}
+		return w
+	}
+
+	readOnly := issue("read")
+	readWrite := issue("read write")
+	if resp := do("POST", "/rest/apitoken", `{"Name":"x","Scopes":"admin"}`, cookie, ""); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected unknown scope to be refused but got %s", resp.Status)
+	}
+
+	//a token acts as the session that issued it
+	resp := do("GET", "/rest/notewire", "", nil, string(readOnly.Token))
+	var notes []*NoteWire
+	json.NewDecoder(resp.Body).Decode(&notes)
+	if resp.StatusCode != http.StatusOK || len(notes) != 1 || string(notes[0].Text) != session.SessionId() {
+		t.Errorf("expected token to read as the session: %s %v", resp.Status, notes)
+	}
+	cases := []struct {
+		name   string
+		bearer string
+		cookie *http.Cookie
+		status int
+	}{
+		{"read only token", string(readOnly.Token), nil, http.StatusForbidden},
+		{"read write token", string(readWrite.Token), nil, http.StatusCreated},
+		{"cookie", "", cookie, http.StatusCreated},
+		{"bad token", "s5_nope", cookie, http.StatusUnauthorized},
+		{"nobody", "", nil, http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		if resp := do("POST", "/rest/notewire", `{"Text":"hi"}`, c.cookie, c.bearer); resp.StatusCode != c.status {
+			t.Errorf("%s: expected %d but got %s", c.name, c.status, resp.Status)
+		}
+	}
+	if resp := do("GET", "/rest/notewire", "", nil, "s5_nope"); resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected a challenge for a bad token")
+	}
+
+	//tokens can't manage tokens, the cookie can
+	if resp := do("GET", "/rest/apitoken", "", nil, string(readWrite.Token)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("token should not be able to list tokens: %s", resp.Status)
+	}
+	resp = do("GET", "/rest/apitoken", "", cookie, "")
+	var list []*ApiTokenWire
+	json.NewDecoder(resp.Body).Decode(&list)
+	if len(list) != 2 || list[0].Token != "" || list[1].Scopes != "read write" {
+		t.Errorf("bad token list: %+v", list)
+	}
+	if resp := do("DELETE", fmt.Sprintf("/rest/apitoken/%d", readWrite.Id), "", cookie, ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("unable to revoke: %s", resp.Status)
+	}
+	if resp := do("GET", "/rest/notewire", "", nil, string(readWrite.Token)); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("revoked token still works: %s", resp.Status)
+	}
+}
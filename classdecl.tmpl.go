@@ -1,107 +1,83 @@
 package seven5
 
 const classdecl_tmpl = `
-{{define "FIELD_DECL"}}
-	{{range .Struct}} 
-		{{.Dart}} {{.Name}};
-	{{end}}	
-{{end}}
-
-{{define "COPY_JSON_FIELDS"}}
-	{{range .Struct}}
-
-		{{if .StructName}}
-			this.{{.Name}} = new {{.StructName}}.fromJson(json["{{.Name}}"]);
-		{{else}}
-			this.{{.Name}} = json["{{.Name}}"];
-			{{end}}{{/* if */}}
-		{{end}} {{/* range */}}
-{{end}} {{/* define */}}
-
-{{define "EMIT_JSON_FIELDS"}}
-Map toMapForJson() {
-	Map result = new Map();
-	{{range .Struct}}
-		result['{{.Name}}']={{.Name}};
-	{{end}} {{/* range */}}
-	return result;
-}
-{{end}} {{/* define */}}
+{{- define "FIELD_DECL" -}}
+{{range .Struct}}	{{.Dart}} {{.Name}}{{with .DartDefault}} = {{.}}{{end}};
+{{end -}}
+{{end -}}
 
-class {{.Name}} {
-	{{template "FIELD_DECL" .}}
+{{- define "JSON_METHODS"}}	//nothing to do in default constructor
+	{{.ClassName}}();
 
-	static String resourceURL = "{{.RestPrefix}}{{tolower .Name}}/";
-
-	static void Index(Function successFunc, [Function errorFunc, Map headers, Map requestParameters]) {
-		Seven5Support.Index(resourceURL, ()=>new List<{{.Name}}>(), ()=>new {{.Name}}(), successFunc, errorFunc, headers, requestParameters);
+	//convenience constructor
+	factory {{.ClassName}}.fromJson(Map<String, dynamic> json) {
+		return {{.ClassName}}().copyFromJson(json);
 	}
 
-	static void Delete(int id, Function successFunc, [Function errorFunc, Map headers, Map requestParameters]) {
-		Seven5Support.Delete(id, resourceURL, new {{.Name}}(), successFunc, errorFunc, headers, requestParameters);
+	//this is the "magic" that changes from untyped Json to typed object
+	{{.ClassName}} copyFromJson(Map<String, dynamic> json) {
+{{range .Struct}}		{{.Name}} = {{.DartFromJson}};
+{{end}}		return this;
 	}
 
-	void Put(Function successFunc, [Function errorFunc, Map headers, Map requestParameters]) {
-		Seven5Support.Put(JSON.stringify(this), Id, resourceURL, new {{.Name}}(), successFunc, errorFunc, headers, requestParameters);
+	//this converts the object to a map so JSON serialization will like it
+	Map<String, dynamic> toJson() {
+		return <String, dynamic>{
+{{range .Struct}}			"{{.Name}}": {{.DartToJson}},
+{{end}}		};
 	}
+{{end -}}
+
+{{- define "CLASSDECL_TMPL" -}}
+class {{.ClassName}} {
+{{template "FIELD_DECL" .}}
+	static const String resourceURL = "{{.RestPrefix}}{{tolower .Name}}/";
 
-	static void Post(dynamic example, Function successFunc, [Function errorFunc, Map headers, Map requestParameters]) {
-		Seven5Support.Post(JSON.stringify(example), resourceURL, new {{.Name}}(), successFunc, errorFunc, headers, requestParameters);
+	static Future<List<{{.ClassName}}>> Index({Map<String, String>? headers, Map<String, String>? params}) {
+		return Seven5Support.Index(resourceURL, {{.ClassName}}.fromJson, headers, params);
 	}
 
-	void Find(int id, Function successFunc, [Function errorFunc, Map headers, Map requestParameters]) {
-		Seven5Support.Find(id, resourceURL, new {{.Name}}(), successFunc, errorFunc, headers, requestParameters);
+	static Future<{{.ClassName}}> Find(int id, {Map<String, String>? headers, Map<String, String>? params}) {
+		return Seven5Support.Find(resourceURL, id, {{.ClassName}}.fromJson, headers, params);
 	}
-	
-	//convenience constructor
-	{{.Name}}.fromJson(Map json) {
-		copyFromJson(json);
+
+	static Future<{{.ClassName}}> Post({{.ClassName}} example, {Map<String, String>? headers, Map<String, String>? params}) {
+		return Seven5Support.Post(resourceURL, example.toJson(), {{.ClassName}}.fromJson, headers, params);
 	}
-	
-	//nothing to do in default constructor
-	{{.Name}}();
-	
-	//this is the "magic" that changes from untyped Json to typed object
-	{{.Name}} copyFromJson(Map json) {
-		{{template "COPY_JSON_FIELDS" .}}
-		return this;
+{{if .HasId}}
+	Future<{{.ClassName}}> Put({Map<String, String>? headers, Map<String, String>? params}) {
+		return Seven5Support.Put(resourceURL, Id, toJson(), {{.ClassName}}.fromJson, headers, params);
 	}
-	
-	{{template "EMIT_JSON_FIELDS" .}}
-	
-	//this converts the object to a map so JSON serialization will like it
-	toJson() {
-		try {
-			return this.toMapForJson();
-		} catch (e) {
-			print("something went wrong during JSON encoding: ${e}");
-		}
+{{end}}
+	static Future<{{.ClassName}}> Delete(int id, {Map<String, String>? headers, Map<String, String>? params}) {
+		return Seven5Support.Delete(resourceURL, id, {{.ClassName}}.fromJson, headers, params);
 	}
-}
 
-{{define "SUPPORT_STRUCT_TMPL"}}
-	class {{.StructName}} {
-		{{template "FIELD_DECL" .}}
-
-		//convenience constructor
-		{{.StructName}}.fromJson(Map json) {
-			copyFromJson(json);
-		}
-	
-		//nothing to do in default constructor
-		{{.StructName}}();
-	
-		//this is the "magic" that changes from untyped Json to typed object
-		copyFromJson(Map json) {
-			{{template "COPY_JSON_FIELDS" .}}
-			return this;
-		}
-		{{template "EMIT_JSON_FIELDS" .}}
-		
-		//this converts the object to a map so JSON serialization will like it
-		toJson() {
-			return this.toMapForJson();
-		}
-		
+{{template "JSON_METHODS" .}}}
+{{end -}}
+
+{{- define "SUPPORT_STRUCT_TMPL" -}}
+class {{.ClassName}} {
+{{template "FIELD_DECL" .}}
+{{template "JSON_METHODS" .}}}
+{{end -}}
+
+{{- define "ENUM_TMPL" -}}
+enum {{.EnumName}} {
+{{range $i, $c := .Constants}}{{if $i}},
+{{end}}	{{$c.Ident}}({{$c.Literal}}){{end}};
+
+	final String value;
+
+	const {{.EnumName}}(this.value);
+
+	//fromJson throws if the server sends a value this code does not know about
+	static {{.EnumName}} fromJson(dynamic json) {
+		return {{.EnumName}}.values.firstWhere((e) => e.value == json,
+			orElse: () => throw ArgumentError("unknown {{.EnumName}}: $json"));
 	}
-{{end}} {{/*define*/}}`
+
+	String toJson() => value;
+}
+{{end -}}
+`
@@ -31,8 +31,15 @@ func containsType(all []*FieldDescription, candidate *FieldDescription) bool {
 }
 
 //collectStructs is a recursive walk of FieldDescription structure to find all 
-//types that are known as structs.  This full list is needed to generate code.
+//types that are known as structs, including those inside arrays and maps.  This full list is needed
+//to generate code.
 func collectStructs(current *FieldDescription) []*FieldDescription {
+	if current.Array != nil {
+		return collectStructs(current.Array)
+	}
+	if current.Map != nil {
+		return collectStructs(current.Map)
+	}
 	result := []*FieldDescription{}
 	if current.StructName != "" {
 		result = append(result, current)
@@ -47,15 +54,85 @@ func collectStructs(current *FieldDescription) []*FieldDescription {
 	return result
 }
 
+//collectEnums is a recursive walk of FieldDescription structure to find all the enumerations,
+//including those inside nested structs, arrays and maps.  Each appears once.
+func collectEnums(current *FieldDescription) []*FieldDescription {
+	result := []*FieldDescription{}
+	var nested []*FieldDescription
+	switch {
+	case current.EnumName != "":
+		return append(result, current)
+	case current.Array != nil:
+		nested = collectEnums(current.Array)
+	case current.Map != nil:
+		nested = collectEnums(current.Map)
+	default:
+		for _, c := range current.Struct {
+			nested = append(nested, collectEnums(c)...)
+		}
+	}
+	for _, e := range nested {
+		if !containsEnum(result, e) {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+//containsEnum checks a slice of FieldDescriptions for an enumeration with the same EnumName as
+//the candidate.
+func containsEnum(all []*FieldDescription, candidate *FieldDescription) bool {
+	for _, f := range all {
+		if f.EnumName == candidate.EnumName {
+			return true
+		}
+	}
+	return false
+}
+
+//holderEnums returns the enumerations used by any of the types in the holder.
+func holderEnums(holder TypeHolder) []*FieldDescription {
+	result := []*FieldDescription{}
+	for _, d := range holder.All() {
+		for _, e := range collectEnums(d) {
+			if !containsEnum(result, e) {
+				result = append(result, e)
+			}
+		}
+	}
+	return result
+}
+
+//enumConstant is one value of an enumeration in generated code: the name of the constant in
+//the target language and the literal of the value.
+type enumConstant struct {
+	Ident   string
+	Literal string
+}
+
+//enumWrapper adds the constants of an enumeration to a FieldDescription for the templates.
+type enumWrapper struct {
+	*FieldDescription
+	Constants []*enumConstant
+}
+
 //fdWrapper is a wrapper and field description that adds a field to help the code generator know what
 //the rest prefix is.
 type fdWrapper struct {
 	*FieldDescription
 	RestPrefix string
 }
+//dartWrapper adds the name of the generated class to a FieldDescription, since resources
+//are named by their Name and support structs by their StructName.
+type dartWrapper struct {
+	*FieldDescription
+	RestPrefix string
+	ClassName  string
+}
+
 func generateDartForResource(f *FieldDescription, prefix string) string {
 	var buffer bytes.Buffer
-	w:=&fdWrapper{f,prefix}
+	w:=&dartWrapper{f,prefix,f.Name}
 	if err := codegenTemplate.ExecuteTemplate(&buffer, "CLASSDECL_TMPL", w); err != nil {
 		return err.Error()
 	}
@@ -64,19 +141,34 @@ func generateDartForResource(f *FieldDescription, prefix string) string {
 
 func generateDartForSupportStruct(f *FieldDescription) string {
 	var buffer bytes.Buffer
-	if err := codegenTemplate.ExecuteTemplate(&buffer, "SUPPORT_STRUCT_TMPL", f); err != nil {
+	w:=&dartWrapper{f,"",f.StructName}
+	if err := codegenTemplate.ExecuteTemplate(&buffer, "SUPPORT_STRUCT_TMPL", w); err != nil {
 		return err.Error()
 	}
 	return buffer.String()
 }
 
 //Dart returns the Dart name for a particular _type_ name or panics if it does not understand.
+//Structs are nullable, since a pointer to a struct may be nil on the go side.  Inside lists and
+//maps only pointers to structs are nullable, since the elements of a []T can't be nil.
 func (self *FieldDescription) Dart() string {
+	return self.dartType(true)
+}
+
+func (self *FieldDescription) dartType(nullable bool) string {
+	if self.Optional {
+		basic := *self
+		basic.Optional = false
+		return basic.dartType(false) + "?"
+	}
+	if self.EnumName != "" {
+		return self.EnumName
+	}
 	switch self.TypeName {
 	case "Boolean":
 		return "bool"
 	case "DateTime":
-		return "int"
+		return "DateTime"
 	case "Integer":
 		return "int"
 	case "Floating":
@@ -89,14 +181,206 @@ func (self *FieldDescription) Dart() string {
 		return "int"
 	}
 	if self.Array != nil {
-		return "List<" + self.Array.Dart() + ">"
+		return "List<" + self.Array.dartType(false) + ">"
+	}
+	if self.Map != nil {
+		return "Map<String, " + self.Map.dartType(false) + ">"
 	}
 	if self.StructName != "" {
+		if nullable || self.Pointer {
+			return self.StructName + "?"
+		}
 		return self.StructName
 	}
 	panic(fmt.Sprintf("unable to convert type %s to Dart type!", self.TypeName))
 }
 
+//DartDefault returns the initial value of a field in a newly created object, or "" for
+//fields that start as null.
+func (self *FieldDescription) DartDefault() string {
+	if self.Optional {
+		return ""
+	}
+	if self.EnumName != "" {
+		return self.EnumName + "." + dartEnumConstants(self)[0].Ident
+	}
+	switch self.TypeName {
+	case "Boolean":
+		return "false"
+	case "DateTime":
+		return "DateTime.fromMicrosecondsSinceEpoch(0, isUtc: true)"
+	case "Integer", "Id":
+		return "0"
+	case "Floating":
+		return "0.0"
+	case "String255", "Textblob":
+		return `""`
+	}
+	if self.Array != nil {
+		return "[]"
+	}
+	if self.Map != nil {
+		return "{}"
+	}
+	return ""
+}
+
+//DartFromJson returns the Dart expression that converts this field of the decoded JSON
+//object (called json) to its Dart type.
+func (self *FieldDescription) DartFromJson() string {
+	return dartDecode(self, fmt.Sprintf(`json["%s"]`, self.Name), true)
+}
+
+//dartReserved are the names that can't be used for the constants of a dart enum, either because
+//they are reserved words or because enums already have members with those names.
+var dartReserved = map[string]bool{
+	"assert": true, "break": true, "case": true, "catch": true, "class": true, "const": true,
+	"continue": true, "default": true, "do": true, "else": true, "enum": true, "extends": true,
+	"false": true, "final": true, "finally": true, "for": true, "if": true, "in": true, "is": true,
+	"new": true, "null": true, "rethrow": true, "return": true, "super": true, "switch": true,
+	"this": true, "throw": true, "true": true, "try": true, "var": true, "void": true,
+	"while": true, "with": true, "values": true, "value": true, "index": true, "name": true,
+	"hashCode": true, "runtimeType": true, "toString": true, "noSuchMethod": true,
+	"fromJson": true, "toJson": true,
+}
+
+//dartEnumConstants returns the names and literals of the values of an enumeration in dart.
+//Characters that can't be in an identifier become _ and names that would clash get a _ added.
+func dartEnumConstants(f *FieldDescription) []*enumConstant {
+	result := []*enumConstant{}
+	used := make(map[string]bool)
+	for _, v := range f.Enum {
+		ident := []byte(v)
+		for i, c := range ident {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+				ident[i] = '_'
+			}
+		}
+		name := string(ident)
+		if name == "" || name[0] == '_' || (name[0] >= '0' && name[0] <= '9') {
+			name = "v" + name
+		}
+		for dartReserved[name] || used[name] {
+			name += "_"
+		}
+		used[name] = true
+		result = append(result, &enumConstant{name, dartString(v)})
+	}
+	return result
+}
+
+//dartString returns s as a dart string literal.  Besides quotes and backslashes, $ must be
+//escaped so it is not taken as interpolation.
+func dartString(s string) string {
+	var buffer bytes.Buffer
+	buffer.WriteString(`"`)
+	for _, r := range s {
+		switch {
+		case r == '"' || r == '\\' || r == '$':
+			buffer.WriteRune('\\')
+			buffer.WriteRune(r)
+		case r < 0x20:
+			fmt.Fprintf(&buffer, "\\u{%x}", r)
+		default:
+			buffer.WriteRune(r)
+		}
+	}
+	buffer.WriteString(`"`)
+	return buffer.String()
+}
+
+func generateDartForEnum(f *FieldDescription) string {
+	var buffer bytes.Buffer
+	if err := codegenTemplate.ExecuteTemplate(&buffer, "ENUM_TMPL", &enumWrapper{f, dartEnumConstants(f)}); err != nil {
+		return err.Error()
+	}
+	return buffer.String()
+}
+
+//DartToJson returns the Dart expression that converts this field to a value that jsonEncode
+//produces in the form the server expects.
+func (self *FieldDescription) DartToJson() string {
+	return dartEncode(self, self.Name, true)
+}
+
+//dartDecode converts the untyped JSON value expr to the Dart type of f.  Numbers are
+//converted with toInt/toDouble because Go writes whole floats without a decimal point.
+//Go sends nil slices and maps as null, so they decode as empty ones.
+func dartDecode(f *FieldDescription, expr string, nullable bool) string {
+	if f.Optional {
+		basic := *f
+		basic.Optional = false
+		return fmt.Sprintf("%s == null ? null : %s", expr, dartDecode(&basic, expr, false))
+	}
+	if f.EnumName != "" {
+		return f.EnumName + ".fromJson(" + expr + ")"
+	}
+	switch f.TypeName {
+	case "Boolean":
+		return expr + " as bool"
+	case "Integer", "Id":
+		return "(" + expr + " as num).toInt()"
+	case "Floating":
+		return "(" + expr + " as num).toDouble()"
+	case "String255", "Textblob":
+		return expr + " as String"
+	case "DateTime":
+		return "Seven5Support.dateTimeFromJson(" + expr + ")"
+	}
+	if f.Array != nil {
+		return fmt.Sprintf("((%s as List<dynamic>?) ?? []).map<%s>((e) => %s).toList()", expr,
+			f.Array.dartType(false), dartDecode(f.Array, "e", false))
+	}
+	if f.Map != nil {
+		return fmt.Sprintf("((%s as Map<String, dynamic>?) ?? {}).map<String, %s>((k, e) => MapEntry(k, %s))", expr,
+			f.Map.dartType(false), dartDecode(f.Map, "e", false))
+	}
+	if f.StructName != "" {
+		if nullable || f.Pointer {
+			return fmt.Sprintf("%s == null ? null : %s.fromJson(%s as Map<String, dynamic>)", expr, f.StructName, expr)
+		}
+		return fmt.Sprintf("%s.fromJson(%s as Map<String, dynamic>)", f.StructName, expr)
+	}
+	panic(fmt.Sprintf("unable to convert type %s to Dart type!", f.TypeName))
+}
+
+//dartEncode is the inverse of dartDecode.
+func dartEncode(f *FieldDescription, expr string, nullable bool) string {
+	if f.EnumName != "" && f.Optional {
+		return expr + "?.toJson()"
+	}
+	if f.EnumName != "" {
+		return expr + ".toJson()"
+	}
+	if f.TypeName == "DateTime" && f.Optional {
+		return expr + " == null ? null : Seven5Support.dateTimeToJson(" + expr + "!)"
+	}
+	if f.TypeName == "DateTime" {
+		return "Seven5Support.dateTimeToJson(" + expr + ")"
+	}
+	if f.Array != nil {
+		inner := dartEncode(f.Array, "e", false)
+		if inner == "e" {
+			return expr
+		}
+		return fmt.Sprintf("%s.map((e) => %s).toList()", expr, inner)
+	}
+	if f.Map != nil {
+		inner := dartEncode(f.Map, "e", false)
+		if inner == "e" {
+			return expr
+		}
+		return fmt.Sprintf("%s.map((k, e) => MapEntry(k, %s))", expr, inner)
+	}
+	if f.StructName != "" {
+		if nullable || f.Pointer {
+			return expr + "?.toJson()"
+		}
+		return expr + ".toJson()"
+	}
+	return expr
+}
+
 //HasId returns true if this struct has a field Id of type seven5.Id.
 func (self *FieldDescription) HasId() bool {
 	if len(self.Struct) == 0 {
@@ -160,15 +444,18 @@ func dartPrettyPrint(raw string) []byte {
 
 //GeneratedDartContent adds an http handler for a particular path.  The restPrefix must be the same one
 //used by the TypeHolder (probably a dispatcher) to map its rest resources.
-//func GeneratedDartContent(mux *ServeMux, holder TypeHolder, urlPath string, restPrefix string) {
-//	mux.HandleFunc(fmt.Sprintf("%sdart", urlPath), generateDartFunc(holder, restPrefix))
-//}
+func GeneratedDartContent(mux *ServeMux, holder TypeHolder, urlPath string, restPrefix string) {
+	mux.HandleFunc(fmt.Sprintf("%sdart", urlPath), generateDartFunc(holder, restPrefix))
+}
 
 
-const LIBRARY_INFO = `
+//LIBRARY_INFO starts the generated Dart.  The support library (seven5_dart) must be next to it
+//as support.dart.
+const LIBRARY_INFO = `//Generated by seven5 from the wire types of the server.  Do not edit.
+// ignore_for_file: non_constant_identifier_names
 library generated;
-import 'package:seven5/support.dart';
-import 'dart:json' as JSON;
+
+import 'support.dart';
 `
 
 
@@ -178,6 +465,7 @@ import 'dart:json' as JSON;
 func generateDartFunc(holder TypeHolder, prefix string) func(http.ResponseWriter,*http.Request){
 	return func(w http.ResponseWriter, r *http.Request) {
 		text:=wrappedCodeGen(holder, prefix)
+		w.Header().Set("Content-Type", "application/dart")
 		if _,err:=w.Write(text.Bytes()); err!=nil {
 			fmt.Fprintf(os.Stderr, "Unable to write result of code generation to the client: %s\n", err)
 		}
@@ -191,6 +479,7 @@ func wrappedCodeGen(holder TypeHolder,prefix string) bytes.Buffer{
 	supportStructs := []*FieldDescription{}
 	text.WriteString(LIBRARY_INFO)
 	for _, d := range holder.All() {
+		text.WriteString("\n")
 		text.WriteString(generateDartForResource(d, prefix))
 		resourceStructs = append(resourceStructs, d)
 	}
@@ -203,7 +492,12 @@ func wrappedCodeGen(holder TypeHolder,prefix string) bytes.Buffer{
 		}
 	}
 	for _, i := range supportStructs {
+		text.WriteString("\n")
 		text.WriteString(generateDartForSupportStruct(i))
 	}
+	for _, e := range holderEnums(holder) {
+		text.WriteString("\n")
+		text.WriteString(generateDartForEnum(e))
+	}
 	return text	
 }
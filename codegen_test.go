@@ -1,11 +1,22 @@
 package seven5
 
 import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"testing"
 	"strings"
 	"reflect"
 )
 
+//run "go test -run Golden -update" to rewrite the golden files after changing the generator
+var updateGolden = flag.Bool("update", false, "rewrite the golden files of the code generators")
+
 type Nested struct {
 	Id	Id
 	I	Integer
@@ -17,6 +28,37 @@ type Test1 struct {
 	S	*Nested
 }
 
+type Address struct {
+	Street	String255
+	Tags	[]String255
+	Near	[]*Nested
+}
+
+//Person has every shape of nesting the generators must convert in both directions
+type Person struct {
+	Id		Id
+	Home		*Address
+	Work		*Address
+	Addresses	[]*Address
+	Grid		[][]Integer
+	Groups		[][]Address
+	Seen		[]DateTime
+	Born		DateTime
+}
+
+func examplePerson() *Person {
+	home := &Address{Street: "Main St", Tags: []String255{"home"}, Near: []*Nested{&Nested{Id: 1, I: 2}}}
+	return &Person{
+		Id:        7,
+		Home:      home,
+		Addresses: []*Address{home, nil, &Address{Street: "Elm St"}},
+		Grid:      [][]Integer{{1, 2}, {}, {3}},
+		Groups:    [][]Address{{Address{Street: "A"}}, nil},
+		Seen:      []DateTime{0, 1234567890.5},
+		Born:      1234567890.25,
+	}
+}
+
 /*-------------------------------------------------------------------------*/
 /*                          VERIFICATION CODE                              */
 /*-------------------------------------------------------------------------*/
@@ -27,6 +69,70 @@ func verifyHasString(T *testing.T, s string, code string) {
 	}
 }
 
+//verifyJsonShape checks that a value decoded from the output of JsonEncoder has the shape
+//the generated code expects from the field description: numbers where there are numbers, lists
+//(or null) where there are arrays, and objects (or null) with exactly the described fields where
+//there are structs.
+func verifyJsonShape(T *testing.T, f *FieldDescription, v interface{}, path string) {
+	switch f.TypeName {
+	case "Boolean":
+		if _, ok := v.(bool); !ok {
+			T.Errorf("%s: expected a boolean but got %#v", path, v)
+		}
+		return
+	case "Integer", "Id", "Floating", "DateTime":
+		if _, ok := v.(float64); !ok {
+			T.Errorf("%s: expected a number but got %#v", path, v)
+		}
+		return
+	case "String255", "Textblob":
+		if _, ok := v.(string); !ok {
+			T.Errorf("%s: expected a string but got %#v", path, v)
+		}
+		return
+	}
+	//the generated dart only accepts null for lists, maps and pointers to structs
+	if v == nil {
+		if f.StructName != "" && !f.Pointer {
+			T.Errorf("%s: null for %s, which dart expects to be non-null", path, f.StructName)
+		}
+		return
+	}
+	if f.Array != nil {
+		list, ok := v.([]interface{})
+		if !ok {
+			T.Errorf("%s: expected a list but got %#v", path, v)
+			return
+		}
+		for i, e := range list {
+			verifyJsonShape(T, f.Array, e, fmt.Sprintf("%s[%d]", path, i))
+		}
+		return
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok || len(obj) != len(f.Struct) {
+		T.Errorf("%s: expected an object with %d fields but got %#v", path, len(f.Struct), v)
+		return
+	}
+	for _, field := range f.Struct {
+		verifyJsonShape(T, field, obj[field.Name], path+"."+field.Name)
+	}
+}
+
+//verifySameJson checks that two JSON texts have the same content.
+func verifySameJson(T *testing.T, expected string, actual string) {
+	var e, a interface{}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		T.Fatalf("bad expected json: %s", err)
+	}
+	if err := json.Unmarshal([]byte(actual), &a); err != nil {
+		T.Fatalf("bad json %s: %s", actual, err)
+	}
+	if !reflect.DeepEqual(e, a) {
+		T.Errorf("json differs after round trip:\nexpected %s\nbut got  %s", expected, actual)
+	}
+}
+
 /*-------------------------------------------------------------------------*/
 /*                                 TEST CODE                               */
 /*-------------------------------------------------------------------------*/
@@ -41,7 +147,9 @@ func TestDartFields(T *testing.T) {
 	}
 	verifyHasString(T, "double", f.Struct[0].Dart())
 	verifyHasString(T, "List<int>", f.Struct[1].Dart())
-	verifyHasString(T, "Nested", f.Struct[2].Dart())
+	verifyHasString(T, "Nested?", f.Struct[2].Dart())
+	verifyHasString(T, "List<Nested>", WalkWireType("ScheduleWire", reflect.TypeOf(ScheduleWire{})).Struct[7].Dart())
+	verifyHasString(T, "List<Nested?>", WalkWireType("Address", reflect.TypeOf(Address{})).Struct[2].Dart())
 
 }
 
@@ -66,10 +174,179 @@ func TestDartFullResource(T *testing.T) {
 	b := wrappedCodeGen(holder,"/rest/")
 	decl:= b.String()
 	verifyHasString(T, "class someWire {", decl)
-	verifyHasString(T, "int Id;", decl)
-	verifyHasString(T, "String Foo;", decl)
+	verifyHasString(T, "int Id = 0;", decl)
+	verifyHasString(T, "String Foo = \"\";", decl)
 	verifyHasString(T, "someWire();", decl)
-	verifyHasString(T, "someWire.fromJson(Map json)", decl)
-	verifyHasString(T, "void Find(", decl)
-	verifyHasString(T, "static String resourceURL = \"/rest/somewire/\"", decl)
+	verifyHasString(T, "factory someWire.fromJson(Map<String, dynamic> json)", decl)
+	verifyHasString(T, "static Future<someWire> Find(int id,", decl)
+	verifyHasString(T, "static const String resourceURL = \"/rest/somewire/\"", decl)
+	if strings.Contains(decl, "dart:json") {
+		T.Errorf("dart:json is long gone:\n%s", decl)
+	}
+}
+
+//checkGolden compares generated code to the file testdata/name, or rewrites the file
+//when the -update flag is given.
+func checkGolden(T *testing.T, name string, code string) {
+	path := filepath.Join("testdata", name)
+	if *updateGolden {
+		if err := ioutil.WriteFile(path, []byte(code), 0644); err != nil {
+			T.Fatalf("unable to update %s: %s", path, err)
+		}
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		T.Fatalf("unable to read golden file %s: %s", path, err)
+	}
+	if string(b) != code {
+		T.Errorf("generated code differs from %s (use -update if the change is intended):\n%s", path, code)
+	}
+}
+
+func TestDartGolden(T *testing.T) {
+	holder := NewSimpleTypeHolder()
+	holder.Add("someWire", &someWire{})
+	holder.Add("ScheduleWire", &ScheduleWire{})
+	holder.Add("Test1", &Test1{})
+	holder.Add("Person", &Person{})
+
+	b := wrappedCodeGen(holder, "/rest/")
+	checkGolden(T, "generated.dart.golden", b.String())
+}
+
+func TestNestedConversion(T *testing.T) {
+	f := WalkWireType("Person", reflect.TypeOf(&Person{}))
+	text, err := (&JsonEncoder{}).Encode(examplePerson(), false)
+	if err != nil {
+		T.Fatalf("unable to encode: %s", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal([]byte(text), &v); err != nil {
+		T.Fatalf("unable to decode: %s", err)
+	}
+	verifyJsonShape(T, f, v, "Person")
+	if addresses := v.(map[string]interface{})["Addresses"].([]interface{}); addresses[1] != nil {
+		T.Errorf("expected the nil address to be sent as null: %s", text)
+	}
+
+	//the decoder is what the server uses on the generated code's output
+	var p Person
+	if err := (&JsonDecoder{}).Decode([]byte(text), &p); err != nil {
+		T.Fatalf("unable to decode person: %s", err)
+	}
+	again, _ := (&JsonEncoder{}).Encode(&p, false)
+	verifySameJson(T, text, again)
+
+	code := generateDartForResource(f, "/rest/")
+	verifyHasString(T, `Home = json["Home"] == null ? null : Address.fromJson(json["Home"] as Map<String, dynamic>);`, code)
+	verifyHasString(T, `Addresses = ((json["Addresses"] as List<dynamic>?) ?? []).map<Address?>((e) => e == null ? null : Address.fromJson(e as Map<String, dynamic>)).toList();`, code)
+	verifyHasString(T, `"Addresses": Addresses.map((e) => e?.toJson()).toList(),`, code)
+	verifyHasString(T, `Grid = ((json["Grid"] as List<dynamic>?) ?? []).map<List<int>>((e) => ((e as List<dynamic>?) ?? []).map<int>((e) => (e as num).toInt()).toList()).toList();`, code)
+	verifyHasString(T, `"Groups": Groups.map((e) => e.map((e) => e.toJson()).toList()).toList(),`, code)
+	verifyHasString(T, `"Seen": Seen.map((e) => Seven5Support.dateTimeToJson(e)).toList(),`, code)
+	verifyHasString(T, `"Grid": Grid,`, code)
+	verifyHasString(T, `"Work": Work?.toJson(),`, code)
+}
+
+//TestDartRoundTrip runs the generated code on the output of JsonEncoder and checks that the
+//objects encode back to the same JSON.  It needs the dart SDK and the http package, so it
+//is skipped when they are not available.
+func TestDartRoundTrip(T *testing.T) {
+	dart, err := exec.LookPath("dart")
+	if err != nil {
+		T.Skip("no dart SDK on the PATH")
+	}
+	dir, err := ioutil.TempDir("", "seven5dart")
+	if err != nil {
+		T.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	holder := NewSimpleTypeHolder()
+	holder.Add("Person", &Person{})
+	if err := GenerateDartForWireTypes(holder, "/rest/", "roundtrip", dirFinder(dir)); err != nil {
+		T.Fatalf("unable to generate dart: %s", err)
+	}
+	pubspec := "name: roundtrip\nenvironment:\n  sdk: '>=3.0.0 <4.0.0'\ndependencies:\n  http: '>=0.13.0 <2.0.0'\n"
+	main := `import 'dart:convert';
+import 'dart:io';
+import 'package:roundtrip/seven5/generated.dart';
+
+void main() {
+	final p = Person.fromJson(jsonDecode(stdin.readLineSync()!) as Map<String, dynamic>);
+	stdout.write(jsonEncode(p));
+}
+`
+	if err := ioutil.WriteFile(filepath.Join(dir, "pubspec.yaml"), []byte(pubspec), 0644); err != nil {
+		T.Fatalf("can't write pubspec: %s", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		T.Fatalf("can't create bin: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "main.dart"), []byte(main), 0644); err != nil {
+		T.Fatalf("can't write main: %s", err)
+	}
+	get := exec.Command(dart, "pub", "get")
+	get.Dir = dir
+	if out, err := get.CombinedOutput(); err != nil {
+		T.Skipf("unable to get the http package: %s\n%s", err, out)
+	}
+	text, _ := (&JsonEncoder{}).Encode(examplePerson(), false)
+	run := exec.Command(dart, "run", "bin/main.dart")
+	run.Dir = dir
+	run.Stdin = strings.NewReader(text + "\n")
+	var stderr bytes.Buffer
+	run.Stderr = &stderr
+	out, err := run.Output()
+	if err != nil {
+		T.Fatalf("generated dart failed: %s\n%s", err, stderr.String())
+	}
+	verifySameJson(T, normalizeNulls(T, text), string(out))
+}
+
+//normalizeNulls replaces the null that Go sends for a nil slice by an empty list, which is what
+//the generated dart code turns it into.
+func normalizeNulls(T *testing.T, text string) string {
+	var p Person
+	json.Unmarshal([]byte(text), &p)
+	for i := range p.Groups {
+		if p.Groups[i] == nil {
+			p.Groups[i] = []Address{}
+		}
+	}
+	fix := func(a *Address) {
+		if a != nil && a.Tags == nil {
+			a.Tags = []String255{}
+		}
+		if a != nil && a.Near == nil {
+			a.Near = []*Nested{}
+		}
+	}
+	fix(p.Home)
+	for _, a := range p.Addresses {
+		fix(a)
+	}
+	for _, g := range p.Groups {
+		for i := range g {
+			fix(&g[i])
+		}
+	}
+	b, err := json.Marshal(&p)
+	if err != nil {
+		T.Fatalf("can't encode person: %s", err)
+	}
+	return string(b)
+}
+
+//the dart sources are embedded with seven5tool embedfile (which adds a leading newline), so
+//check that nobody edited only one copy
+func TestDartEmbedded(T *testing.T) {
+	for file, text := range map[string]string{"seven5.dart": seven5_dart, "classdecl.tmpl": classdecl_tmpl} {
+		b, err := ioutil.ReadFile(filepath.Join("dart", file))
+		if err != nil {
+			T.Fatalf("unable to read %s: %s", file, err)
+		}
+		if "\n"+string(b) != text {
+			T.Errorf("dart/%s differs from the embedded copy", file)
+		}
+	}
 }
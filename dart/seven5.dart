@@ -1,111 +1,95 @@
 library seven5support;
 
-//import 'dart:json';
-import "dart:json" as JSON;
-import 'dart:html';
+import 'dart:convert';
+
+import 'package:http/http.dart' as http;
+
+//Seven5Error is thrown by the generated methods when the server answers with a status
+//that is not 2xx.  The body is whatever text the server sent with the error.
+class Seven5Error implements Exception {
+	final int status;
+	final String body;
+
+	Seven5Error(this.status, this.body);
+
+	@override
+	String toString() => "request failed with status $status: $body";
+}
 
 class Seven5Support {
-	static const int NOT_FETCHED = -1092; //signal value for object is not loaded from server
-	
+	//client is used for all requests; replace it to add credentials or for testing.
+	static http.Client client = http.Client();
+
 	//compute a URL for this call, including query params
-	static encodeURL(String url, Map qp) {
-		if (qp==null) {
-			return url;
+	static Uri encodeURL(String url, Map<String, String>? params) {
+		final uri = Uri.parse(url);
+		if (params == null || params.isEmpty) {
+			return uri;
 		}
-		StringBuffer buff = new StringBuffer();
-		bool first=true;
-		qp.forEach((String k,String v) {
-			if (!first) {
-				buff.add("&");
-			} else {
-				first=false;
-			}
-			buff.add("${k}=${v}");
-		});
-		//no sense trying to get to fancy as this will be url encoded anyway
-		return "${url}?${buff.toString()}";
+		return uri.replace(queryParameters: params);
 	}
-	
-	static void addHeaders(Map headers, HttpRequest req) {
-		if (headers!=null) {
-			for (var k in headers.getKeys()){
-				req.setRequestHeader(k,headers[k]);
-			}
+
+	//request sends the body (if any) as JSON and returns the decoded JSON of the response.
+	static Future<dynamic> request(String method, Uri url, Object? body, Map<String, String>? headers) async {
+		final req = http.Request(method, url);
+		req.headers["Accept"] = "application/json";
+		if (body != null) {
+			req.headers["Content-Type"] = "application/json";
+			req.body = jsonEncode(body);
+		}
+		if (headers != null) {
+			req.headers.addAll(headers);
+		}
+		final resp = await http.Response.fromStream(await client.send(req));
+		if (resp.statusCode ~/ 100 != 2) {
+			throw Seven5Error(resp.statusCode, resp.body);
+		}
+		if (resp.body.isEmpty) {
+			return null;
 		}
+		return jsonDecode(resp.body);
 	}
-	
-	static void Index(String indexURL, Function createList, Function createInstance, Function successFunc, Function errorFunc, 
-		Map headers, Map params){
-		HttpRequest req = new HttpRequest();
-		
-		req.open("GET", encodeURL(indexURL, params));
-		
-		Seven5Support.addHeaders(headers,req);
-		
-		req.on.load.add((HttpRequestProgressEvent progressEvent) {
-			if (req.status/100==2) {
-				List raw = JSON.parse(req.responseText);
-				List result = createList();
-				for (Map json in raw) {
-					result.add(createInstance().copyFromJson(json));
-				}
-				if (successFunc!=null) {
-					successFunc(result, req);
-				}
-			} else {
-				if (errorFunc!=null) {
-					errorFunc(req);
-				}
-			}
-		});
-		req.send();
+
+	static Future<List<T>> Index<T>(String resURL, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers, Map<String, String>? params) async {
+		final raw = await request("GET", encodeURL(resURL, params), null, headers);
+		return (raw as List<dynamic>).map((e) => fromJson(e as Map<String, dynamic>)).toList();
 	}
-	//resourceCallWithObjectResult is called to make a call on the resource and pass the result through to the 
-	//success function as parameter.  POST, PUT, DELETE, and FIND all use this code because they all expect a
-	//single object as the result of their call (in the success case).
-	static void resourceCallWithObjectResult(String method, String encodedURL, dynamic obj, Function successFunc, 
-		Function errorFunc, Map headers, String body){
-		HttpRequest req = new HttpRequest();
-		req.open(method, encodedURL);
-		
-		Seven5Support.addHeaders(headers,req);
-		
-		req.on.load.add((HttpRequestProgressEvent progressEvent) {
-			if (req.status/100==2) {
-				obj.copyFromJson(JSON.parse(req.responseText));
-				successFunc(obj, req);
-			} else {
-				if (errorFunc!=null) {
-					errorFunc(req);
-				}
-			}
-		});
-		req.send(body);
+
+	//objectResult is used by POST, PUT, DELETE, and FIND because they all expect a single
+	//object as the result of their call.
+	static Future<T> objectResult<T>(String method, Uri url, Object? body, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers) async {
+		final raw = await request(method, url, body, headers);
+		return fromJson(raw as Map<String, dynamic>);
 	}
-	//singleInstance is used by PUT, DELETE, and FIND because they _address_ a particular object as well as
-	//expecting as a single object as a return value.
-	static void singleInstance(String method, int id, String resURL, dynamic obj, Function successFunc, Function errorFunc,
-		Map headers, Map params, String bodyContent) { 
-		Seven5Support.resourceCallWithObjectResult(method, encodeURL("${resURL}${id}", params), obj, successFunc, errorFunc, 
-			headers, bodyContent);
+
+	static Future<T> Find<T>(String resURL, int id, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers, Map<String, String>? params) {
+		return objectResult("GET", encodeURL("$resURL$id", params), null, fromJson, headers);
 	}
-	
-	static void Put(String bodyContent, int id, String resURL, dynamic obj, Function successFunc, Function errorFunc, 
-		Map headers, Map params){
-			Seven5Support.singleInstance("PUT", id, resURL, obj, successFunc, errorFunc, headers, params, bodyContent);
+
+	static Future<T> Post<T>(String resURL, Map<String, dynamic> body, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers, Map<String, String>? params) {
+		return objectResult("POST", encodeURL(resURL, params), body, fromJson, headers);
 	}
-	static void Delete(int id, String resURL, dynamic obj, Function successFunc, Function errorFunc, 
-		Map headers, Map params){
-			Seven5Support.singleInstance("DELETE", id, resURL, obj, successFunc, errorFunc, headers, params, null);
+
+	static Future<T> Put<T>(String resURL, int id, Map<String, dynamic> body, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers, Map<String, String>? params) {
+		return objectResult("PUT", encodeURL("$resURL$id", params), body, fromJson, headers);
 	}
-	static void Find(int id, String resURL, dynamic obj, Function successFunc, Function errorFunc, 
-		Map headers, Map params){
-			Seven5Support.singleInstance("GET", id, resURL, obj, successFunc, errorFunc, headers, params, null);
+
+	static Future<T> Delete<T>(String resURL, int id, T Function(Map<String, dynamic>) fromJson,
+		Map<String, String>? headers, Map<String, String>? params) {
+		return objectResult("DELETE", encodeURL("$resURL$id", params), null, fromJson, headers);
+	}
+
+	//seven5.DateTime is sent as (fractional) seconds since the epoch, in UTC.
+	static DateTime dateTimeFromJson(dynamic value) {
+		return DateTime.fromMicrosecondsSinceEpoch(((value as num) * 1000000).round(), isUtc: true);
 	}
-	
-	static void Post(String bodyContent, String resURL, dynamic obj, Function successFunc, Function errorFunc, 
-		Map headers, Map params){
-			Seven5Support.resourceCallWithObjectResult("POST", encodeURL("${resURL}", params), obj, successFunc, 
-			errorFunc, headers, bodyContent);
+
+	static double dateTimeToJson(DateTime value) {
+		return value.microsecondsSinceEpoch / 1000000;
 	}
-}
\ No newline at end of file
+}
@@ -48,33 +48,74 @@ func (self *SimpleTypeHolder) Add(name string, i interface{}) {
 //be ignored.
 type FieldDescription struct {
 	//name is required
-	Name string
+	Name string `json:",omitempty"`
 	//type name must a simple type (from seven5) 
-	TypeName string
+	TypeName string `json:",omitempty"`
 	//arrays are composed of some number of a single _type_ ... if there is an array
 	//there should NOT be a TypeName or a Struct defn
-	Array *FieldDescription
+	Array *FieldDescription `json:",omitempty"`
 	//struct name is separate from TypeName so we can disambiguate a struct 'Floating' from a
 	//base type of the same name
-	StructName string
+	StructName string `json:",omitempty"`
+	//pointer is true if the struct is reached through a pointer, so it may be nil (sent as
+	//null), as the elements of a []*T may be
+	Pointer bool `json:",omitempty"`
 	//structs are zero or more different fields
-	Struct []*FieldDescription
+	Struct []*FieldDescription `json:",omitempty"`
+	//maps always have String255 keys, so this is the description of the values ... like
+	//Array, there should NOT be a TypeName or a Struct defn if there is a map
+	Map *FieldDescription `json:",omitempty"`
+	//optional fields are pointers to a basic type or an enumeration, so "absent" (nil, sent as
+	//null) is different from the zero value.  TypeName is the basic type.
+	Optional bool `json:",omitempty"`
+	//enumerations are strings limited to the values registered with RegisterEnum.  EnumName
+	//is the name of the go type and there is no TypeName.
+	EnumName string `json:",omitempty"`
+	Enum []string `json:",omitempty"`
+}
+
+//isBasicType returns true if t is one of the seven5 types that can be sent over the wire.
+func isBasicType(t reflect.Type) bool {
+	if !strings.HasSuffix(t.PkgPath(), "seven5") {
+		return false
+	}
+	switch t.Name() {
+	case "Floating", "String255", "Textblob", "Integer", "Id", "Boolean", "DateTime":
+		return true
+	}
+	return false
 }
 
 //WalkWireType is the recursive machine that creates a FieldDescription from 
 //a go type.  Given a type it returns a pointer to a FieldDescription struct.  
 //This is public because it's likely to be useful to others.
 func WalkWireType(name string, t reflect.Type) *FieldDescription {
-	if strings.HasSuffix(t.PkgPath(), "seven5") {
-		switch t.Name() {
-		case "Floating", "String255", "Textblob", "Integer", "Id", "Boolean", "DateTime":
-			return &FieldDescription{Name: name, TypeName: t.Name()}
+	if isBasicType(t) {
+		return &FieldDescription{Name: name, TypeName: t.Name()}
+	}
+	if values, ok := enumValues(t); ok {
+		return &FieldDescription{Name: name, EnumName: t.Name(), Enum: values}
+	}
+	if t.Kind() == reflect.Ptr && isBasicType(t.Elem()) {
+		return &FieldDescription{Name: name, TypeName: t.Elem().Name(), Optional: true}
+	}
+	if t.Kind() == reflect.Ptr {
+		if values, ok := enumValues(t.Elem()); ok {
+			return &FieldDescription{Name: name, EnumName: t.Elem().Name(), Enum: values, Optional: true}
 		}
 	}
 	if t.Kind() == reflect.Slice {
 		nested := WalkWireType("slice", t.Elem())
 		return &FieldDescription{Name: name, Array: nested}
 	}
+	if t.Kind() == reflect.Map {
+		if !isBasicType(t.Key()) || t.Key().Name() != "String255" {
+			panic(fmt.Sprintf("Keys of maps must be seven5.String255 (not %v) so they can be "+
+				"converted to Json, Dart, and SQL", t.Key()))
+		}
+		nested := WalkWireType("map", t.Elem())
+		return &FieldDescription{Name: name, Map: nested}
+	}
 	if t.Kind() == reflect.Struct || (t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct) {
 		var structType reflect.Type
 		if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct {
@@ -101,7 +142,11 @@ func WalkWireType(name string, t reflect.Type) *FieldDescription {
 			fieldCollection = append(fieldCollection, nested)
 		}
 		return &FieldDescription{Name: name, StructName: structType.Name(),
-			Struct: fieldCollection}
+			Struct: fieldCollection, Pointer: t.Kind() == reflect.Ptr}
+	}
+	if t.Kind() == reflect.String && t.PkgPath() != "" {
+		panic(fmt.Sprintf("Please register %s with RegisterEnum if it is an enumeration, or use "+
+			"seven5.String255 so it is clear how to translate it to Json, Dart, and SQL", t.Name()))
 	}
 	switch t.Kind() {
 	case reflect.Bool, reflect.Float32, reflect.Float64, reflect.Int, reflect.Int32,
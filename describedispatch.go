@@ -0,0 +1,153 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"go/token"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//DESCRIBE_DEFAULT_PACKAGE is the package name of the generated Go client when the request
+//does not supply one with the "package" query parameter.
+const DESCRIBE_DEFAULT_PACKAGE = "client"
+
+//ResourceDescription is what a DescribeDispatcher sends to describe a single resource.  The
+//Methods are the operations the resource supports, named as in seven5 (INDEX, FIND, POST,
+//PUT, DELETE), and the URL is where the resource is mapped.
+type ResourceDescription struct {
+	Name    string
+	URL     string
+	Methods []string
+	Fields  *FieldDescription
+}
+
+//DescribeDispatcher lets a running server be introspected by tooling and browsers.  It
+//serves, relative to the pattern it is mapped at with ServeMux.Dispatch:
+//
+//	""                    JSON array of ResourceDescription for every resource of Rest
+//	"<name>"              JSON ResourceDescription of the resource (name is lower case)
+//	"openapi.json"        the OpenAPI document of Rest
+//	"schema/"             the index of JSON Schemas, and "schema/<name>" for each one
+//	"client/dart"         the generated Dart code
+//	"client/typescript"   the generated TypeScript code
+//	"client/go"           the generated Go client, ?package= sets the package name (400 if
+//	                      it is not a Go identifier)
+//
+//Nothing here is protected; wrap the dispatcher in an HTTPBasicDispatcher (or don't map it)
+//if the shape of the API should not be public.
+type DescribeDispatcher struct {
+	Rest    *RawDispatcher
+	Title   string
+	Version string
+	prefix  string
+}
+
+//NewDescribeDispatcher returns a dispatcher describing the resources of rest.  The prefix
+//must be the same one passed to ServeMux.Dispatch, such as "/describe/".
+func NewDescribeDispatcher(prefix string, rest *RawDispatcher) *DescribeDispatcher {
+	if !strings.HasSuffix(prefix, "/") {
+		prefix = prefix + "/"
+	}
+	return &DescribeDispatcher{
+		Rest:    rest,
+		Title:   "seven5",
+		Version: "1",
+		prefix:  prefix,
+	}
+}
+
+//Describe returns the descriptions of all the resources of Rest, in the order of its
+//TypeHolder.  Types that are known to the holder but not mapped as resources are left out.
+func (self *DescribeDispatcher) Describe() []*ResourceDescription {
+	result := []*ResourceDescription{}
+	for _, f := range self.Rest.All() {
+		obj, ok := self.Rest.Res[strings.ToLower(f.Name)]
+		if !ok {
+			continue
+		}
+		d := &ResourceDescription{
+			Name:    f.Name,
+			URL:     self.Rest.Prefix + "/" + strings.ToLower(f.Name),
+			Methods: []string{},
+			Fields:  f,
+		}
+		if obj.index != nil {
+			d.Methods = append(d.Methods, "INDEX")
+		}
+		if obj.find != nil {
+			d.Methods = append(d.Methods, "FIND")
+		}
+		if obj.post != nil {
+			d.Methods = append(d.Methods, "POST")
+		}
+		if obj.put != nil {
+			d.Methods = append(d.Methods, "PUT")
+		}
+		if obj.del != nil {
+			d.Methods = append(d.Methods, "DELETE")
+		}
+		result = append(result, d)
+	}
+	return result
+}
+
+//Dispatch sends the description or the generated code named by the path of the request.
+//Only GET is allowed.
+func (self *DescribeDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "only GET is supported", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if !strings.HasPrefix(r.URL.Path, self.prefix) {
+		http.NotFound(w, r)
+		return nil
+	}
+	restPrefix := self.Rest.Prefix + "/"
+	path := strings.TrimPrefix(r.URL.Path, self.prefix)
+	switch {
+	case path == "":
+		self.send(w, self.Describe())
+	case path == "openapi.json":
+		openAPIFunc(self.Rest, self.Title, self.Version)(w, r)
+	case path == "client/dart":
+		generateDartFunc(self.Rest, restPrefix)(w, r)
+	case path == "client/typescript":
+		generateTypeScriptFunc(self.Rest, restPrefix)(w, r)
+	case path == "client/go":
+		pkg := r.URL.Query().Get("package")
+		if pkg == "" {
+			pkg = DESCRIBE_DEFAULT_PACKAGE
+		}
+		if !token.IsIdentifier(pkg) {
+			http.Error(w, fmt.Sprintf("%q is not a valid package name", pkg), http.StatusBadRequest)
+			return nil
+		}
+		generateGoClientFunc(self.Rest, restPrefix, pkg)(w, r)
+	case strings.HasPrefix(path, "schema/"):
+		jsonSchemaFunc(self.Rest, self.prefix+"schema/")(w, r)
+	case !strings.Contains(path, "/"):
+		for _, d := range self.Describe() {
+			if strings.ToLower(d.Name) == path {
+				self.send(w, d)
+				return nil
+			}
+		}
+		http.NotFound(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+	return nil
+}
+
+//send writes v to the client as indented JSON.
+func (self *DescribeDispatcher) send(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write description to the client: %s\n", err)
+	}
+}
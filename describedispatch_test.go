@@ -0,0 +1,80 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestDescribeDispatcher(t *testing.T) {
+	disp := NewBaseDispatcher(appName, nil)
+	disp.Resource("NoteWire", &NoteWire{}, &noteStore{notes: make(map[Id]*NoteWire)})
+	disp.ResourceSeparate("ScheduleWire", &ScheduleWire{}, nil, nil, &noteStore{}, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/describe/", NewDescribeDispatcher("/describe", disp.RawDispatcher))
+
+	get := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	w := get("GET", "/describe/")
+	var all []*ResourceDescription
+	if err := json.Unmarshal(w.Body.Bytes(), &all); err != nil || len(all) != 2 {
+		t.Fatalf("bad list of resources: %v %s", err, w.Body.String())
+	}
+	if all[0].Name != "NoteWire" || all[0].URL != "/rest/notewire" || strings.Join(all[0].Methods, ",") != "INDEX,FIND,POST,PUT,DELETE" {
+		t.Errorf("bad description of notewire: %+v", all[0])
+	}
+	if strings.Join(all[1].Methods, ",") != "POST" || len(all[1].Fields.Struct) != 8 {
+		t.Errorf("bad description of schedulewire: %+v", all[1])
+	}
+	if strings.Contains(w.Body.String(), "null") {
+		t.Errorf("expected empty parts of field descriptions to be left out: %s", w.Body.String())
+	}
+
+	var one ResourceDescription
+	w = get("GET", "/describe/schedulewire")
+	if err := json.Unmarshal(w.Body.Bytes(), &one); err != nil || one.Name != "ScheduleWire" || one.Fields.Struct[7].Array.StructName != "Nested" {
+		t.Errorf("bad single description: %v %s", err, w.Body.String())
+	}
+
+	var doc OpenAPIDoc
+	w = get("GET", "/describe/openapi.json")
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil || doc.Paths["/rest/notewire/{id}"] == nil {
+		t.Errorf("bad openapi document: %v %s", err, w.Body.String())
+	}
+	if w = get("GET", "/describe/schema/notewire"); !strings.Contains(w.Body.String(), JSON_SCHEMA_DIALECT) {
+		t.Errorf("expected json schema but got %s", w.Body.String())
+	}
+	if w = get("GET", "/describe/client/dart"); !strings.Contains(w.Body.String(), "class NoteWire") {
+		t.Errorf("expected dart code but got %s", w.Body.String())
+	}
+	if w = get("GET", "/describe/client/typescript"); !strings.Contains(w.Body.String(), "export class NoteWireResource") {
+		t.Errorf("expected typescript but got %s", w.Body.String())
+	}
+	if w = get("GET", "/describe/client/go"); !strings.Contains(w.Body.String(), "package client") {
+		t.Errorf("expected go client but got %s", w.Body.String())
+	}
+	if w = get("GET", "/describe/client/go?package=api"); !strings.Contains(w.Body.String(), "package api") {
+		t.Errorf("expected package to be chosen by the query")
+	}
+	for _, bad := range []string{"x%3B+os.Exit(1)", "func", "9lives", "a.b"} {
+		if w = get("GET", "/describe/client/go?package="+bad); w.Code != http.StatusBadRequest {
+			t.Errorf("expected 400 for package %s but got %d", bad, w.Code)
+		}
+	}
+
+	if w = get("GET", "/describe/nosuch"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown resource but got %d", w.Code)
+	}
+	if w = get("GET", "/describe/client/cobol"); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown language but got %d", w.Code)
+	}
+	if w = get("POST", "/describe/"); w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != "GET" {
+		t.Errorf("expected only GET to be allowed but got %d", w.Code)
+	}
+}
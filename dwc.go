@@ -367,30 +367,33 @@ func createPath(parent string, d string, f string) (*os.File, error) {
 
 //GenerateDartForWireTypes emits dart source code that allows the client side dart code
 //to manipulate the defined types (in TypeHolder argument) conveniently.  It uses
-//the projectfinder supplied to know where to place the resulting file.
+//the projectfinder supplied to know where to place the resulting files, which are
+//lib/seven5/generated.dart and the support library it needs, lib/seven5/support.dart.
+//The generated code uses package:http, so the project's pubspec must depend on it.
 func GenerateDartForWireTypes(t TypeHolder, pre string, name string, pf ProjectFinder) error {
-	dir, err := pf.ProjectFind(filepath.Join("web", "packages"), name, DART_FLAVOR)
+	dir, err := pf.ProjectFind("lib", name, DART_FLAVOR)
 	if err != nil {
 		return err
 	}
-	_, err = os.Open(dir)
-	if os.IsNotExist(err) {
-		panic(fmt.Sprintf("No package directory for dart packages (%s): did you forget to run pub install?", dir))
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return err
 	}
 	buffer := wrappedCodeGen(t, pre)
-	c, err := createPath(dir, "generated", "dart")
+	c, err := createPath(dir, "seven5", "generated.dart")
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 	_, err = c.Write(buffer.Bytes())
 	if err != nil {
 		return err
 	}
-	c, err = createPath(dir, "seven5", "support.dart")
+	s, err := createPath(dir, "seven5", "support.dart")
 	if err != nil {
 		return err
 	}
-	_, err = c.Write([]byte(seven5_dart))
+	defer s.Close()
+	_, err = s.Write([]byte(seven5_dart))
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,56 @@
+package seven5
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+var enumLock sync.RWMutex
+var enums = make(map[reflect.Type][]string)
+
+//RegisterEnum makes a named string type an enumeration that can be used in wire types.  The
+//example is any value of the type, such as Color(""), and values are all the values allowed.
+//Bodies sent to resources with any other value in a field of the type, or without a value
+//for a field of the type that is not optional, are refused with 422.
+//The first value is the initial value of such fields in objects created by generated code.
+//Register enumerations (usually in init) before adding resources that use them.  It panics if
+//the type is not a string type or the values are empty or repeated, since that is a mistake
+//in the program.
+func RegisterEnum(example interface{}, values ...string) {
+	t := reflect.TypeOf(example)
+	if t == nil || t.Kind() != reflect.String || t.Name() == "" || isBasicType(t) {
+		panic(fmt.Sprintf("enumerations must be named string types, not %v", t))
+	}
+	if len(values) == 0 {
+		panic(fmt.Sprintf("enumeration %s must have at least one value", t.Name()))
+	}
+	seen := make(map[string]bool)
+	for _, v := range values {
+		if seen[v] {
+			panic(fmt.Sprintf("enumeration %s has the value %q twice", t.Name(), v))
+		}
+		seen[v] = true
+	}
+	enumLock.Lock()
+	defer enumLock.Unlock()
+	enums[t] = append([]string{}, values...)
+}
+
+//enumValues returns the values registered for t, and false if it is not an enumeration.
+func enumValues(t reflect.Type) ([]string, bool) {
+	enumLock.RLock()
+	defer enumLock.RUnlock()
+	values, ok := enums[t]
+	return values, ok
+}
+
+//containsValue is true if s is one of the values of the enumeration f.
+func (self *FieldDescription) containsValue(s string) bool {
+	for _, v := range self.Enum {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
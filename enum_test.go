@@ -0,0 +1,153 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type Mood string
+
+type Weird string
+
+type Unregistered string
+
+func init() {
+	RegisterEnum(Mood(""), "happy", "sad")
+	RegisterEnum(Weird(""), "in-progress", "class", "9lives", "say \"$hi\"")
+}
+
+type Ticket struct {
+	Id      Id
+	Feeling Mood
+	Was     *Mood
+	History []Mood
+	Odd     map[String255]Weird
+}
+
+//ticketEcho is a RestAll that sends back what it is given.
+type ticketEcho struct {
+	profileEcho
+}
+
+func (self *ticketEcho) Post(i interface{}, pb PBundle) (interface{}, error) { return i, nil }
+
+/*-------------------------------------------------------------------------------*/
+func TestRegisterEnum(t *testing.T) {
+	for _, bad := range []func(){
+		func() { RegisterEnum(String255(""), "a") },
+		func() { RegisterEnum(Integer(0), "a") },
+		func() { RegisterEnum(Unregistered("")) },
+		func() { RegisterEnum(Unregistered(""), "a", "a") },
+		func() { WalkWireType("bad", reflect.TypeOf(Unregistered(""))) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected a panic")
+				}
+			}()
+			bad()
+		}()
+	}
+
+	f := WalkWireType("Ticket", reflect.TypeOf(&Ticket{}))
+	if m := f.Struct[1]; m.EnumName != "Mood" || strings.Join(m.Enum, ",") != "happy,sad" || m.TypeName != "" {
+		t.Errorf("bad enum description: %+v", m)
+	}
+	if m := f.Struct[2]; m.EnumName != "Mood" || !m.Optional {
+		t.Errorf("expected optional enum: %+v", m)
+	}
+	if e := collectEnums(f); len(e) != 2 || e[0].EnumName != "Mood" || e[1].EnumName != "Weird" {
+		t.Errorf("expected each enum once: %+v", e)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestEnumCodegen(t *testing.T) {
+	holder := NewSimpleTypeHolder()
+	holder.Add("Ticket", &Ticket{})
+
+	dart := wrappedCodeGen(holder, "/rest/")
+	verifyHasString(t, "enum Mood {\n\thappy(\"happy\"),\n\tsad(\"sad\");", dart.String())
+	verifyHasString(t, "Mood Feeling = Mood.happy;", dart.String())
+	verifyHasString(t, "Mood? Was;", dart.String())
+	verifyHasString(t, `Was = json["Was"] == null ? null : Mood.fromJson(json["Was"]);`, dart.String())
+	verifyHasString(t, `"Feeling": Feeling.toJson(),`, dart.String())
+	verifyHasString(t, `"Was": Was?.toJson(),`, dart.String())
+	verifyHasString(t, `"History": History.map((e) => e.toJson()).toList(),`, dart.String())
+	verifyHasString(t, "in_progress(\"in-progress\"),\n\tclass_(\"class\"),\n\tv9lives(\"9lives\"),\n\tsay___hi_(\"say \\\"\\$hi\\\"\");", dart.String())
+
+	ts := wrappedTypeScriptCodeGen(holder, "/rest/")
+	verifyHasString(t, "export enum Mood {\n\thappy = \"happy\",\n\tsad = \"sad\",\n}", ts.String())
+	verifyHasString(t, "\"in-progress\" = \"in-progress\",", ts.String())
+	verifyHasString(t, "Was?: Mood | null;", ts.String())
+	verifyHasString(t, "Odd: { [key: string]: Weird };", ts.String())
+
+	src, err := GenerateGoClient(holder, "/rest/", "api")
+	if err != nil {
+		t.Fatalf("generated go doesn't parse: %s", err)
+	}
+	verifyHasString(t, "type Mood string", string(src))
+	verifyHasString(t, "var MoodValues = []Mood{\n\t\"happy\",\n\t\"sad\",\n}", string(src))
+	verifyHasString(t, "Was     *Mood", string(src))
+
+	s := WireTypeSchema(WalkWireType("Ticket", reflect.TypeOf(&Ticket{})))
+	if m := s.Properties["Feeling"]; m.Type != "string" || strings.Join(m.Enum, ",") != "happy,sad" {
+		t.Errorf("bad enum schema: %+v", m)
+	}
+	if m := s.Properties["Was"]; len(m.AnyOf) != 2 || m.AnyOf[0].Title != "Mood" {
+		t.Errorf("bad optional enum schema: %+v", m)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestEnumDecoding(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, NewSimpleTypeHolder(), "/rest")
+	raw.Rez(&Ticket{}, &ticketEcho{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/rest/ticket", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"Feeling":"sad","Was":null,"History":["happy"],"Odd":{"x":"class"}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected known values to be accepted but got %d: %s", w.Code, w.Body.String())
+	}
+	var ticket Ticket
+	if err := json.Unmarshal(w.Body.Bytes(), &ticket); err != nil || ticket.Feeling != "sad" || ticket.Odd["x"] != "class" {
+		t.Errorf("bad result: %v %+v", err, ticket)
+	}
+	for _, body := range []string{`{"Feeling":"angry"}`, `{"Was":"SAD"}`, `{"History":["happy","meh"]}`, `{"Odd":{"x":"in progress"}}`, `{"Feeling":null}`} {
+		if w := post(body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected %s to be refused but got %d", body, w.Code)
+		}
+	}
+	if w := post(`{"History":["happy","meh"]}`); !strings.Contains(w.Body.String(), "Mood") {
+		t.Errorf("expected the error to name the enumeration: %s", w.Body.String())
+	}
+
+	//a missing or empty enumeration would be decoded as "", which is not one of its values
+	put := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("PUT", "/rest/ticket/1", strings.NewReader(body)))
+		return w
+	}
+	for _, send := range []func(string) *httptest.ResponseRecorder{post, put} {
+		for _, body := range []string{`{"Id":1}`, `{"Id":1,"Feeling":""}`, `{"Id":1,"Was":"sad"}`} {
+			if w := send(body); w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "Feeling") {
+				t.Errorf("expected missing or empty Feeling in %s to be refused but got %d: %s", body, w.Code, w.Body.String())
+			}
+		}
+	}
+	if w := put(`{"Id":1,"feeling":"happy"}`); w.Code != http.StatusOK {
+		t.Errorf("expected Was to be optional but got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -18,6 +18,7 @@ const (
 	DART_FLAVOR
 	ASSET_FLAVOR
 	TOP_LEVEL_FLAVOR
+	TYPESCRIPT_FLAVOR
 )
 
 //DeploymentEnvironment encodes information that cannot be obtained from the source code but can only
@@ -30,6 +31,25 @@ type DeploymentEnvironment interface {
 	RedirectHost(string) string
 }
 
+//ProviderHoster is an optional interface for a DeploymentEnvironment that wants the oauth
+//connectors to talk to somewhere other than the real provider, usually a FakeProvider in
+//tests.  ProviderHost returns the scheme and host (such as "http://127.0.0.1:4321") to use
+//for the named service, or "" to use the real one.
+type ProviderHoster interface {
+	ProviderHost(serviceName string) string
+}
+
+//providerHost returns the host that dep wants used for the service or def if it has no
+//opinion.
+func providerHost(dep DeploymentEnvironment, serviceName string, def string) string {
+	if ph, ok := dep.(ProviderHoster); ok {
+		if h := ph.ProviderHost(serviceName); h != "" {
+			return h
+		}
+	}
+	return def
+}
+
 //PublicSettings is an interface representing information that you want the client to have
 //access to, usually via a URL, but do not want stored in the source code.  A common example
 //of this is an API key that you use with a particular web service that needs to be available
@@ -118,6 +138,8 @@ func (self *EnvironmentVars) ProjectFind(target string, projectName string, flav
 		return filepath.Join(filepath.Dir(env), "dart", projectName, "assets", target), nil
 	case TOP_LEVEL_FLAVOR:
 		return filepath.Join(filepath.Dir(env), target), nil
+	case TYPESCRIPT_FLAVOR:
+		return filepath.Join(filepath.Dir(env), "typescript", projectName, target), nil
 	}
 	panic("unknown type of object searched for in the project!")
 }
@@ -1,80 +1,97 @@
 package seven5
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	//oauth1 "github.com/iansmith/go-oauth/oauth"
 	oauth1 "github.com/garyburd/go-oauth/oauth"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 const (
-	EVERNOTE_AUTH_URL_HOST = "https://sandbox.evernote.com"
+	EVERNOTE_SANDBOX_HOST    = "https://sandbox.evernote.com"
+	EVERNOTE_PRODUCTION_HOST = "https://www.evernote.com"
+	//EVERNOTE_AUTH_URL_HOST is the host used by NewEvernoteOauth1.  Use NewEvernoteOauth1Host
+	//to talk to production.
+	EVERNOTE_AUTH_URL_HOST = EVERNOTE_SANDBOX_HOST
 	EVERNOTE_AUTH_URL_PATH = "/oauth"
+	EVERNOTE_USER_URL_PATH = "/OAuth.action"
 	EVERNOTE_AUTH_URL      = EVERNOTE_AUTH_URL_HOST + EVERNOTE_AUTH_URL_PATH
-	EVERNOTE_USER_URL      = "https://sandbox.evernote.com/OAuth.action"
+	EVERNOTE_USER_URL      = EVERNOTE_AUTH_URL_HOST + EVERNOTE_USER_URL_PATH
+	//EVERNOTE_TEMP_CRED_TTL is how long a user has to approve access at evernote before
+	//the temporary credentials are forgotten.
+	EVERNOTE_TEMP_CRED_TTL = 15 * time.Minute
 )
 
-var evClient = oauth1.Client{
-	TemporaryCredentialRequestURI: EVERNOTE_AUTH_URL,
-	ResourceOwnerAuthorizationURI: EVERNOTE_USER_URL,
-	TokenRequestURI:               EVERNOTE_AUTH_URL,
-}
-
-//EvernoteOauth1 is the implementation of an ServiceConnector for Evernote.  XXX
-//the set of known credentials should be culled every few minutes because one
-//could mount an attack against this growing without bounds. XXX
+//EvernoteOauth1 is the implementation of an ServiceConnector for Evernote.  Temporary
+//credentials handed out in Phase1 are kept until Phase2 consumes them or they expire.
 type EvernoteOauth1 struct {
 	host       string
-	knownCreds map[string]*oauth1.Credentials
+	client     *oauth1.Client
+	knownCreds *expiringMap
 }
 
-//NewEvernoteOauth1 returns an OauthConnector suitable for use with Evernote.  
+//NewEvernoteOauth1 returns an OauthConnector suitable for use with Evernote's sandbox.
 //The OauthClientDetail is passed here because we need extract
 //client id and secret from somewhere other than the code.  The Deployment is passed to
-//help calculate correct hostnames.
+//help calculate correct hostnames; if it is a ProviderHoster with a host for "evernote"
+//that host is used instead of the sandbox.
 func NewEvernoteOauth1(d OauthClientDetail, dep DeploymentEnvironment) *EvernoteOauth1 {
+	return NewEvernoteOauth1Host(providerHost(dep, "evernote", EVERNOTE_AUTH_URL_HOST), d, dep)
+}
 
+//NewEvernoteOauth1Host returns an OauthConnector for the Evernote service at evernoteHost,
+//usually EVERNOTE_SANDBOX_HOST or EVERNOTE_PRODUCTION_HOST.
+func NewEvernoteOauth1Host(evernoteHost string, d OauthClientDetail, dep DeploymentEnvironment) *EvernoteOauth1 {
+	client := &oauth1.Client{
+		TemporaryCredentialRequestURI: evernoteHost + EVERNOTE_AUTH_URL_PATH,
+		ResourceOwnerAuthorizationURI: evernoteHost + EVERNOTE_USER_URL_PATH,
+		TokenRequestURI:               evernoteHost + EVERNOTE_AUTH_URL_PATH,
+	}
 	//app credentials are fixed
-	evClient.Credentials.Token = d.ClientId("evernote")
-	evClient.Credentials.Secret = d.ClientSecret("evernote")
+	client.Credentials.Token = d.ClientId("evernote")
+	client.Credentials.Secret = d.ClientSecret("evernote")
 
 	result := &EvernoteOauth1{
 		host:       dep.RedirectHost("evernote"),
-		knownCreds: make(map[string]*oauth1.Credentials),
+		client:     client,
+		knownCreds: newExpiringMap(EVERNOTE_TEMP_CRED_TTL),
 	}
 	return result
 }
 
-func (self *EvernoteOauth1) Phase2(token string, verifier string) (OauthConnection,error) {
-	//should lookup creds in map
-	creds, ok := self.knownCreds[token]
+func (self *EvernoteOauth1) Phase2(token string, verifier string) (OauthConnection, error) {
+	//temporary credentials can only be used once
+	c, ok := self.knownCreds.Take(token)
 	if !ok {
-		return nil,errors.New(fmt.Sprintf("Unable to find token %s in known credentials!", token))
+		return nil, errors.New(fmt.Sprintf("Unable to find token %s in known credentials!", token))
 	}
-	cr, v, err := evClient.RequestToken(http.DefaultClient, creds, verifier)
+	cr, v, err := self.client.RequestToken(http.DefaultClient, c.(*oauth1.Credentials), verifier)
 	if err != nil {
-		return nil,err
+		return nil, err
 	}
-	id:=v["edam_userId"][0]
-	i,err:=strconv.ParseInt(id, 10, 64)
-	if err!=nil {
-		return nil,err
+	i, err := strconv.ParseInt(v.Get("edam_userId"), 10, 64)
+	if err != nil {
+		return nil, err
 	}
-	u:=v["edam_noteStoreUrl"][0]
-	url, err:=url.Parse(u)
-	if err!=nil {
-		return nil,err
+	ns, err := url.Parse(v.Get("edam_noteStoreUrl"))
+	if err != nil {
+		return nil, err
 	}
-	result:=&EvernoteConnection{
-		Credentials:cr,
-		EvernoteId:i,
-		Notestore: url,
+	result := &EvernoteConnection{
+		Credentials: cr,
+		EvernoteId:  i,
+		Notestore:   ns,
+		client:      self.client,
 	}
-	delete(self.knownCreds,token)
-	return result,nil
+	return result, nil
 }
 
 func (self *EvernoteOauth1) Name() string {
@@ -86,17 +103,16 @@ func (self *EvernoteOauth1) UserInteractionURL(tempCred OauthCred, state string,
 	values := url.Values{
 		"action": {state},
 	}
-	return evClient.AuthorizationURL(cred, values)
+	return self.client.AuthorizationURL(cred, values)
 }
 
 func (self *EvernoteOauth1) Phase1(state string, callbackPath string) (OauthCred, error) {
 	callback := self.host + callbackPath
-	tempCred, err := evClient.RequestTemporaryCredentials(http.DefaultClient, callback, nil)
+	tempCred, err := self.client.RequestTemporaryCredentials(http.DefaultClient, callback, nil)
 	if err != nil {
-		fmt.Printf("Error getting temp cred: %s\n", err.Error())
-		return nil, err
+		return nil, errors.New(fmt.Sprintf("unable to get temporary credentials: %s", err))
 	}
-	self.knownCreds[tempCred.Token] = tempCred
+	self.knownCreds.Put(tempCred.Token, tempCred)
 	return &SimpleOauthCred{tempCred}, nil
 }
 
@@ -115,12 +131,78 @@ func (self *EvernoteOauth1) ErrorValueName() string {
 	return "oauth_error"
 }
 
+//EvernoteConnection is the connection returned by EvernoteOauth1.  Evernote tokens are not
+//refreshed, they simply last for a long time (a year by default).
 type EvernoteConnection struct {
 	*oauth1.Credentials
+	tokenPersistence
+	EvernoteId int64
+	Notestore  *url.URL
+	client     *oauth1.Client
+}
+
+//evernoteCredentials is the stored form of an EvernoteConnection.
+type evernoteCredentials struct {
+	Token      string
+	Secret     string
 	EvernoteId int64
-	Notestore *url.URL
+	Notestore  string
 }
 
-func (self *EvernoteConnection) SendAuthenticated(r *http.Request) (*http.Response,error) {
-	return nil,nil
+//SendAuthenticated signs the request with the user's token and sends it.  Parameters in
+//the query string and in url-encoded form bodies are covered by the signature.  The
+//request passed in is not modified, except that a form body that had to be read to sign
+//it is replaced by a copy that can still be read.
+func (self *EvernoteConnection) SendAuthenticated(r *http.Request) (*http.Response, error) {
+	if self.client == nil {
+		return nil, errors.New("evernote connection has no client to sign requests with")
+	}
+	req := r.Clone(r.Context())
+	var params url.Values
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); r.Body != nil && mt == "application/x-www-form-urlencoded" {
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if params, err = url.ParseQuery(string(body)); err != nil {
+			return nil, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+	req.Header.Set("Authorization", self.client.AuthorizationHeader(self.Credentials, req.Method, req.URL, params))
+	return http.DefaultClient.Do(req)
+}
+
+//MarshalCredentials returns the token, secret and evernote specific values as json.
+func (self *EvernoteConnection) MarshalCredentials() ([]byte, error) {
+	creds := &evernoteCredentials{
+		Token:      self.Token,
+		Secret:     self.Secret,
+		EvernoteId: self.EvernoteId,
+	}
+	if self.Notestore != nil {
+		creds.Notestore = self.Notestore.String()
+	}
+	return json.Marshal(creds)
+}
+
+//RestoreConnection creates a connection from the json written by EvernoteConnection.MarshalCredentials.
+func (self *EvernoteOauth1) RestoreConnection(data []byte) (OauthConnection, error) {
+	creds := &evernoteCredentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, err
+	}
+	ns, err := url.Parse(creds.Notestore)
+	if err != nil {
+		return nil, err
+	}
+	return &EvernoteConnection{
+		Credentials: &oauth1.Credentials{Token: creds.Token, Secret: creds.Secret},
+		EvernoteId:  creds.EvernoteId,
+		Notestore:   ns,
+		client:      self.client,
+	}, nil
 }
@@ -0,0 +1,125 @@
+package seven5
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestEvernoteSendAuthenticated(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	//a tiny evernote: the temporary credential and token endpoints share a path and are
+	//told apart by the verifier, the api echoes the form if the signature is right
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case EVERNOTE_AUTH_URL_PATH:
+			params := oauth1Params(r)
+			if params.Get("oauth_verifier") == "" {
+				if !checkOauth1Signature(r, params, seekret, "") || params.Get("oauth_callback") == "" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				fmt.Fprintf(w, "oauth_token=temp&oauth_token_secret=tempsec&oauth_callback_confirmed=true")
+				return
+			}
+			if !checkOauth1Signature(r, params, seekret, "tempsec") || params.Get("oauth_token") != "temp" || params.Get("oauth_verifier") != "v" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, "oauth_token=tok&oauth_token_secret=sec&edam_userId=1999&edam_noteStoreUrl=%s",
+				url.QueryEscape("https://sandbox.evernote.com/shard/s1/notestore"))
+		case "/api":
+			params := oauth1Params(r)
+			if !checkOauth1Signature(r, params, seekret, "sec") || params.Get("oauth_token") != "tok" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			fmt.Fprintf(w, "%s %s", r.Form.Get("q"), r.Form.Get("note"))
+		}
+	}))
+	defer srv.Close()
+
+	deploy := NewMockDeploymentEnvironment(ctrl)
+	deploy.EXPECT().RedirectHost("evernote").Return("http://localhost")
+	detail := NewMockOauthClientDetail(ctrl)
+	detail.EXPECT().ClientId("evernote").Return(id)
+	detail.EXPECT().ClientSecret("evernote").Return(seekret)
+	ever := NewEvernoteOauth1Host(srv.URL, detail, deploy)
+
+	cred, err := ever.Phase1("s", "/auth/evernote/oauth2callback")
+	if err != nil {
+		t.Fatalf("phase 1 failed: %s", err)
+	}
+	if u := ever.UserInteractionURL(cred, "s", ""); !strings.HasPrefix(u, srv.URL+EVERNOTE_USER_URL_PATH) {
+		t.Errorf("user sent to wrong host: %s", u)
+	}
+	conn, err := ever.Phase2(cred.Token(), "v")
+	if err != nil {
+		t.Fatalf("phase 2 failed: %s", err)
+	}
+	if _, err := ever.Phase2(cred.Token(), "v"); err == nil {
+		t.Errorf("temporary credentials should only be usable once")
+	}
+	if conn.(*EvernoteConnection).EvernoteId != 1999 {
+		t.Errorf("wrong evernote id: %d", conn.(*EvernoteConnection).EvernoteId)
+	}
+
+	req, _ := http.NewRequest("POST", srv.URL+"/api?q=find+me", strings.NewReader("note=hello%20world"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := conn.SendAuthenticated(req)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "find me hello world" {
+		t.Errorf("signed request rejected: %s, '%s'", resp.Status, body)
+	}
+	if sent, _ := ioutil.ReadAll(req.Body); string(sent) != "note=hello%20world" {
+		t.Errorf("the body of the request passed in should be left for the caller: '%s'", sent)
+	}
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("caller's request should not be modified")
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestExpiringMap(t *testing.T) {
+	m := newExpiringMap(50 * time.Millisecond)
+	m.Put("a", 1)
+	m.Put("b", 2)
+	if v, ok := m.Take("a"); !ok || v.(int) != 1 {
+		t.Errorf("expected to take a but got %v %v", v, ok)
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Errorf("take should remove the entry")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := m.Get("b"); ok {
+		t.Errorf("entry should have expired")
+	}
+	m.Put("c", 3)
+	if m.Len() != 1 {
+		t.Errorf("expired entries should be culled, have %d", m.Len())
+	}
+
+	//a long ttl doesn't mean expired entries are kept for as long
+	long := newExpiringMap(30 * 24 * time.Hour)
+	if long.every != expiringCullInterval {
+		t.Errorf("expected long lived map to be culled every %s but got %s", expiringCullInterval, long.every)
+	}
+	long.Put("old", 1)
+	long.entries["old"].expires = time.Now().Add(-time.Second)
+	long.cull(time.Now().Add(expiringCullInterval))
+	if long.Len() != 0 {
+		t.Errorf("expired entry should be culled after %s", expiringCullInterval)
+	}
+}
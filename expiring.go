@@ -0,0 +1,109 @@
+package seven5
+
+import (
+	"sync"
+	"time"
+)
+
+//expiringMap is a small, goroutine-safe map from strings to values where each entry is
+//forgotten after a fixed time-to-live.  It is used for the short-lived bits of state that
+//must survive between the two halves of a login handshake; because entries expire, a
+//client that starts many logins and never finishes them cannot make it grow without bound.
+type expiringMap struct {
+	sync.Mutex
+	ttl     time.Duration
+	every   time.Duration
+	entries map[string]*expiringEntry
+	lastGC  time.Time
+}
+
+type expiringEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+//expiringCullInterval is the longest expired entries are kept around by maps with a long
+//ttl, such as refresh tokens that live for weeks.
+const expiringCullInterval = 10 * time.Minute
+
+//newExpiringMap returns an empty expiringMap whose entries live for ttl.
+func newExpiringMap(ttl time.Duration) *expiringMap {
+	every := ttl
+	if every > expiringCullInterval {
+		every = expiringCullInterval
+	}
+	return &expiringMap{
+		ttl:     ttl,
+		every:   every,
+		entries: make(map[string]*expiringEntry),
+		lastGC:  time.Now(),
+	}
+}
+
+//Put stores v under key, replacing any previous value and restarting the clock for that key.
+func (self *expiringMap) Put(key string, v interface{}) {
+	self.Lock()
+	defer self.Unlock()
+	now := time.Now()
+	self.cull(now)
+	self.entries[key] = &expiringEntry{value: v, expires: now.Add(self.ttl)}
+}
+
+//Get returns the value stored under key, if it is present and has not expired.
+func (self *expiringMap) Get(key string) (interface{}, bool) {
+	self.Lock()
+	defer self.Unlock()
+	e, ok := self.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(self.entries, key)
+		return nil, false
+	}
+	return e.value, true
+}
+
+//Take is Get followed by Delete.  Values that are meant to be used exactly once (such as
+//temporary credentials) should be retrieved with Take.
+func (self *expiringMap) Take(key string) (interface{}, bool) {
+	self.Lock()
+	defer self.Unlock()
+	e, ok := self.entries[key]
+	if !ok {
+		return nil, false
+	}
+	delete(self.entries, key)
+	if time.Now().After(e.expires) {
+		return nil, false
+	}
+	return e.value, true
+}
+
+//Delete removes key, if present.
+func (self *expiringMap) Delete(key string) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.entries, key)
+}
+
+//Len returns the number of entries, including any that have expired but not been culled.
+func (self *expiringMap) Len() int {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.entries)
+}
+
+//cull drops expired entries.  It only does the walk once per ttl (or expiringCullInterval,
+//if that is shorter) so that Put stays cheap.  The caller must hold the lock.
+func (self *expiringMap) cull(now time.Time) {
+	if now.Sub(self.lastGC) < self.every {
+		return
+	}
+	for k, e := range self.entries {
+		if now.After(e.expires) {
+			delete(self.entries, k)
+		}
+	}
+	self.lastGC = now
+}
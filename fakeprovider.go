@@ -0,0 +1,443 @@
+package seven5
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//FakeConsent is what the user of a FakeProvider does when asked to approve access.
+type FakeConsent int
+
+const (
+	//FAKE_CONSENT_ALLOW sends the browser back to the application with a code (or verifier).
+	FAKE_CONSENT_ALLOW FakeConsent = iota
+	//FAKE_CONSENT_DENY sends the browser back to the application with an access_denied error.
+	FAKE_CONSENT_DENY
+	//FAKE_CONSENT_ABANDON leaves the browser at the provider, as if the user closed the window.
+	FAKE_CONSENT_ABANDON
+)
+
+//FAKE_TOKEN_TTL is the lifetime of the access tokens from a FakeProvider unless its
+//TokenTTL is set.
+const FAKE_TOKEN_TTL = time.Hour
+
+//FakeUser is an account at a FakeProvider.  The Id should be a decimal number, since that is
+//what evernote uses.
+type FakeUser struct {
+	Id    string
+	Email string
+	Name  string
+}
+
+//FakeProvider is an in-process authorization server that speaks enough of google's oauth2
+//and evernote's oauth1 to run the login, callback and logout of an AuthDispatcher without
+//the network.  It is an http.Handler, so it is usually run with httptest.NewServer and the
+//connectors are pointed at it with a FakeDeployment.  It is also the OauthClientDetail for
+//the connectors: every service has the client id and secret of the provider.
+//
+//The "user" approving access is the one chosen by LoginAs, or the first user.  What they do
+//is controlled by SetConsent, and any endpoint can be made to fail with FailNext.
+type FakeProvider struct {
+	sync.Mutex
+	Id       string
+	Secret   string
+	TokenTTL time.Duration
+	users    []*FakeUser
+	current  *FakeUser
+	consent  FakeConsent
+	failures map[string]int
+	codes    map[string]*fakeGrant
+	access   map[string]*fakeGrant
+	refresh  map[string]*fakeGrant
+	temps    map[string]*fakeGrant
+}
+
+//fakeGrant is what the provider remembers about a code or token.  For oauth1, secret and
+//callback belong to the temporary credentials and verifier is set once the user consents.
+type fakeGrant struct {
+	user      *FakeUser
+	redirect  string
+	challenge string
+	expires   time.Time
+	secret    string
+	callback  string
+	verifier  string
+}
+
+//NewFakeProvider returns a provider with the given client credentials and users.
+func NewFakeProvider(clientId string, clientSecret string, users ...*FakeUser) *FakeProvider {
+	return &FakeProvider{
+		Id:       clientId,
+		Secret:   clientSecret,
+		users:    users,
+		failures: make(map[string]int),
+		codes:    make(map[string]*fakeGrant),
+		access:   make(map[string]*fakeGrant),
+		refresh:  make(map[string]*fakeGrant),
+		temps:    make(map[string]*fakeGrant),
+	}
+}
+
+func (self *FakeProvider) ClientId(serviceName string) string {
+	return self.Id
+}
+
+func (self *FakeProvider) ClientSecret(serviceName string) string {
+	return self.Secret
+}
+
+//AddUser adds an account to the provider.
+func (self *FakeProvider) AddUser(u *FakeUser) {
+	self.Lock()
+	defer self.Unlock()
+	self.users = append(self.users, u)
+}
+
+//LoginAs makes the user with the given id the one that approves (or denies) access.  It
+//returns false if there is no such user.
+func (self *FakeProvider) LoginAs(id string) bool {
+	self.Lock()
+	defer self.Unlock()
+	for _, u := range self.users {
+		if u.Id == id {
+			self.current = u
+			return true
+		}
+	}
+	return false
+}
+
+//SetConsent sets what the user does at the authorization page from now on.
+func (self *FakeProvider) SetConsent(c FakeConsent) {
+	self.Lock()
+	defer self.Unlock()
+	self.consent = c
+}
+
+//FailNext makes the next request for path (such as GOOGLE_TOKEN_URL_PATH) fail with status.
+func (self *FakeProvider) FailNext(path string, status int) {
+	self.Lock()
+	defer self.Unlock()
+	self.failures[path] = status
+}
+
+//ExpireTokens makes all the oauth2 access tokens handed out so far expire, so that clients
+//have to use their refresh tokens.
+func (self *FakeProvider) ExpireTokens() {
+	self.Lock()
+	defer self.Unlock()
+	for _, g := range self.access {
+		g.expires = time.Now().Add(-time.Second)
+	}
+}
+
+func (self *FakeProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	self.Lock()
+	defer self.Unlock()
+	if status, ok := self.failures[r.URL.Path]; ok {
+		delete(self.failures, r.URL.Path)
+		http.Error(w, "injected failure", status)
+		return
+	}
+	switch r.URL.Path {
+	case GOOGLE_AUTH_URL_PATH:
+		self.authorize(w, r)
+	case GOOGLE_TOKEN_URL_PATH:
+		self.token(w, r)
+	case GOOGLE_USER_INFO_PATH:
+		self.userInfo(w, r)
+	case EVERNOTE_AUTH_URL_PATH:
+		self.oauth1Token(w, r)
+	case EVERNOTE_USER_URL_PATH:
+		self.oauth1Authorize(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+//user is the user approving access right now, or nil if there are no users.
+func (self *FakeProvider) user() *FakeUser {
+	if self.current != nil {
+		return self.current
+	}
+	if len(self.users) == 0 {
+		return nil
+	}
+	return self.users[0]
+}
+
+//consentPage handles the parts of the authorization page shared by oauth1 and oauth2.  It
+//returns false if the browser has been dealt with and should not be sent back with a code.
+func (self *FakeProvider) consentPage(w http.ResponseWriter, r *http.Request, back *url.URL, q url.Values, errorName string) bool {
+	switch {
+	case self.consent == FAKE_CONSENT_ABANDON:
+		fmt.Fprintf(w, "<html><body>Allow access?</body></html>")
+		return false
+	case self.consent == FAKE_CONSENT_DENY:
+		q.Set(errorName, "access_denied")
+	case self.user() == nil:
+		q.Set(errorName, "no_such_user")
+	default:
+		return true
+	}
+	back.RawQuery = q.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+	return false
+}
+
+//authorize is the oauth2 authorization endpoint.
+func (self *FakeProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != self.Id {
+		http.Error(w, "unknown client", http.StatusBadRequest)
+		return
+	}
+	back, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !back.IsAbs() {
+		http.Error(w, "bad redirect_uri", http.StatusBadRequest)
+		return
+	}
+	result := back.Query()
+	if s := q.Get("state"); s != "" {
+		result.Set("state", s)
+	}
+	if !self.consentPage(w, r, back, result, "error") {
+		return
+	}
+	code := UDID()
+	self.codes[code] = &fakeGrant{user: self.user(), redirect: q.Get("redirect_uri"), challenge: q.Get("code_challenge")}
+	result.Set("code", code)
+	back.RawQuery = result.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+//token is the oauth2 token endpoint, for both codes and refresh tokens.
+func (self *FakeProvider) token(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "token requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+	}
+	if id != self.Id || secret != self.Secret {
+		tokenError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+	var g *fakeGrant
+	switch r.PostFormValue("grant_type") {
+	case "authorization_code":
+		code := r.PostFormValue("code")
+		g = self.codes[code]
+		delete(self.codes, code)
+		if g == nil || g.redirect != r.PostFormValue("redirect_uri") ||
+			(g.challenge != "" && PKCEChallenge(r.PostFormValue("code_verifier")) != g.challenge) {
+			tokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	case "refresh_token":
+		g = self.refresh[r.PostFormValue("refresh_token")]
+		if g == nil {
+			tokenError(w, http.StatusBadRequest, "invalid_grant")
+			return
+		}
+	default:
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	ttl := self.TokenTTL
+	if ttl == 0 {
+		ttl = FAKE_TOKEN_TTL
+	}
+	tr := &tokenResponse{AccessToken: UDID(), RefreshToken: r.PostFormValue("refresh_token"),
+		ExpiresIn: int64(ttl / time.Second)}
+	if tr.RefreshToken == "" {
+		tr.RefreshToken = UDID()
+		self.refresh[tr.RefreshToken] = &fakeGrant{user: g.user}
+	}
+	self.access[tr.AccessToken] = &fakeGrant{user: g.user, expires: time.Now().Add(ttl)}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tr)
+}
+
+func tokenError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&tokenResponse{Error: code})
+}
+
+//userInfo is google's user info endpoint.
+func (self *FakeProvider) userInfo(w http.ResponseWriter, r *http.Request) {
+	g := self.access[strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	if g == nil || time.Now().After(g.expires) {
+		http.Error(w, "bad or expired token", http.StatusUnauthorized)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&GoogleUser{GoogleId: g.user.Id, EmailAddr: g.user.Email, Name: g.user.Name})
+}
+
+//oauth1Token is evernote's endpoint for both temporary credentials and tokens.  They are
+//told apart by the verifier.
+func (self *FakeProvider) oauth1Token(w http.ResponseWriter, r *http.Request) {
+	params := oauth1Params(r)
+	if params.Get("oauth_consumer_key") != self.Id {
+		http.Error(w, "unknown consumer", http.StatusUnauthorized)
+		return
+	}
+	if params.Get("oauth_verifier") == "" {
+		if !checkOauth1Signature(r, params, self.Secret, "") {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		temp := &fakeGrant{secret: UDID(), callback: params.Get("oauth_callback")}
+		tok := UDID()
+		self.temps[tok] = temp
+		fmt.Fprintf(w, "oauth_token=%s&oauth_token_secret=%s&oauth_callback_confirmed=true", tok, temp.secret)
+		return
+	}
+	tok := params.Get("oauth_token")
+	temp := self.temps[tok]
+	if temp == nil || !checkOauth1Signature(r, params, self.Secret, temp.secret) ||
+		temp.verifier == "" || temp.verifier != params.Get("oauth_verifier") {
+		http.Error(w, "bad temporary credentials or verifier", http.StatusUnauthorized)
+		return
+	}
+	delete(self.temps, tok)
+	v := url.Values{
+		"oauth_token":        {UDID()},
+		"oauth_token_secret": {UDID()},
+		"edam_userId":        {temp.user.Id},
+		"edam_noteStoreUrl":  {"http://" + r.Host + "/shard/s1/notestore"},
+	}
+	fmt.Fprint(w, v.Encode())
+}
+
+//oauth1Authorize is evernote's authorization page.  The action parameter is passed back to
+//the callback, as the connector uses it for the state.
+func (self *FakeProvider) oauth1Authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	temp := self.temps[q.Get("oauth_token")]
+	if temp == nil {
+		http.Error(w, "unknown temporary credentials", http.StatusBadRequest)
+		return
+	}
+	back, err := url.Parse(temp.callback)
+	if err != nil || !back.IsAbs() {
+		http.Error(w, "bad callback", http.StatusBadRequest)
+		return
+	}
+	result := back.Query()
+	result.Set("oauth_token", q.Get("oauth_token"))
+	if a := q.Get("action"); a != "" {
+		result.Set("action", a)
+	}
+	if !self.consentPage(w, r, back, result, "oauth_error") {
+		return
+	}
+	temp.user = self.user()
+	temp.verifier = UDID()
+	result.Set("oauth_verifier", temp.verifier)
+	back.RawQuery = result.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+//oauth1Params returns the oauth1 parameters of a request from the Authorization header,
+//the query and the form body.
+func oauth1Params(r *http.Request) url.Values {
+	r.ParseForm()
+	result := url.Values{}
+	for k, vs := range r.Form {
+		result[k] = vs
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "OAuth ") {
+		return result
+	}
+	for _, p := range strings.Split(strings.TrimPrefix(header, "OAuth "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, _ := url.QueryUnescape(strings.Trim(kv[1], `"`))
+		result.Add(kv[0], v)
+	}
+	return result
+}
+
+//oauth1Escape is the percent encoding of RFC 5849, which differs from url.QueryEscape
+//in its treatment of spaces and '~'.
+func oauth1Escape(s string) string {
+	return strings.Replace(strings.Replace(url.QueryEscape(s), "+", "%20", -1), "%7E", "~", -1)
+}
+
+//checkOauth1Signature recomputes the HMAC-SHA1 signature of a request as described by
+//RFC 5849, section 3.4, from the params returned by oauth1Params.
+func checkOauth1Signature(r *http.Request, params url.Values, consumerSecret string, tokenSecret string) bool {
+	var pairs []string
+	for k, vs := range params {
+		if k == "oauth_signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, oauth1Escape(k)+"="+oauth1Escape(v))
+		}
+	}
+	sort.Strings(pairs)
+	scheme := "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+	base := r.Method + "&" + oauth1Escape(scheme+r.Host+r.URL.Path) + "&" +
+		oauth1Escape(strings.Join(pairs, "&"))
+	h := hmac.New(sha1.New, []byte(oauth1Escape(consumerSecret)+"&"+oauth1Escape(tokenSecret)))
+	h.Write([]byte(base))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)) == params.Get("oauth_signature")
+}
+
+//FakeDeployment is a DeploymentEnvironment for tests that sends the browser back to the
+//application at AppURL and points the connectors at the provider at ProviderURL (see
+//ProviderHoster).
+type FakeDeployment struct {
+	AppURL      string
+	ProviderURL string
+}
+
+//NewFakeDeployment returns a deployment for the application and provider, usually the URLs of
+//two httptest servers.
+func NewFakeDeployment(appURL string, providerURL string) *FakeDeployment {
+	return &FakeDeployment{AppURL: appURL, ProviderURL: providerURL}
+}
+
+func (self *FakeDeployment) IsTest() bool {
+	return true
+}
+
+//Port is the port of the AppURL, or 0 if it has none.
+func (self *FakeDeployment) Port() int {
+	u, err := url.Parse(self.AppURL)
+	if err != nil {
+		return 0
+	}
+	var port int
+	fmt.Sscanf(u.Port(), "%d", &port)
+	return port
+}
+
+func (self *FakeDeployment) RedirectHost(serviceName string) string {
+	return self.AppURL
+}
+
+func (self *FakeDeployment) ProviderHost(serviceName string) string {
+	return self.ProviderURL
+}
@@ -0,0 +1,111 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestFakeProviderLoginFlows(t *testing.T) {
+	provider := NewFakeProvider(id, seekret, &FakeUser{Id: "1", Email: "alice@example.com", Name: "Alice"},
+		&FakeUser{Id: "2", Email: "bob@example.com", Name: "Bob"})
+	fake := httptest.NewServer(provider)
+	defer fake.Close()
+
+	mux := NewServeMux()
+	app := httptest.NewServer(mux)
+	defer app.Close()
+	dep := NewFakeDeployment(app.URL, fake.URL)
+	sm := NewSimpleSessionManager()
+	cm := NewSimpleCookieMapper(appName)
+	disp := NewAuthDispatcherRaw("/auth", NewSimplePageMapper(three, two, "/loggedout"), cm, sm)
+	disp.Tokens = NewSimpleTokenStore()
+	google := NewGoogleOauth2("email", "", provider, dep)
+	google.RequestOfflineAccess()
+	evernote := NewEvernoteOauth1(provider, dep)
+	disp.AddConnector(google, mux)
+	disp.AddConnector(evernote, mux)
+
+	//the browser follows the redirects between the app and the provider until it reaches
+	//one of the landing pages, which the app doesn't serve
+	jar, _ := cookiejar.New(nil)
+	appURL, _ := url.Parse(app.URL)
+	browser := &http.Client{Jar: jar}
+	browser.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if req.URL.Host == appURL.Host && (req.URL.Path == two || req.URL.Path == three || req.URL.Path == "/loggedout") {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}
+	visit := func(path string) string {
+		resp, err := browser.Get(app.URL + path)
+		if err != nil {
+			t.Fatalf("%s failed: %s", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 3 {
+			return resp.Request.URL.Path
+		}
+		u, _ := url.Parse(resp.Header.Get("Location"))
+		return u.Path
+	}
+	session := func() Session {
+		for _, c := range jar.Cookies(appURL) {
+			if c.Name == cm.CookieName() && c.Value != "" {
+				s, _ := sm.Find(c.Value)
+				return s
+			}
+		}
+		return nil
+	}
+
+	//google, with PKCE and a refresh when the access token stops working
+	if p := visit("/auth/google/login?state=s1"); p != two || session() == nil {
+		t.Fatalf("expected google login to land on %s with a session, but got %s", two, p)
+	}
+	conn, err := disp.Connection(google, session())
+	if err != nil {
+		t.Fatalf("no saved connection: %s", err)
+	}
+	provider.ExpireTokens()
+	if u, err := conn.(*GoogleConnection).FetchUser(); err != nil || u.EmailAddr != "alice@example.com" {
+		t.Errorf("unable to fetch user after token expired: %+v %v", u, err)
+	}
+	if p := visit("/auth/google/logout"); p != "/loggedout" || session() != nil {
+		t.Errorf("expected logout to clear the session, but got %s", p)
+	}
+
+	//the user says no, and the token endpoint falls over
+	provider.SetConsent(FAKE_CONSENT_DENY)
+	if p := visit("/auth/google/login?state=s2"); p != three || session() != nil {
+		t.Errorf("expected denied consent to land on the error page, but got %s", p)
+	}
+	provider.SetConsent(FAKE_CONSENT_ABANDON)
+	if p := visit("/auth/google/login?state=s3"); p != GOOGLE_AUTH_URL_PATH || session() != nil {
+		t.Errorf("expected abandoned login to stay at the provider, but got %s", p)
+	}
+	provider.SetConsent(FAKE_CONSENT_ALLOW)
+	provider.FailNext(GOOGLE_TOKEN_URL_PATH, http.StatusInternalServerError)
+	if p := visit("/auth/google/login?state=s4"); p != three || session() != nil {
+		t.Errorf("expected token failure to land on the error page, but got %s", p)
+	}
+
+	//evernote, as a different user
+	if !provider.LoginAs("2") {
+		t.Fatalf("unable to choose user")
+	}
+	if p := visit("/auth/evernote/login?action=s5"); p != two || session() == nil {
+		t.Fatalf("expected evernote login to land on %s with a session, but got %s", two, p)
+	}
+	conn, err = disp.Connection(evernote, session())
+	if err != nil || conn.(*EvernoteConnection).EvernoteId != 2 {
+		t.Errorf("expected evernote connection for user 2: %+v %v", conn, err)
+	}
+	provider.FailNext(EVERNOTE_AUTH_URL_PATH, http.StatusServiceUnavailable)
+	if p := visit("/auth/evernote/login?action=s6"); p != three {
+		t.Errorf("expected failure to get temporary credentials to land on the error page, but got %s", p)
+	}
+}
@@ -0,0 +1,336 @@
+package seven5
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+//RoleSource computes the roles of a request.  RawIOHook uses it to decide which fields of
+//a wire type the request may see and change.  RoleAuthorizer is a RoleSource.
+type RoleSource interface {
+	Roles(PBundle) []string
+}
+
+//BundleRoles returns the roles of the request represented by the bundle: ROLE_ANONYMOUS,
+//ROLE_AUTHENTICATED if there is a session, the roles of the session if it is a RoleHolder,
+//and the roles given to the user in store (which may be nil).
+func BundleRoles(bundle PBundle, store RoleStore) []string {
+	result := []string{ROLE_ANONYMOUS}
+	s := bundle.Session()
+	if s == nil {
+		return result
+	}
+	result = append(result, ROLE_AUTHENTICATED)
+	if rh, ok := s.(RoleHolder); ok {
+		result = append(result, rh.Roles()...)
+	}
+	if store != nil {
+		if roles, err := store.RolesOf(UserKey(s)); err == nil {
+			result = append(result, roles...)
+		}
+	}
+	return result
+}
+
+//fieldRule is the access allowed to one field of a wire type, from a tag such as
+//
+//	Salary Money `seven5:"read=admin|staff,write=admin"`
+//
+//An empty list of roles means that anybody may read (or write) the field.  If the field
+//is a struct (or a pointer, slice, array or map of them) that has rules of its own, they
+//are in nested, and t is the type of the field.
+type fieldRule struct {
+	name   string
+	key    string
+	read   []string
+	write  []string
+	nested []*fieldRule
+	t      reflect.Type
+}
+
+//fieldRules parses the seven5 tags of the fields of a wire type, and of the structs inside
+//it.  Fields without a tag, and without nested rules, have no rule.  The rules of an
+//embedded struct are those of the wire type itself, since encoding/json promotes its fields.
+func fieldRules(t reflect.Type) ([]*fieldRule, error) {
+	return nestedRules(t, map[reflect.Type]bool{})
+}
+
+//nestedRules is fieldRules for a type inside a wire type.  Types already seen are not
+//entered again, so the rules of a recursive type apply only at its first level.
+func nestedRules(t reflect.Type, seen map[reflect.Type]bool) ([]*fieldRule, error) {
+	seen[t] = true
+	defer delete(seen, t)
+	var result []*fieldRule
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if p := promoted(f); p != nil {
+			if !seen[p] {
+				rules, err := nestedRules(p, seen)
+				if err != nil {
+					return nil, err
+				}
+				result = append(result, rules...)
+			}
+			continue
+		}
+		rule := &fieldRule{name: f.Name, key: fieldKey(f), t: f.Type}
+		if inner := structInside(f.Type); inner != nil && !seen[inner] {
+			nested, err := nestedRules(inner, seen)
+			if err != nil {
+				return nil, err
+			}
+			rule.nested = nested
+		}
+		tag := f.Tag.Get("seven5")
+		if tag == "" {
+			if len(rule.nested) > 0 {
+				result = append(result, rule)
+			}
+			continue
+		}
+		for _, part := range strings.Split(tag, ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return nil, errors.New(fmt.Sprintf("%s.%s: bad seven5 tag %q", t.Name(), f.Name, tag))
+			}
+			roles := strings.Split(kv[1], "|")
+			switch kv[0] {
+			case "read":
+				rule.read = roles
+			case "write":
+				rule.write = roles
+			default:
+				return nil, errors.New(fmt.Sprintf("%s.%s: expected read or write in seven5 tag but got %s", t.Name(), f.Name, kv[0]))
+			}
+		}
+		result = append(result, rule)
+	}
+	return result, nil
+}
+
+//structInside returns the struct type of a field that is a struct, or a pointer, slice,
+//array or map of them.  It returns nil for any other field.
+func structInside(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Array || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+//promoted returns the type of an embedded struct (or pointer to one) whose fields
+//encoding/json puts in the object of the enclosing struct, or nil if f is not one.  Only
+//embedded structs of exported types are promoted here, since the fields of others can't
+//be read with reflection.
+func promoted(f reflect.StructField) reflect.Type {
+	if !f.Anonymous || f.PkgPath != "" || strings.Split(f.Tag.Get("json"), ",")[0] != "" {
+		return nil
+	}
+	t := f.Type
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+//fieldKey is the name of the field in the encoded form of the wire type.
+func fieldKey(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+//anyRole is true if allowed is empty or has one of roles in it.
+func anyRole(allowed []string, roles []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, a := range allowed {
+		for _, r := range roles {
+			if a == r {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//hidesAny is true if the roles may not read some field, at any level, of the rules.
+func hidesAny(rules []*fieldRule, roles []string) bool {
+	for _, rule := range rules {
+		if !anyRole(rule.read, roles) || hidesAny(rule.nested, roles) {
+			return true
+		}
+	}
+	return false
+}
+
+//checkWritable returns a 403 error if the decoded body (keyed as in the encoding) sets a
+//field, at any level, that the roles may not write.  Keys are compared without case, as
+//encoding/json does.
+func checkWritable(rules []*fieldRule, roles []string, body map[string]interface{}) error {
+	for k, v := range body {
+		for _, rule := range rules {
+			if !strings.EqualFold(k, rule.key) {
+				continue
+			}
+			if !anyRole(rule.write, roles) {
+				return HTTPError(http.StatusForbidden, fmt.Sprintf("field %s may not be written", rule.key))
+			}
+			if len(rule.nested) > 0 {
+				if err := checkNestedWritable(rule.nested, roles, rule.t, v); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+//checkNestedWritable is checkWritable for the decoded value of a field of type t with
+//nested rules: an object, or a list or map of them.
+func checkNestedWritable(rules []*fieldRule, roles []string, t reflect.Type, v interface{}) error {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return checkNestedWritable(rules, roles, t.Elem(), v)
+	case reflect.Struct:
+		obj, _ := v.(map[string]interface{})
+		return checkWritable(rules, roles, obj)
+	case reflect.Slice, reflect.Array:
+		list, _ := v.([]interface{})
+		for _, e := range list {
+			if err := checkNestedWritable(rules, roles, t.Elem(), e); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		m, _ := v.(map[string]interface{})
+		for _, e := range m {
+			if err := checkNestedWritable(rules, roles, t.Elem(), e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//withoutFields returns a copy of a wire object (or a slice of them) as maps that leave out
+//the fields, at any level, that the roles may not read.  Maps are used so that hidden
+//fields are not sent at all, rather than sent as zero values.
+func withoutFields(i interface{}, rules []*fieldRule, roles []string) interface{} {
+	return withoutValue(reflect.ValueOf(i), rules, roles)
+}
+
+//withoutValue is withoutFields for a value that may be a struct, or a pointer, slice, array
+//or map of them.  Other values are returned as they are.
+func withoutValue(v reflect.Value, rules []*fieldRule, roles []string) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v.Interface()
+		}
+		return withoutValue(v.Elem(), rules, roles)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return v.Interface()
+		}
+		result := make([]interface{}, v.Len())
+		for j := 0; j < v.Len(); j++ {
+			result[j] = withoutValue(v.Index(j), rules, roles)
+		}
+		return result
+	case reflect.Map:
+		if v.IsNil() {
+			return v.Interface()
+		}
+		result := make(map[string]interface{}, v.Len())
+		for iter := v.MapRange(); iter.Next(); {
+			result[fmt.Sprint(iter.Key().Interface())] = withoutValue(iter.Value(), rules, roles)
+		}
+		return result
+	}
+	if v.Kind() != reflect.Struct {
+		return v.Interface()
+	}
+	result := make(map[string]interface{})
+	addFields(v, rules, roles, result, map[string]bool{})
+	return result
+}
+
+//addFields puts the fields of the struct v that the roles may read in result, keyed as in
+//the encoding.  The fields of embedded structs are promoted, as encoding/json does, but do
+//not replace a field of the same name in an enclosing struct; done has the keys used so far,
+//whether their fields were sent or hidden.
+func addFields(v reflect.Value, rules []*fieldRule, roles []string, result map[string]interface{}, done map[string]bool) {
+	t := v.Type()
+	var embedded []reflect.Value
+	for j := 0; j < t.NumField(); j++ {
+		f := t.Field(j)
+		if promoted(f) != nil {
+			if e := v.Field(j); e.Kind() != reflect.Ptr {
+				embedded = append(embedded, e)
+			} else if !e.IsNil() {
+				embedded = append(embedded, e.Elem())
+			}
+			continue
+		}
+		key := fieldKey(f)
+		if f.PkgPath != "" || f.Tag.Get("json") == "-" || done[key] {
+			continue
+		}
+		done[key] = true
+		value := v.Field(j)
+		if strings.Contains(f.Tag.Get("json"), ",omitempty") && value.IsZero() {
+			continue
+		}
+		rule := ruleFor(rules, f.Name)
+		switch {
+		case rule == nil:
+			result[key] = value.Interface()
+		case !anyRole(rule.read, roles):
+		case len(rule.nested) > 0:
+			result[key] = withoutValue(value, rule.nested, roles)
+		default:
+			result[key] = value.Interface()
+		}
+	}
+	for _, e := range embedded {
+		addFields(e, rules, roles, result, done)
+	}
+}
+
+//ruleFor returns the rule for the field called name, or nil if there is none.
+func ruleFor(rules []*fieldRule, name string) *fieldRule {
+	for _, rule := range rules {
+		if rule.name == name {
+			return rule
+		}
+	}
+	return nil
+}
+
+//filterRows applies a RowFilter to the result of Index, which should be a slice.  The
+//result is a new slice of the same type.
+func filterRows(rf RowFilter, result interface{}, bundle PBundle) interface{} {
+	v := reflect.ValueOf(result)
+	if v.Kind() != reflect.Slice {
+		return result
+	}
+	kept := reflect.MakeSlice(v.Type(), 0, v.Len())
+	for j := 0; j < v.Len(); j++ {
+		if rf.AllowRow(v.Index(j).Interface(), bundle) {
+			kept = reflect.Append(kept, v.Index(j))
+		}
+	}
+	return kept.Interface()
+}
@@ -0,0 +1,239 @@
+package seven5
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type SalaryWire struct {
+	Id     Id
+	Owner  String255
+	Salary Integer   `seven5:"read=admin|staff,write=admin"`
+	Note   String255 `seven5:"write=staff"`
+}
+
+//salaryResource shows staff every salary and everyone else only their own.
+type salaryResource struct {
+	roles RoleStore
+	rows  []*SalaryWire
+}
+
+func (self *salaryResource) AllowRow(i interface{}, pb PBundle) bool {
+	s := pb.Session()
+	return s != nil && (hasRole(self.roles, UserKey(s), ROLE_STAFF) || string(i.(*SalaryWire).Owner) == s.SessionId())
+}
+
+func (self *salaryResource) Index(pb PBundle) (interface{}, error) {
+	return self.rows, nil
+}
+
+func (self *salaryResource) Find(id Id, pb PBundle) (interface{}, error) {
+	for _, r := range self.rows {
+		if r.Id == id {
+			return r, nil
+		}
+	}
+	return nil, HTTPError(http.StatusNotFound, "no such salary")
+}
+
+func (self *salaryResource) Put(id Id, i interface{}, pb PBundle) (interface{}, error) {
+	return i, nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestRowAndFieldFiltering(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"roles": {"authenticated": {"permissions": {"*": ["*"]}}}}`))
+	if err != nil {
+		t.Fatalf("bad policy: %s", err)
+	}
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	roles := NewSimpleRoleStore()
+	disp.UseAuthorizer(NewRoleAuthorizer(policy, roles))
+	alice, _ := sm.Generate(nil, "", nil, "", "")
+	bob, _ := sm.Generate(nil, "", nil, "", "")
+	res := &salaryResource{roles: roles, rows: []*SalaryWire{
+		&SalaryWire{Id: 1, Owner: String255(alice.SessionId()), Salary: 10},
+		&SalaryWire{Id: 2, Owner: String255(bob.SessionId()), Salary: 20},
+	}}
+	disp.ResourceSeparate("SalaryWire", &SalaryWire{}, res, res, nil, res, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method string, path string, body string, s Session) (*http.Response, string) {
+		resp := sendRequest(t, srv, method, path, body, sessionCookie(disp, s))
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	index := func(s Session) []map[string]interface{} {
+		var result []map[string]interface{}
+		_, body := do("GET", "/rest/salarywire", "", s)
+		json.Unmarshal([]byte(body), &result)
+		return result
+	}
+
+	//alice sees only her own row, and not the salary in it
+	rows := index(alice)
+	if len(rows) != 1 || rows[0]["Owner"] != alice.SessionId() {
+		t.Fatalf("expected only alice's row: %v", rows)
+	}
+	if _, ok := rows[0]["Salary"]; ok {
+		t.Errorf("salary should be hidden from alice: %v", rows[0])
+	}
+	if resp, _ := do("GET", "/rest/salarywire/2", "", alice); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected bob's row to be not found for alice but got %s", resp.Status)
+	}
+
+	//staff see every row and salaries
+	roles.Assign(UserKey(alice), ROLE_STAFF)
+	rows = index(alice)
+	if len(rows) != 2 || rows[1]["Salary"] != float64(20) {
+		t.Errorf("expected staff to see all salaries: %v", rows)
+	}
+	resp, body := do("GET", "/rest/salarywire/2", "", alice)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `"Salary": 20`) {
+		t.Errorf("expected staff to find bob's salary: %s %s", resp.Status, body)
+	}
+
+	//only admins can change salaries, only staff can change notes
+	if resp, _ := do("PUT", "/rest/salarywire/2", `{"Id":2,"salary":30}`, alice); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected salary write to be refused but got %s", resp.Status)
+	}
+	if resp, _ := do("PUT", "/rest/salarywire/2", `{"Id":2,"Note":"ok"}`, alice); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected staff to write note but got %s", resp.Status)
+	}
+	if resp, _ := do("PUT", "/rest/salarywire/1", `{"Id":1,"Note":"ok"}`, bob); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected note write by bob to be refused but got %s", resp.Status)
+	}
+	//a caller who is not logged in is asked to log in, not told which fields are refused
+	resp, _ = do("PUT", "/rest/salarywire/2", `{"Id":2,"Salary":30}`, nil)
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected 401 with challenge for anonymous salary write but got %s %v", resp.Status, resp.Header)
+	}
+	roles.Assign(UserKey(alice), ROLE_ADMIN)
+	if resp, _ := do("PUT", "/rest/salarywire/2", `{"Id":2,"Salary":30}`, alice); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected admin to write salary but got %s", resp.Status)
+	}
+
+	//bad tags are caught when the resource is added
+	defer func() {
+		if recover() == nil {
+			t.Errorf("expected panic for bad seven5 tag")
+		}
+	}()
+	type BadWire struct {
+		Id   Id
+		Name String255 `seven5:"see=admin"`
+	}
+	disp.ResourceSeparate("BadWire", &BadWire{}, res, nil, nil, nil, nil)
+}
+
+type PayWire struct {
+	Grade  String255
+	Amount Integer `seven5:"read=admin,write=admin"`
+}
+
+type ReviewWire struct {
+	Reviewer String255
+	Bonus    Integer `seven5:"read=admin,write=admin"`
+}
+
+type EmployeeWire struct {
+	ReviewWire
+	Id      Id
+	Name    String255
+	Pay     *PayWire
+	History []*PayWire
+	ByYear  map[String255]*PayWire
+}
+
+type employeeResource struct {
+	row *EmployeeWire
+}
+
+func (self *employeeResource) Find(id Id, pb PBundle) (interface{}, error) {
+	return self.row, nil
+}
+
+func (self *employeeResource) Put(id Id, i interface{}, pb PBundle) (interface{}, error) {
+	self.row = i.(*EmployeeWire)
+	return self.row, nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestNestedFieldRules(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"roles": {"authenticated": {"permissions": {"*": ["*"]}}}}`))
+	if err != nil {
+		t.Fatalf("bad policy: %s", err)
+	}
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	roles := NewSimpleRoleStore()
+	disp.UseAuthorizer(NewRoleAuthorizer(policy, roles))
+	alice, _ := sm.Generate(nil, "", nil, "", "")
+	res := &employeeResource{row: &EmployeeWire{Id: 1, Name: "bob",
+		Pay: &PayWire{Grade: "B", Amount: 10}, History: []*PayWire{&PayWire{Grade: "A", Amount: 5}},
+		ByYear:     map[String255]*PayWire{"2012": &PayWire{Grade: "A", Amount: 7}},
+		ReviewWire: ReviewWire{Reviewer: "carol", Bonus: 3}}}
+	disp.ResourceSeparate("EmployeeWire", &EmployeeWire{}, nil, res, nil, res, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	find := func() (string, map[string]interface{}) {
+		var result map[string]interface{}
+		resp := sendRequest(t, srv, "GET", "/rest/employeewire/1", "", sessionCookie(disp, alice))
+		b, _ := ioutil.ReadAll(resp.Body)
+		json.Unmarshal(b, &result)
+		return string(b), result
+	}
+
+	//amounts are hidden inside the struct and inside each element of the list and the map
+	body, row := find()
+	pay, _ := row["Pay"].(map[string]interface{})
+	if pay["Grade"] != "B" || strings.Contains(body, "Amount") {
+		t.Errorf("expected nested amounts to be hidden: %s", body)
+	}
+	byYear, _ := row["ByYear"].(map[string]interface{})
+	if year, _ := byYear["2012"].(map[string]interface{}); year["Grade"] != "A" {
+		t.Errorf("expected grades in the map to be sent: %s", body)
+	}
+	//the fields of the embedded struct are at the top level, as encoding/json puts them
+	if row["Reviewer"] != "carol" || strings.Contains(body, "ReviewWire") || strings.Contains(body, "Bonus") {
+		t.Errorf("expected embedded fields to be promoted and the bonus hidden: %s", body)
+	}
+	put := func(body string) *http.Response {
+		return sendRequest(t, srv, "PUT", "/rest/employeewire/1", body, sessionCookie(disp, alice))
+	}
+	if resp := put(`{"Id":1,"Pay":{"Grade":"C","Amount":30}}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected nested amount write to be refused but got %s", resp.Status)
+	}
+	if resp := put(`{"Id":1,"History":[{"Grade":"C"},{"amount":30}]}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected amount write in a list to be refused but got %s", resp.Status)
+	}
+	if resp := put(`{"Id":1,"ByYear":{"2013":{"Amount":30}}}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected amount write in a map to be refused but got %s", resp.Status)
+	}
+	if resp := put(`{"Id":1,"Bonus":30}`); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected embedded bonus write to be refused but got %s", resp.Status)
+	}
+	if resp := put(`{"Id":1,"Pay":{"Grade":"C"},"ByYear":{"2013":{"Grade":"C"}}}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected grade write to be allowed but got %s", resp.Status)
+	}
+
+	//admins see and write the amounts
+	roles.Assign(UserKey(alice), ROLE_ADMIN)
+	if resp := put(`{"Id":1,"Pay":{"Grade":"C","Amount":30},"Bonus":4}`); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected admin to write nested amount but got %s", resp.Status)
+	}
+	if body, _ := find(); !strings.Contains(body, `"Amount": 30`) || !strings.Contains(body, `"Bonus": 4`) {
+		t.Errorf("expected admin to see nested amount and bonus: %s", body)
+	}
+}
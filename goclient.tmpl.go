@@ -0,0 +1,161 @@
+package seven5
+
+//goclient_tmpl is the template for the Go client.  The output is run through go/format, so
+//the template does not need to get the layout exactly right.
+const goclient_tmpl = `
+{{- define "GO_LIBRARY" -}}
+// Code generated by seven5 from the wire types of the server. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/seven5/seven5"
+)
+
+//Client is the connection to the server shared by the clients of each resource.  Set
+//Cookie to the session cookie of a logged in user, or Bearer to an API token.
+type Client struct {
+	BaseURL string
+	HTTP    *http.Client
+	Cookie  *http.Cookie
+	Bearer  string
+}
+
+//NewClient returns a client for the server at baseURL, such as "https://example.com".
+func NewClient(baseURL string) *Client {
+	return &Client{BaseURL: strings.TrimSuffix(baseURL, "/"), HTTP: http.DefaultClient}
+}
+
+//do sends the request and decodes the result into out.  Responses that are not 2xx are
+//returned as a *seven5.Error with the status and message sent by the server.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	u := c.BaseURL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var body *bytes.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	} else {
+		body = bytes.NewReader(nil)
+	}
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Cookie != nil {
+		req.AddCookie(c.Cookie)
+	}
+	if c.Bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Bearer)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return &seven5.Error{StatusCode: resp.StatusCode, Msg: strings.TrimSpace(string(b))}
+	}
+	return json.Unmarshal(b, out)
+}
+
+func idPath(base string, id seven5.Id) string {
+	return base + "/" + strconv.FormatInt(int64(id), 10)
+}
+{{end -}}
+
+{{- define "GO_STRUCT" -}}
+type {{.GoName}} struct {
+{{range .Struct}}	{{.Name}} {{.Go}}
+{{end -}}
+}
+{{end -}}
+
+{{- define "GO_ENUM" -}}
+//{{.GoName}} is an enumeration.  The server refuses values that are not in {{.GoName}}Values.
+type {{.GoName}} string
+
+var {{.GoName}}Values = []{{.GoName}}{
+{{range .Enum}}	{{printf "%q" .}},
+{{end -}}
+}
+{{end -}}
+
+{{- define "GO_RESOURCE" -}}
+{{template "GO_STRUCT" .}}
+//{{.GoName}}Client calls the {{.Name}} resource.
+type {{.GoName}}Client struct {
+	*Client
+}
+
+//{{.GoName}} returns the client of the {{.Name}} resource.
+func (c *Client) {{.GoName}}() *{{.GoName}}Client {
+	return &{{.GoName}}Client{c}
+}
+
+const {{.GoName}}URL = "{{.RestPrefix}}{{tolower .Name}}"
+
+func (r *{{.GoName}}Client) Index(ctx context.Context, query url.Values) ([]*{{.GoName}}, error) {
+	var result []*{{.GoName}}
+	if err := r.do(ctx, "GET", {{.GoName}}URL, query, nil, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *{{.GoName}}Client) Find(ctx context.Context, id seven5.Id) (*{{.GoName}}, error) {
+	result := &{{.GoName}}{}
+	if err := r.do(ctx, "GET", idPath({{.GoName}}URL, id), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (r *{{.GoName}}Client) Post(ctx context.Context, obj *{{.GoName}}) (*{{.GoName}}, error) {
+	result := &{{.GoName}}{}
+	if err := r.do(ctx, "POST", {{.GoName}}URL, nil, obj, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{if .HasId}}
+func (r *{{.GoName}}Client) Put(ctx context.Context, obj *{{.GoName}}) (*{{.GoName}}, error) {
+	result := &{{.GoName}}{}
+	if err := r.do(ctx, "PUT", idPath({{.GoName}}URL, obj.Id), nil, obj, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end}}
+func (r *{{.GoName}}Client) Delete(ctx context.Context, id seven5.Id) (*{{.GoName}}, error) {
+	result := &{{.GoName}}{}
+	if err := r.do(ctx, "DELETE", idPath({{.GoName}}URL, id), nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+{{end -}}
+`
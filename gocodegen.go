@@ -0,0 +1,156 @@
+package seven5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/format"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var goclientTemplate *template.Template
+
+//init creates the template needed for Go client generation.
+func init() {
+	fnMap := template.FuncMap{
+		"tolower": strings.ToLower,
+	}
+	goclientTemplate = template.Must(template.New("GOCLIENT_TMPL").Funcs(fnMap).Parse(goclient_tmpl))
+}
+
+//exportedName makes the first letter of a wire type name upper case, since the generated
+//types must be visible outside the generated package.
+func exportedName(s string) string {
+	if s == "" {
+		return s
+	}
+	return strings.ToUpper(s[0:1]) + s[1:]
+}
+
+//Go returns the Go type of a field in the generated client.  Basic types are the seven5 types
+//and nested structs and optional fields are pointers.
+func (self *FieldDescription) Go() string {
+	switch self.TypeName {
+	case "Boolean", "DateTime", "Integer", "Floating", "String255", "Textblob", "Id":
+		if self.Optional {
+			return "*seven5." + self.TypeName
+		}
+		return "seven5." + self.TypeName
+	}
+	if self.EnumName != "" && self.Optional {
+		return "*" + exportedName(self.EnumName)
+	}
+	if self.EnumName != "" {
+		return exportedName(self.EnumName)
+	}
+	if self.Array != nil {
+		return "[]" + self.Array.Go()
+	}
+	if self.Map != nil {
+		return "map[seven5.String255]" + self.Map.Go()
+	}
+	if self.StructName != "" {
+		return "*" + exportedName(self.StructName)
+	}
+	panic(fmt.Sprintf("unable to convert type %s to Go type!", self.TypeName))
+}
+
+//goWrapper adds what the Go templates need to a FieldDescription.
+type goWrapper struct {
+	*FieldDescription
+	RestPrefix string
+	GoName     string
+}
+
+func generateGo(name string, data interface{}) string {
+	var buffer bytes.Buffer
+	if err := goclientTemplate.ExecuteTemplate(&buffer, name, data); err != nil {
+		return err.Error()
+	}
+	return buffer.String()
+}
+
+//GenerateGoClient returns the source of a Go package called pkg with a struct for every wire
+//type in the holder, a string type for every enumeration and a client for every resource,
+//with Index/Find/Post/Put/Delete methods.  Errors from the server are returned as *Error.  The restPrefix must be the one
+//used by the dispatcher to map its resources.
+func GenerateGoClient(holder TypeHolder, restPrefix string, pkg string) ([]byte, error) {
+	var text bytes.Buffer
+	resourceStructs := []*FieldDescription{}
+	supportStructs := []*FieldDescription{}
+	text.WriteString(generateGo("GO_LIBRARY", map[string]string{"Package": pkg}))
+	for _, d := range holder.All() {
+		text.WriteString("\n")
+		text.WriteString(generateGo("GO_RESOURCE", &goWrapper{d, restPrefix, exportedName(d.Name)}))
+		resourceStructs = append(resourceStructs, d)
+	}
+	for _, d := range holder.All() {
+		for _, s := range collectStructs(d) {
+			if !containsType(resourceStructs, s) && !containsType(supportStructs, s) {
+				supportStructs = append(supportStructs, s)
+			}
+		}
+	}
+	for _, s := range supportStructs {
+		text.WriteString("\n")
+		text.WriteString(generateGo("GO_STRUCT", &goWrapper{s, restPrefix, exportedName(s.StructName)}))
+	}
+	for _, e := range holderEnums(holder) {
+		text.WriteString("\n")
+		text.WriteString(generateGo("GO_ENUM", &goWrapper{e, restPrefix, exportedName(e.EnumName)}))
+	}
+	return format.Source(text.Bytes())
+}
+
+//GeneratedGoClientContent adds an http handler at urlPath that serves the Go client for the
+//types in holder as the package pkg.
+func GeneratedGoClientContent(mux *ServeMux, holder TypeHolder, urlPath string, restPrefix string, pkg string) {
+	mux.HandleFunc(urlPath, generateGoClientFunc(holder, restPrefix, pkg))
+}
+
+//generateGoClientFunc returns the handler used by GeneratedGoClientContent.
+func generateGoClientFunc(holder TypeHolder, restPrefix string, pkg string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		src, err := GenerateGoClient(holder, restPrefix, pkg)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to generate go client: %s", err), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/x-go; charset=utf-8")
+		if _, err := w.Write(src); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write result of code generation to the client: %s\n", err)
+		}
+	}
+}
+
+//GenerateGoClientForWireTypes writes the Go client for the types in t to client.go in the
+//package with the given import path, which is found with the GO_SOURCE_FLAVOR of the
+//projectfinder.  The package name is the last element of the import path.
+func GenerateGoClientForWireTypes(t TypeHolder, pre string, importPath string, pf ProjectFinder) error {
+	pkg := filepath.Base(importPath)
+	if pkg == "." || pkg == "/" || strings.ContainsAny(pkg, "-.") {
+		return errors.New(fmt.Sprintf("can't use %s as the name of a go package", pkg))
+	}
+	dir, err := pf.ProjectFind(filepath.Dir(importPath), "", GO_SOURCE_FLAVOR)
+	if err != nil {
+		return err
+	}
+	src, err := GenerateGoClient(t, pre, pkg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		return err
+	}
+	c, err := createPath(dir, pkg, "client.go")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(src)
+	return err
+}
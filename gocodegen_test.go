@@ -0,0 +1,55 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------*/
+func TestGoClient(T *testing.T) {
+	holder := NewSimpleTypeHolder()
+	holder.Add("someWire", &someWire{})
+	holder.Add("ScheduleWire", &ScheduleWire{})
+
+	src, err := GenerateGoClient(holder, "/rest/", "api")
+	if err != nil {
+		T.Fatalf("generated code doesn't parse: %s", err)
+	}
+	code := string(src)
+	verifyHasString(T, "package api", code)
+	verifyHasString(T, "type SomeWire struct {\n\tId  seven5.Id\n\tFoo seven5.String255\n}", code)
+	verifyHasString(T, "func (c *Client) SomeWire() *SomeWireClient", code)
+	verifyHasString(T, `const SomeWireURL = "/rest/somewire"`, code)
+	verifyHasString(T, "func (r *SomeWireClient) Index(ctx context.Context, query url.Values) ([]*SomeWire, error)", code)
+	verifyHasString(T, "func (r *SomeWireClient) Put(ctx context.Context, obj *SomeWire) (*SomeWire, error)", code)
+	verifyHasString(T, "func (r *ScheduleWireClient) Delete(ctx context.Context, id seven5.Id) (*ScheduleWire, error)", code)
+	verifyHasString(T, "Attendees []*Nested", code)
+	verifyHasString(T, "type Nested struct {", code)
+	verifyHasString(T, "return &seven5.Error{StatusCode: resp.StatusCode", code)
+
+	w := httptest.NewRecorder()
+	mux := NewServeMux()
+	GeneratedGoClientContent(mux, holder, "/client.go", "/rest/", "api")
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/client.go", nil))
+	if w.Body.String() != code {
+		T.Errorf("served code differs from generated code")
+	}
+
+	dir, err := ioutil.TempDir("", "seven5go")
+	if err != nil {
+		T.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := GenerateGoClientForWireTypes(holder, "/rest/", "example.com/my-api", dirFinder(dir)); err == nil {
+		T.Errorf("expected bad package name to be refused")
+	}
+	if err := GenerateGoClientForWireTypes(holder, "/rest/", "example.com/api", dirFinder(dir)); err != nil {
+		T.Fatalf("unable to write client: %s", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "example.com", "api", "client.go")); err != nil || string(b) != code {
+		T.Errorf("expected generated code in file: %v", err)
+	}
+}
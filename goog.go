@@ -7,38 +7,63 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"bytes"
+	"sync"
 )
 
 const (
-	GOOGLE_AUTH_URL_HOST = "https://accounts.google.com"
-	GOOGLE_AUTH_URL_PATH = "/o/oauth2/auth"
-	GOOGLE_AUTH_URL      = GOOGLE_AUTH_URL_HOST + GOOGLE_AUTH_URL_PATH
-	GOOGLE_TOKEN_URL     = "https://accounts.google.com/o/oauth2/token"
-	GOOGLE_USER_INFO     = "https://www.googleapis.com/oauth2/v1/userinfo"
+	GOOGLE_AUTH_URL_HOST  = "https://accounts.google.com"
+	GOOGLE_AUTH_URL_PATH  = "/o/oauth2/auth"
+	GOOGLE_AUTH_URL       = GOOGLE_AUTH_URL_HOST + GOOGLE_AUTH_URL_PATH
+	GOOGLE_TOKEN_URL_PATH = "/o/oauth2/token"
+	GOOGLE_TOKEN_URL      = GOOGLE_AUTH_URL_HOST + GOOGLE_TOKEN_URL_PATH
+	GOOGLE_API_HOST       = "https://www.googleapis.com"
+	GOOGLE_USER_INFO_PATH = "/oauth2/v1/userinfo"
+	GOOGLE_USER_INFO      = GOOGLE_API_HOST + GOOGLE_USER_INFO_PATH
 )
 
 type GoogleOauth2 struct {
-	cfg  *oauth2.Config
-	host string
+	cfg      *oauth2.Config
+	host     string
+	userInfo string
 }
 
+//NewGoogleOauth2 returns an OauthConnector for google.  If the DeploymentEnvironment is a
+//ProviderHoster with a host for "google", all of google's endpoints are expected to be at
+//that host with their usual paths.
 func NewGoogleOauth2(scope string, prompt string, d OauthClientDetail, dep DeploymentEnvironment) *GoogleOauth2 {
+	authHost := providerHost(dep, "google", GOOGLE_AUTH_URL_HOST)
 	cfg := &oauth2.Config{
 		ClientId:       d.ClientId("google"),
 		ClientSecret:   d.ClientSecret("google"),
 		Scope:          scope,
-		AuthURL:        GOOGLE_AUTH_URL,
-		TokenURL:       GOOGLE_TOKEN_URL,
+		AuthURL:        authHost + GOOGLE_AUTH_URL_PATH,
+		TokenURL:       authHost + GOOGLE_TOKEN_URL_PATH,
 		RedirectURL:    "", //don't know it yet
 		ApprovalPrompt: prompt,
 	}
 	return &GoogleOauth2{
-		host: dep.RedirectHost("google"),
-		cfg:  cfg,
+		host:     dep.RedirectHost("google"),
+		cfg:      cfg,
+		userInfo: providerHost(dep, "google", GOOGLE_API_HOST) + GOOGLE_USER_INFO_PATH,
 	}
 }
 
+//RequestOfflineAccess asks google for a refresh token as well as an access token, so that the
+//connection can be used after the user has left (and after the first hour).  Google only
+//returns the refresh token the first time the user approves access, unless the prompt is "force".
+func (self *GoogleOauth2) RequestOfflineAccess() {
+	self.cfg.AccessType = "offline"
+}
+
+//RestoreConnection creates a connection from the json written by GoogleConnection.MarshalCredentials.
+func (self *GoogleOauth2) RestoreConnection(data []byte) (OauthConnection, error) {
+	tok := &oauth2.Token{}
+	if err := json.Unmarshal(data, tok); err != nil {
+		return nil, err
+	}
+	return &GoogleConnection{Transport: &oauth2.Transport{Config: self.cfg, Token: tok}, userInfo: self.userInfo}, nil
+}
+
 func (self *GoogleOauth2) CodeValueName() string {
 	return "code"
 }
@@ -76,7 +101,15 @@ func (self *GoogleUser) SetEmail(e string) {
 
 //Returns the GoogleUser object onces we have connected to the service.
 func (self *GoogleConnection) FetchUser() (*GoogleUser, error) {
-	r, err := self.Client().Get(GOOGLE_USER_INFO)
+	info := self.userInfo
+	if info == "" {
+		info = GOOGLE_USER_INFO
+	}
+	req, err := http.NewRequest("GET", info, nil)
+	if err != nil {
+		return nil, err
+	}
+	r, err := self.SendAuthenticated(req)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +146,27 @@ func (self *GoogleOauth2) UserInteractionURL(ignored OauthCred, state string, ca
 	return self.cfg.AuthCodeURL(state)
 }
 
+//UserInteractionURLWithChallenge is the same as UserInteractionURL but adds the PKCE
+//code challenge so that google will insist on seeing the matching verifier in Phase2.
+func (self *GoogleOauth2) UserInteractionURLWithChallenge(ignored OauthCred, state string, callbackPath string,
+	challenge string) string {
+	return addChallenge(self.UserInteractionURL(ignored, state, callbackPath), challenge)
+}
+
+//Phase2WithVerifier exchanges the code for a token, proving with the verifier that we are the
+//same party that started the login.
+func (self *GoogleOauth2) Phase2WithVerifier(ignore string, code string, verifier string) (OauthConnection, error) {
+	tok, err := exchangeWithVerifier(self.cfg, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	transport := &oauth2.Transport{
+		Config: self.cfg,
+		Token:  tok,
+	}
+	return &GoogleConnection{Transport: transport, userInfo: self.userInfo}, nil
+}
+
 func (self *GoogleOauth2) Phase2(ignore string, code string) (OauthConnection, error) {
 	transport := &oauth2.Transport{
 		Config: self.cfg,
@@ -122,19 +176,27 @@ func (self *GoogleOauth2) Phase2(ignore string, code string) (OauthConnection, e
 		return nil, err
 	}
 	
-	return &GoogleConnection{transport}, nil
+	return &GoogleConnection{Transport: transport, userInfo: self.userInfo}, nil
 }
 
+//GoogleConnection is the connection returned by GoogleOauth2.  Its token is refreshed when
+//it expires or is refused, provided google gave us a refresh token (see RequestOfflineAccess).
 type GoogleConnection struct {
 	*oauth2.Transport
+	tokenPersistence
+	lock     sync.Mutex
+	userInfo string
 }
 
 func (self *GoogleConnection) SendAuthenticated(r *http.Request) (*http.Response, error) {
-	var buff bytes.Buffer
-	enc:=json.NewEncoder(&buff)
-	err:=enc.Encode(self.Transport);
-	if err!=nil{
-		panic(err)
-	}
-	return self.Client().Do(r)
+	return sendOauth2(&self.lock, self.Transport, r, func(t *oauth2.Token) error {
+		return self.save(json.Marshal(t))
+	})
+}
+
+//MarshalCredentials returns the token of this connection as json.
+func (self *GoogleConnection) MarshalCredentials() ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return json.Marshal(self.Token)
 }
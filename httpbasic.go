@@ -0,0 +1,199 @@
+package seven5
+
+import (
+	"bufio"
+	"code.google.com/p/go.crypto/bcrypt"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+//preauthKey is the context key for a session that was established before the request
+//reached the IOHook.
+type preauthKey struct{}
+
+//WithSession returns a copy of r that carries the session s.  Dispatchers that authenticate
+//a request themselves (like HTTPBasicDispatcher) use this to hand the session to the
+//RawIOHook, which puts it in the PBundle instead of looking at the cookie.
+func WithSession(r *http.Request, s Session) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), preauthKey{}, s))
+}
+
+//RequestSession returns the session attached to r with WithSession, or nil.
+func RequestSession(r *http.Request) Session {
+	s, _ := r.Context().Value(preauthKey{}).(Session)
+	return s
+}
+
+//BasicAuthVerifier checks a username and password sent with HTTP Basic authentication.
+type BasicAuthVerifier interface {
+	Verify(username string, password string) bool
+}
+
+//BasicAuthFunc lets an ordinary function be used as a BasicAuthVerifier.
+type BasicAuthFunc func(username string, password string) bool
+
+func (self BasicAuthFunc) Verify(username string, password string) bool {
+	return self(username, password)
+}
+
+//HtpasswdFile is a BasicAuthVerifier that reads users from a file in the format made by
+//Apache's htpasswd, one "user:hash" per line.  Only bcrypt (htpasswd -B) and SHA1 (-s)
+//hashes are understood; lines with other hashes are rejected when the file is loaded.
+type HtpasswdFile struct {
+	sync.RWMutex
+	path  string
+	users map[string]string
+}
+
+//NewHtpasswdFile loads the htpasswd file at path.
+func NewHtpasswdFile(path string) (*HtpasswdFile, error) {
+	result := &HtpasswdFile{path: path}
+	if err := result.Reload(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Reload reads the file again, so users can be changed without restarting.  If the file
+//can't be read the old users are kept.
+func (self *HtpasswdFile) Reload() error {
+	f, err := os.Open(self.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return errors.New(fmt.Sprintf("%s:%d: expected user:hash", self.path, n))
+		}
+		hash := line[i+1:]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return errors.New(fmt.Sprintf("%s:%d: unsupported hash (use bcrypt or SHA1)", self.path, n))
+		}
+		users[line[:i]] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.users = users
+	return nil
+}
+
+func (self *HtpasswdFile) Verify(username string, password string) bool {
+	self.RLock()
+	hash, ok := self.users[username]
+	self.RUnlock()
+	if !ok {
+		return false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+//BasicAuthSession is the Session for a request authenticated with HTTP Basic.  Since the
+//credentials come with every request, there is nothing to remember between requests and
+//these sessions are not kept in a SessionManager.
+type BasicAuthSession struct {
+	Username string
+}
+
+func (self *BasicAuthSession) SessionId() string {
+	return "basic:" + self.Username
+}
+
+//HTTPBasicDispatcher protects another dispatcher (typically a BaseDispatcher) with HTTP
+//Basic authentication.  Requests without valid credentials are refused with a 401 and a
+//WWW-Authenticate challenge, which goes through the ServeMux's ErrorDispatcher like any
+//other error.  Authenticated requests are passed to the wrapped dispatcher with a session
+//made by NewSession, which RawIOHook puts in the PBundle.
+type HTTPBasicDispatcher struct {
+	Wrapped    Dispatcher
+	Verifier   BasicAuthVerifier
+	Realm      string
+	NewSession func(username string) Session
+}
+
+//NewHTTPBasicDispatcher returns a dispatcher that checks credentials with v before passing
+//requests to d.  The sessions are BasicAuthSessions.
+func NewHTTPBasicDispatcher(d Dispatcher, v BasicAuthVerifier, realm string) *HTTPBasicDispatcher {
+	return &HTTPBasicDispatcher{
+		Wrapped:  d,
+		Verifier: v,
+		Realm:    realm,
+		NewSession: func(username string) Session {
+			return &BasicAuthSession{Username: username}
+		},
+	}
+}
+
+func (self *HTTPBasicDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	user, pass, ok := r.BasicAuth()
+	if !ok || !self.Verifier.Verify(user, pass) {
+		basicChallenge(w, self.Realm)
+		http.Error(w, "Authentication required", http.StatusUnauthorized)
+		return nil
+	}
+	return self.Wrapped.Dispatch(mux, w, WithSession(r, self.NewSession(user)))
+}
+
+func basicChallenge(w http.ResponseWriter, realm string) {
+	w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Basic realm=%q, charset="UTF-8"`, realm))
+}
+
+//BasicChallengeErrorDispatcher is an ErrorDispatcher that adds an HTTP Basic challenge to
+//every 401 that doesn't have one, such as the "Not authorized" errors from RawDispatcher,
+//so that browsers ask for a password.  Other challenges on the response are kept.  Errors
+//are then handled by Wrapped, or if that is nil, sent as is.
+type BasicChallengeErrorDispatcher struct {
+	Wrapped ErrorDispatcher
+	Realm   string
+}
+
+func (self *BasicChallengeErrorDispatcher) ErrorDispatch(status int, w http.ResponseWriter, r *http.Request) {
+	if status == http.StatusUnauthorized && !hasBasicChallenge(w) {
+		basicChallenge(w, self.Realm)
+	}
+	if self.Wrapped != nil {
+		self.Wrapped.ErrorDispatch(status, w, r)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+func hasBasicChallenge(w http.ResponseWriter) bool {
+	for _, c := range w.Header()["Www-Authenticate"] {
+		if strings.HasPrefix(c, "Basic ") {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *BasicChallengeErrorDispatcher) PanicDispatch(p interface{}, w http.ResponseWriter, r *http.Request) {
+	if self.Wrapped != nil {
+		self.Wrapped.PanicDispatch(p, w, r)
+		return
+	}
+	http.Error(w, fmt.Sprintf("%v", p), http.StatusInternalServerError)
+}
@@ -0,0 +1,95 @@
+package seven5
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestHTTPBasicDispatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5basic")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	b, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	sum := sha1.Sum([]byte("swordfish"))
+	path := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(path, []byte(fmt.Sprintf("# tools\nadmin:%s\nops:{SHA}%s\n", b,
+		base64.StdEncoding.EncodeToString(sum[:]))), 0600)
+	htpasswd, err := NewHtpasswdFile(path)
+	if err != nil {
+		t.Fatalf("unable to read htpasswd: %s", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "bad"), []byte("admin:$apr1$xyz$abc\n"), 0600)
+	if _, err := NewHtpasswdFile(filepath.Join(dir, "bad")); err == nil {
+		t.Errorf("expected unsupported hash to be refused")
+	}
+
+	disp := NewBaseDispatcher(appName, nil)
+	res := &scopedResource{}
+	disp.ResourceSeparate("NoteWire", &NoteWire{}, res, nil, res, nil, nil)
+	mux := NewServeMux()
+	mux.SetErrorDispatcher(&BasicChallengeErrorDispatcher{Realm: "tools"})
+	mux.Dispatch("/rest/", NewHTTPBasicDispatcher(disp, htpasswd, "tools"))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cases := []struct {
+		user   string
+		pass   string
+		status int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"nobody", "hunter2", http.StatusUnauthorized},
+		{"admin", "hunter2", http.StatusOK},
+		{"ops", "swordfish", http.StatusOK},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", srv.URL+"/rest/notewire", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		if resp.StatusCode != c.status {
+			t.Errorf("%s/%s: expected %d but got %s", c.user, c.pass, c.status, resp.Status)
+		}
+		if c.status == http.StatusUnauthorized {
+			if resp.Header.Get("WWW-Authenticate") != `Basic realm="tools", charset="UTF-8"` {
+				t.Errorf("%s: bad challenge '%s'", c.user, resp.Header.Get("WWW-Authenticate"))
+			}
+			continue
+		}
+		var notes []*NoteWire
+		json.NewDecoder(resp.Body).Decode(&notes)
+		if len(notes) != 1 || string(notes[0].Text) != "basic:"+c.user {
+			t.Errorf("%s: session not passed to resource: %v", c.user, notes)
+		}
+	}
+
+	//the error dispatcher challenges refusals that come from the resource too
+	open := NewBaseDispatcher(appName, nil)
+	open.ResourceSeparate("NoteWire", &NoteWire{}, res, nil, res, nil, nil)
+	mux = NewServeMux()
+	mux.SetErrorDispatcher(&BasicChallengeErrorDispatcher{Realm: "tools"})
+	mux.Dispatch("/rest/", open)
+	srv2 := httptest.NewServer(mux)
+	defer srv2.Close()
+	resp, _ := http.Get(srv2.URL + "/rest/notewire")
+	if resp.StatusCode != http.StatusUnauthorized || resp.Header.Get("WWW-Authenticate") == "" {
+		t.Errorf("expected challenge from error dispatcher: %s %v", resp.Status, resp.Header)
+	}
+}
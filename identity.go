@@ -0,0 +1,449 @@
+package seven5
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	NO_SUCH_IDENTITY = errors.New("No user has that identity")
+	IDENTITY_IN_USE  = errors.New("That identity belongs to another user")
+	LAST_IDENTITY    = errors.New("Can't unlink the only way a user has to log in")
+)
+
+//IDENTITY_LINK_TTL is how long a user has to log in with another identity after asking the
+//LinkDispatcher to link it.
+const IDENTITY_LINK_TTL = 10 * time.Minute
+
+//MergePolicy decides what BasicManager does when a user who is linking identities (see
+//LinkDispatcher) logs in with an identity that is already linked to a different user.
+type MergePolicy int
+
+const (
+	//MERGE_REFUSE fails the login with IDENTITY_IN_USE.
+	MERGE_REFUSE MergePolicy = iota
+	//MERGE_MOVE_IDENTITY takes the identity away from the other user and links it to the
+	//logged in user.  The other user is left with their remaining identities; if it is
+	//the only one they have, the login fails with LAST_IDENTITY.
+	MERGE_MOVE_IDENTITY
+	//MERGE_USERS calls UserMerger.Merge to fold the other user into the logged in user
+	//and then moves all of the other user's identities.
+	MERGE_USERS
+)
+
+//Identity is one way that a user can log in: the subject (user id) at a provider.
+type Identity struct {
+	Id       Id
+	Provider string
+	Subject  string
+	User     Id
+}
+
+//IdentityConnection is implemented by OauthConnections that know who the user is at the
+//provider.  The provider name should be stable and unique, such as "google" or the issuer
+//of an OpenID provider.
+type IdentityConnection interface {
+	OauthConnection
+	Identity() (provider string, subject string, err error)
+}
+
+//IdentityTable maps identities to users.  Link returns IDENTITY_IN_USE if the identity is
+//linked to another user, and Lookup returns NO_SUCH_IDENTITY if it isn't linked at all.
+//Implementations must be safe to call from multiple goroutines.
+type IdentityTable interface {
+	Lookup(provider string, subject string) (*Identity, error)
+	Link(provider string, subject string, user Id) (*Identity, error)
+	Unlink(id Id) error
+	Move(id Id, user Id) error
+	Identities(user Id) ([]*Identity, error)
+}
+
+//SimpleIdentityTable is an IdentityTable kept in memory.
+type SimpleIdentityTable struct {
+	sync.Mutex
+	nextId Id
+	byId   map[Id]*Identity
+}
+
+//NewSimpleIdentityTable returns an empty, in-memory IdentityTable.
+func NewSimpleIdentityTable() *SimpleIdentityTable {
+	return &SimpleIdentityTable{nextId: 1, byId: make(map[Id]*Identity)}
+}
+
+func (self *SimpleIdentityTable) find(provider string, subject string) *Identity {
+	for _, i := range self.byId {
+		if i.Provider == provider && i.Subject == subject {
+			return i
+		}
+	}
+	return nil
+}
+
+func (self *SimpleIdentityTable) Lookup(provider string, subject string) (*Identity, error) {
+	self.Lock()
+	defer self.Unlock()
+	i := self.find(provider, subject)
+	if i == nil {
+		return nil, NO_SUCH_IDENTITY
+	}
+	result := *i
+	return &result, nil
+}
+
+//Link is a no-op if the identity is already linked to user.
+func (self *SimpleIdentityTable) Link(provider string, subject string, user Id) (*Identity, error) {
+	self.Lock()
+	defer self.Unlock()
+	i := self.find(provider, subject)
+	if i != nil && i.User != user {
+		return nil, IDENTITY_IN_USE
+	}
+	if i == nil {
+		i = &Identity{Id: self.nextId, Provider: provider, Subject: subject, User: user}
+		self.byId[i.Id] = i
+		self.nextId++
+	}
+	result := *i
+	return &result, nil
+}
+
+func (self *SimpleIdentityTable) Unlink(id Id) error {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.byId[id]; !ok {
+		return NO_SUCH_IDENTITY
+	}
+	delete(self.byId, id)
+	return nil
+}
+
+func (self *SimpleIdentityTable) Move(id Id, user Id) error {
+	self.Lock()
+	defer self.Unlock()
+	i, ok := self.byId[id]
+	if !ok {
+		return NO_SUCH_IDENTITY
+	}
+	i.User = user
+	return nil
+}
+
+//Identities returns the identities of user in the order they were linked.
+func (self *SimpleIdentityTable) Identities(user Id) ([]*Identity, error) {
+	self.Lock()
+	defer self.Unlock()
+	result := []*Identity{}
+	for _, i := range self.byId {
+		if i.User == user {
+			c := *i
+			result = append(result, &c)
+		}
+	}
+	sort.Sort(identitiesById(result))
+	return result, nil
+}
+
+type identitiesById []*Identity
+
+func (self identitiesById) Len() int           { return len(self) }
+func (self identitiesById) Less(i, j int) bool { return self[i].Id < self[j].Id }
+func (self identitiesById) Swap(i, j int)      { self[i], self[j] = self[j], self[i] }
+
+//IdentitySupport must be implemented by a BasicUserSupport used with an IdentityTable.
+//SessionFor creates a session for a user that was recognized by one of their identities.
+//The BasicUserSupport's Generate is then only called for identities nobody has seen before,
+//to create a new user.
+type IdentitySupport interface {
+	SessionFor(u BasicUser, c OauthConnection) (Session, error)
+}
+
+//UserMerger can be implemented by a BasicUserSupport to allow MERGE_USERS.  Merge should
+//copy whatever it likes from the user "from" into "into" and then delete "from".
+type UserMerger interface {
+	Merge(from BasicUser, into BasicUser) error
+}
+
+//Identity returns the google id of the user.  This requires a request to google.
+func (self *GoogleConnection) Identity() (string, string, error) {
+	u, err := self.FetchUser()
+	if err != nil {
+		return "", "", err
+	}
+	return "google", u.GoogleId, nil
+}
+
+//Identity returns the issuer and subject of the id token.
+func (self *OIDCConnection) Identity() (string, string, error) {
+	return self.claims.Issuer, self.claims.Subject, nil
+}
+
+//Identity returns the evernote user id.
+func (self *EvernoteConnection) Identity() (string, string, error) {
+	return "evernote", strconv.FormatInt(self.EvernoteId, 10), nil
+}
+
+//Identity returns the username of the local account.
+func (self *PasswordConnection) Identity() (string, string, error) {
+	return PASSWORD_CONNECTOR_NAME, self.Username, nil
+}
+
+//generateWithIdentity is BasicManager.Generate when there is an IdentityTable.  A logged
+//in user whose browser asked to link an identity (see LinkDispatcher) gets the identity
+//linked to them.  Otherwise the identity decides the user, and a new user is created for a
+//new identity, even if someone is logged in: a login alone never links identities.
+func (self *BasicManager) generateWithIdentity(c IdentityConnection, existing Session, r *http.Request) (Session, error) {
+	is, ok := self.Sup.(IdentitySupport)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%T must implement IdentitySupport to use identities", self.Sup))
+	}
+	provider, subject, err := c.Identity()
+	if err != nil {
+		return nil, err
+	}
+	owner, err := self.Identities.Lookup(provider, subject)
+	if err != nil && err != NO_SUCH_IDENTITY {
+		return nil, err
+	}
+	current, _ := existing.(BasicUser)
+	if current != nil && !self.linking(existing.SessionId(), r) {
+		current, existing = nil, nil
+	}
+	switch {
+	case current == nil && owner == nil:
+		s, err := self.Sup.Generate(c, existing)
+		if err != nil || s == nil {
+			return s, err
+		}
+		u, ok := s.(BasicUser)
+		if !ok {
+			return nil, errors.New("sessions made by BasicUserSupport must be BasicUsers")
+		}
+		if _, err := self.Identities.Link(provider, subject, u.WireId()); err != nil {
+			return nil, err
+		}
+		return s, nil
+	case current == nil:
+		u := self.knownUser(owner.User)
+		if u == nil {
+			return nil, BAD_ID
+		}
+		return is.SessionFor(u, c)
+	case owner == nil:
+		if _, err := self.Identities.Link(provider, subject, current.WireId()); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	case owner.User == current.WireId():
+		return existing, nil
+	}
+	//the identity belongs to someone else
+	switch self.Merge {
+	case MERGE_MOVE_IDENTITY:
+		all, err := self.Identities.Identities(owner.User)
+		if err != nil {
+			return nil, err
+		}
+		if len(all) == 1 {
+			return nil, LAST_IDENTITY
+		}
+		if err := self.Identities.Move(owner.Id, current.WireId()); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	case MERGE_USERS:
+		m, ok := self.Sup.(UserMerger)
+		other := self.knownUser(owner.User)
+		if !ok || other == nil {
+			return nil, IDENTITY_IN_USE
+		}
+		if err := m.Merge(other, current); err != nil {
+			return nil, err
+		}
+		all, err := self.Identities.Identities(owner.User)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range all {
+			if err := self.Identities.Move(i.Id, current.WireId()); err != nil {
+				return nil, err
+			}
+		}
+		return existing, nil
+	}
+	return nil, IDENTITY_IN_USE
+}
+
+//linking is true if the browser that sent r has a ticket from the LinkDispatcher for the
+//session.  The ticket is used up.
+func (self *BasicManager) linking(sessionId string, r *http.Request) bool {
+	if self.linkCookie == "" || r == nil {
+		return false
+	}
+	c, err := r.Cookie(self.linkCookie)
+	if err != nil || c.Value == "" {
+		return false
+	}
+	v, ok := self.links.Take(c.Value)
+	return ok && v.(string) == sessionId
+}
+
+//LinkDispatcher is how a logged in user asks to link another identity.  A POST to it gives
+//the browser a single use ticket, in a cookie, that lasts for IDENTITY_LINK_TTL; a login
+//from that browser with another provider in that time links the identity to the user
+//(subject to the MergePolicy).  Since linking can hand an account to whoever owns the
+//identity, the POST must come from a script on our own pages: it must have an
+//X-Requested-With header, which a form on another site can't send, and an Origin header,
+//if present, must be our own.  Sessions is the SessionManager the application uses, which
+//may wrap the BasicManager (a JWTSessionManager, for example).
+type LinkDispatcher struct {
+	Manager   *BasicManager
+	Sessions  SessionManager
+	CookieMap CookieMapper
+}
+
+//LinkDispatcher returns a dispatcher for linking identities of the users of this manager.
+//Map it at a path such as /auth/link.
+func (self *BasicManager) LinkDispatcher(sessions SessionManager, cm CookieMapper) *LinkDispatcher {
+	self.linkCookie = cm.CookieName() + "-link"
+	return &LinkDispatcher{Manager: self, Sessions: sessions, CookieMap: cm}
+}
+
+//Dispatch answers a POST with 204 and the ticket cookie.  A user who is impersonating
+//someone can't link identities to them.
+func (self *LinkDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	if r.Method != "POST" {
+		http.Error(w, "linking an identity must be POSTed", http.StatusMethodNotAllowed)
+		return nil
+	}
+	if r.Header.Get("X-Requested-With") == "" || !sameOrigin(r) {
+		http.Error(w, "linking an identity must be asked for by our own pages", http.StatusForbidden)
+		return nil
+	}
+	var s Session
+	if id, err := self.CookieMap.Value(r); err == nil {
+		s, _ = self.Sessions.Find(id)
+	}
+	u := UnwrapSession(s)
+	if _, ok := u.(BasicUser); !ok {
+		http.Error(w, NOT_LOGGED_IN.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	if _, ok := u.(*ImpersonationSession); ok {
+		http.Error(w, "can't link identities while impersonating", http.StatusForbidden)
+		return nil
+	}
+	nonce, err := NewPKCEVerifier()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+	self.Manager.links.Put(nonce, u.SessionId())
+	http.SetCookie(w, &http.Cookie{
+		Name:     self.Manager.linkCookie,
+		Value:    nonce,
+		Path:     "/",
+		MaxAge:   int(IDENTITY_LINK_TTL / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+//sameOrigin is false if r has an Origin header that is not the host it was sent to.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+func (self *BasicManager) knownUser(id Id) BasicUser {
+	for _, u := range self.Sup.KnownUsers() {
+		if u.WireId() == id {
+			return u
+		}
+	}
+	return nil
+}
+
+//IdentityWire is the wire type of the identity resource.
+type IdentityWire struct {
+	Id       Id
+	Provider String255
+	Subject  String255
+}
+
+//IdentityResource lists (GET) and unlinks (DELETE) the identities of the logged in user.
+//Identities are linked with the LinkDispatcher.  Map it
+//with ResourceSeparate, since it does not support Find, Put or Post:
+//
+//	disp.ResourceSeparate("IdentityWire", &IdentityWire{}, res, nil, nil, nil, res)
+type IdentityResource struct {
+	Table IdentityTable
+}
+
+//IdentityResource returns a resource for the identities of the users of this manager.
+func (self *BasicManager) IdentityResource() *IdentityResource {
+	return &IdentityResource{Table: self.Identities}
+}
+
+func (self *IdentityResource) AllowRead(bundle PBundle) bool {
+	_, ok := UnwrapSession(bundle.Session()).(BasicUser)
+	return ok
+}
+
+//Allow only lets users unlink their own identities; ownership is checked by Delete.
+func (self *IdentityResource) Allow(id Id, method string, bundle PBundle) bool {
+	_, ok := UnwrapSession(bundle.Session()).(BasicUser)
+	return ok && method == "DELETE"
+}
+
+func (self *IdentityResource) Index(bundle PBundle) (interface{}, error) {
+	u, err := loggedInUser(bundle)
+	if err != nil {
+		return nil, err
+	}
+	all, err := self.Table.Identities(u.WireId())
+	if err != nil {
+		return nil, err
+	}
+	result := []*IdentityWire{}
+	for _, i := range all {
+		result = append(result, &IdentityWire{Id: i.Id, Provider: String255(i.Provider), Subject: String255(i.Subject)})
+	}
+	return result, nil
+}
+
+//Delete unlinks an identity, as long as it is not the user's last one.
+func (self *IdentityResource) Delete(id Id, bundle PBundle) (interface{}, error) {
+	u, err := loggedInUser(bundle)
+	if err != nil {
+		return nil, err
+	}
+	all, err := self.Table.Identities(u.WireId())
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range all {
+		if i.Id != id {
+			continue
+		}
+		if len(all) == 1 {
+			return nil, HTTPError(http.StatusConflict, LAST_IDENTITY.Error())
+		}
+		if err := self.Table.Unlink(id); err != nil {
+			return nil, err
+		}
+		return &IdentityWire{Id: i.Id, Provider: String255(i.Provider), Subject: String255(i.Subject)}, nil
+	}
+	return nil, HTTPError(http.StatusNotFound, NO_SUCH_IDENTITY.Error())
+}
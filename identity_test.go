@@ -0,0 +1,183 @@
+package seven5
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//linkedUser is both the user and the session, as BasicManager expects.
+type linkedUser struct {
+	id  Id
+	sid string
+}
+
+func (self *linkedUser) SessionId() string   { return self.sid }
+func (self *linkedUser) Email() string       { return "" }
+func (self *linkedUser) SetEmail(string)     {}
+func (self *linkedUser) WireId() Id          { return self.id }
+func (self *linkedUser) ToWire() interface{} { return nil }
+
+type linkedSupport struct {
+	users  []*linkedUser
+	nextId Id
+}
+
+func (self *linkedSupport) IsAdmin(BasicUser) bool                  { return false }
+func (self *linkedSupport) IsStaff(BasicUser) bool                  { return false }
+func (self *linkedSupport) UpdateFields(p interface{}, e BasicUser) {}
+func (self *linkedSupport) Delete(Id) BasicUser                     { return nil }
+
+func (self *linkedSupport) KnownUsers() []BasicUser {
+	result := []BasicUser{}
+	for _, u := range self.users {
+		result = append(result, u)
+	}
+	return result
+}
+
+func (self *linkedSupport) Generate(c OauthConnection, existing Session) (Session, error) {
+	self.nextId++
+	u := &linkedUser{id: self.nextId, sid: UDID()}
+	self.users = append(self.users, u)
+	return u, nil
+}
+
+func (self *linkedSupport) SessionFor(u BasicUser, c OauthConnection) (Session, error) {
+	lu := u.(*linkedUser)
+	lu.sid = UDID()
+	return lu, nil
+}
+
+func (self *linkedSupport) Merge(from BasicUser, into BasicUser) error {
+	for i, u := range self.users {
+		if u == from {
+			self.users = append(self.users[:i], self.users[i+1:]...)
+		}
+	}
+	return nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestIdentityLinking(t *testing.T) {
+	sup := &linkedSupport{}
+	mgr := NewBasicManager(sup)
+	mgr.Identities = NewSimpleIdentityTable()
+	cm := NewSimpleCookieMapper(appName)
+	linker := mgr.LinkDispatcher(mgr, cm)
+	alice := &PasswordConnection{Username: "alice"}
+	ever := &EvernoteConnection{EvernoteId: 42}
+	bob := &PasswordConnection{Username: "bob"}
+
+	//link asks to link an identity to the user of s, and returns the status and the
+	//request that a login from the same browser would be
+	link := func(s Session, header ...string) (int, *http.Request) {
+		req := httptest.NewRequest("POST", "/auth/link", nil)
+		req.AddCookie(&http.Cookie{Name: cm.CookieName(), Value: s.SessionId()})
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		linker.Dispatch(nil, w, req)
+		result := httptest.NewRequest("GET", "/auth/evernote/oauth2callback", nil)
+		for _, c := range w.Result().Cookies() {
+			result.AddCookie(c)
+		}
+		return w.Code, result
+	}
+	linkFor := func(s Session) *http.Request {
+		code, r := link(s, "X-Requested-With", "XMLHttpRequest")
+		if code != http.StatusNoContent {
+			t.Fatalf("unable to start linking: %d", code)
+		}
+		return r
+	}
+	login := func(c OauthConnection, existing Session, r *http.Request) (*linkedUser, error) {
+		id := ""
+		if existing != nil {
+			id = existing.SessionId()
+		}
+		s, err := mgr.Generate(c, id, r, "", "")
+		if err != nil {
+			return nil, err
+		}
+		return s.(*linkedUser), nil
+	}
+
+	first, _ := login(alice, nil, nil)
+	mgr.Destroy(first.SessionId())
+	again, _ := login(alice, nil, nil)
+	if again.WireId() != first.WireId() || len(sup.users) != 1 {
+		t.Errorf("same identity should log in the same user: %d %d", again.WireId(), first.WireId())
+	}
+
+	//logging in while logged in is not enough to link
+	if u, err := login(&EvernoteConnection{EvernoteId: 7}, again, nil); err != nil || u.WireId() == first.WireId() {
+		t.Errorf("expected a login without asking to link to be a new user: %v %v", u, err)
+	}
+	for _, bad := range [][]string{nil, {"X-Requested-With", "x", "Origin", "https://evil.example.com"}} {
+		if code, r := link(again, bad...); code != http.StatusForbidden || len(r.Cookies()) != 0 {
+			t.Errorf("expected linking without our own page to be refused: %v %d", bad, code)
+		}
+	}
+	if code, _ := link(&linkedUser{sid: "nobody"}, "X-Requested-With", "x"); code != http.StatusUnauthorized {
+		t.Errorf("expected linking without a session to be refused: %d", code)
+	}
+
+	r := linkFor(again)
+	if u, err := login(ever, again, r); err != nil || u.WireId() != first.WireId() {
+		t.Errorf("expected evernote to be linked to the logged in user: %v %v", u, err)
+	}
+	if u, _ := login(ever, nil, nil); u.WireId() != first.WireId() {
+		t.Errorf("expected linked identity to log in the same user but got %d", u.WireId())
+	}
+	if u, _ := login(&EvernoteConnection{EvernoteId: 43}, again, r); u.WireId() == first.WireId() {
+		t.Errorf("a link ticket should only be usable once")
+	}
+	sup.users = sup.users[:1]
+	if code, _ := link(again, "X-Requested-With", "x", "Origin", "http://example.com"); code != http.StatusNoContent {
+		t.Errorf("expected our own origin to be allowed: %d", code)
+	}
+
+	other, _ := login(bob, nil, nil)
+	if other.WireId() == first.WireId() {
+		t.Fatalf("new identity should be a new user")
+	}
+	if _, err := login(bob, again, linkFor(again)); err != IDENTITY_IN_USE {
+		t.Errorf("expected merge to be refused but got %v", err)
+	}
+	mgr.Merge = MERGE_MOVE_IDENTITY
+	if _, err := login(bob, again, linkFor(again)); err != LAST_IDENTITY {
+		t.Errorf("expected moving bob's only identity to be refused but got %v", err)
+	}
+	mgr.Merge = MERGE_USERS
+	if u, err := login(bob, again, linkFor(again)); err != nil || u.WireId() != first.WireId() {
+		t.Errorf("expected merge into logged in user: %v %v", u, err)
+	}
+	if len(sup.users) != 1 {
+		t.Errorf("merged user should be gone, have %d users", len(sup.users))
+	}
+
+	//the resource shows the three identities and won't remove the last
+	res := mgr.IdentityResource()
+	pb, _ := NewSimplePBundle(httptest.NewRequest("GET", "/rest/identitywire", nil), again)
+	l, _ := res.Index(pb)
+	list := l.([]*IdentityWire)
+	if len(list) != 3 || list[0].Provider != "local" || list[1].Provider != "evernote" || list[2].Subject != "bob" {
+		t.Fatalf("bad identity list: %+v", list)
+	}
+	for i, w := range list {
+		_, err := res.Delete(w.Id, pb)
+		if i < 2 && err != nil {
+			t.Errorf("unable to unlink %s: %s", w.Provider, err)
+		}
+		if i == 2 {
+			if e, ok := err.(*Error); !ok || e.StatusCode != http.StatusConflict {
+				t.Errorf("should not be able to unlink the last identity: %v", err)
+			}
+		}
+	}
+	if _, err := res.Delete(Id(999), pb); err == nil {
+		t.Errorf("expected error unlinking unknown identity")
+	}
+}
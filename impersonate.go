@@ -0,0 +1,241 @@
+package seven5
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	//IMPERSONATION_TTL is how long an impersonation lasts if BasicManager.ImpersonationTTL
+	//is not set.
+	IMPERSONATION_TTL = 30 * time.Minute
+	//IMPERSONATION_HEADER is added to every REST response made while impersonating.  Its
+	//value is the id of the user being impersonated.
+	IMPERSONATION_HEADER = "X-Seven5-Impersonating"
+)
+
+var (
+	NOT_STAFF              = errors.New("Only staff can impersonate other users")
+	IMPERSONATE_PRIVILEGED = errors.New("Staff and admin users can't be impersonated")
+	ALREADY_IMPERSONATING  = errors.New("Already impersonating a user")
+	NOT_IMPERSONATING      = errors.New("Not impersonating anyone")
+)
+
+//ImpersonationSession is what BasicManager.Find returns for the session of a staff member
+//who is acting as another user.  It is the target user as far as the rest of the system is
+//concerned (Allow checks, UserKey, roles) but keeps the session id of the Actor, so the
+//Actor's cookie continues to work.  Use ImpersonatedUser to get the target itself.
+type ImpersonationSession struct {
+	BasicUser
+	Actor   BasicUser
+	Expires time.Time
+	actor   Session
+}
+
+func (self *ImpersonationSession) SessionId() string {
+	return self.actor.SessionId()
+}
+
+//ImpersonatedUser returns the target of an impersonation, or u if u is not impersonating.
+//BasicUserSupport methods should be passed the result rather than the session.
+func ImpersonatedUser(u BasicUser) BasicUser {
+	if imp, ok := u.(*ImpersonationSession); ok {
+		return imp.BasicUser
+	}
+	return u
+}
+
+//ActingUser returns the user really making a request: the Actor of an impersonation, or
+//else the user of the session.  It returns nil if the session is not a BasicUser.
+func ActingUser(s Session) BasicUser {
+	s = UnwrapSession(s)
+	if imp, ok := s.(*ImpersonationSession); ok {
+		return imp.Actor
+	}
+	u, _ := s.(BasicUser)
+	return u
+}
+
+//privilegedUser is true for staff and admin users, according to roles if it is not nil and
+//otherwise according to sup.
+func privilegedUser(sup BasicUserSupport, roles RoleStore, u BasicUser) bool {
+	u = ImpersonatedUser(u)
+	if roles == nil {
+		return sup.IsStaff(u) || sup.IsAdmin(u)
+	}
+	key := strconv.FormatInt(int64(u.WireId()), 10)
+	return hasRole(roles, key, ROLE_ADMIN) || hasRole(roles, key, ROLE_STAFF)
+}
+
+//Impersonate makes the session with the given id act as the user target until the
+//ImpersonationTTL passes or StopImpersonating is called.  The session must belong to a
+//staff or admin user and the target must not be one.
+func (self *BasicManager) Impersonate(sessionId string, target Id) (*ImpersonationSession, error) {
+	s, err := self.Find(sessionId)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := s.(*ImpersonationSession); ok {
+		return nil, ALREADY_IMPERSONATING
+	}
+	actor, ok := s.(BasicUser)
+	if !ok || !privilegedUser(self.Sup, self.Roles, actor) {
+		return nil, NOT_STAFF
+	}
+	u := self.knownUser(target)
+	if u == nil {
+		return nil, BAD_ID
+	}
+	if privilegedUser(self.Sup, self.Roles, u) {
+		return nil, IMPERSONATE_PRIVILEGED
+	}
+	ttl := self.ImpersonationTTL
+	if ttl == 0 {
+		ttl = IMPERSONATION_TTL
+	}
+	imp := &ImpersonationSession{BasicUser: u, Actor: actor, Expires: time.Now().Add(ttl), actor: s}
+	self.lock.Lock()
+	self.acting[sessionId] = imp
+	self.lock.Unlock()
+	self.auditImpersonation(imp, "IMPERSONATE")
+	return imp, nil
+}
+
+//StopImpersonating returns the session with the given id to its own user.
+func (self *BasicManager) StopImpersonating(sessionId string) error {
+	self.lock.Lock()
+	imp, ok := self.acting[sessionId]
+	delete(self.acting, sessionId)
+	self.lock.Unlock()
+	if !ok {
+		return NOT_IMPERSONATING
+	}
+	self.auditImpersonation(imp, "UNIMPERSONATE")
+	return nil
+}
+
+//impersonating returns the impersonation of the session, if there is one that has not
+//expired.
+func (self *BasicManager) impersonating(sessionId string) *ImpersonationSession {
+	self.lock.Lock()
+	imp, ok := self.acting[sessionId]
+	if ok && time.Now().After(imp.Expires) {
+		delete(self.acting, sessionId)
+		self.lock.Unlock()
+		self.auditImpersonation(imp, "UNIMPERSONATE")
+		return nil
+	}
+	self.lock.Unlock()
+	return imp
+}
+
+//auditImpersonation records the start or end of an impersonation if there is an Audit sink.
+//The entry is for the resource "impersonation" and the id of the target.
+func (self *BasicManager) auditImpersonation(imp *ImpersonationSession, method string) {
+	if self.Audit == nil {
+		return
+	}
+	e := &AuditEntry{
+		Time:       time.Now(),
+		User:       UserKey(imp),
+		Actor:      UserKey(imp.actor),
+		Session:    sessionDigest(imp),
+		Resource:   "impersonation",
+		ResourceId: imp.WireId(),
+		Method:     method,
+	}
+	if err := self.Audit.Record(e); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to record %s of %d: %s\n", method, imp.WireId(), err)
+	}
+}
+
+//ImpersonationWire is the wire type of the impersonation resource.  The Id is the id of the
+//user being impersonated.
+type ImpersonationWire struct {
+	Id      Id
+	Actor   Id
+	Expires DateTime
+}
+
+//ImpersonationResource lets staff start (POST with the Id of the user), check (GET) and stop
+//(DELETE) impersonating a user.  Its Allow methods are based on the ActingUser, not the
+//user being impersonated.  Map it with ResourceSeparate:
+//
+//	disp.ResourceSeparate("ImpersonationWire", &ImpersonationWire{}, res, nil, res, nil, res)
+type ImpersonationResource struct {
+	Manager *BasicManager
+}
+
+//ImpersonationResource returns a resource for starting and stopping impersonations.
+func (self *BasicManager) ImpersonationResource() *ImpersonationResource {
+	return &ImpersonationResource{Manager: self}
+}
+
+func (self *ImpersonationResource) staff(bundle PBundle) bool {
+	u := ActingUser(bundle.Session())
+	return u != nil && privilegedUser(self.Manager.Sup, self.Manager.Roles, u)
+}
+
+func (self *ImpersonationResource) AllowRead(bundle PBundle) bool {
+	return self.staff(bundle)
+}
+
+func (self *ImpersonationResource) AllowWrite(bundle PBundle) bool {
+	return self.staff(bundle)
+}
+
+func (self *ImpersonationResource) Allow(id Id, method string, bundle PBundle) bool {
+	return method == "DELETE" && self.staff(bundle)
+}
+
+//Index returns a list with the current impersonation in it, or an empty list.
+func (self *ImpersonationResource) Index(bundle PBundle) (interface{}, error) {
+	result := []*ImpersonationWire{}
+	if imp, ok := UnwrapSession(bundle.Session()).(*ImpersonationSession); ok {
+		result = append(result, impersonationWire(imp))
+	}
+	return result, nil
+}
+
+func (self *ImpersonationResource) Post(i interface{}, bundle PBundle) (interface{}, error) {
+	w, ok := i.(*ImpersonationWire)
+	if !ok {
+		return nil, HTTPError(http.StatusBadRequest, "expected the id of the user to impersonate")
+	}
+	imp, err := self.Manager.Impersonate(UnwrapSession(bundle.Session()).SessionId(), w.Id)
+	switch err {
+	case nil:
+		return impersonationWire(imp), nil
+	case BAD_ID:
+		return nil, HTTPError(http.StatusNotFound, err.Error())
+	case ALREADY_IMPERSONATING:
+		return nil, HTTPError(http.StatusConflict, err.Error())
+	case NOT_STAFF, IMPERSONATE_PRIVILEGED:
+		return nil, HTTPError(http.StatusForbidden, err.Error())
+	}
+	return nil, err
+}
+
+//Delete stops the current impersonation; the id is ignored.
+func (self *ImpersonationResource) Delete(id Id, bundle PBundle) (interface{}, error) {
+	imp, ok := UnwrapSession(bundle.Session()).(*ImpersonationSession)
+	if !ok {
+		return nil, HTTPError(http.StatusNotFound, NOT_IMPERSONATING.Error())
+	}
+	if err := self.Manager.StopImpersonating(imp.SessionId()); err != nil {
+		return nil, HTTPError(http.StatusNotFound, err.Error())
+	}
+	return impersonationWire(imp), nil
+}
+
+func impersonationWire(imp *ImpersonationSession) *ImpersonationWire {
+	return &ImpersonationWire{
+		Id:      imp.WireId(),
+		Actor:   imp.Actor.WireId(),
+		Expires: DateTime(float64(imp.Expires.UnixNano()) / float64(time.Second)),
+	}
+}
@@ -0,0 +1,114 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type LinkedWire struct {
+	Id Id
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestImpersonation(t *testing.T) {
+	sup := &linkedSupport{}
+	mgr := NewBasicManager(sup)
+	mgr.Roles = NewSimpleRoleStore()
+	log := NewSimpleAuditLog()
+	mgr.Audit = log
+	staff, _ := mgr.Generate(&PasswordConnection{Username: "staff"}, "", nil, "", "")
+	alice, _ := mgr.Generate(&PasswordConnection{Username: "alice"}, "", nil, "", "")
+	bob, _ := mgr.Generate(&PasswordConnection{Username: "bob"}, "", nil, "", "")
+	mgr.Roles.Assign(UserKey(staff), ROLE_STAFF)
+	staffId := staff.(BasicUser).WireId()
+	aliceId := alice.(BasicUser).WireId()
+	bobId := bob.(BasicUser).WireId()
+
+	disp := NewBaseDispatcher(appName, mgr)
+	disp.Audit = log
+	disp.Resource("LinkedWire", &LinkedWire{}, mgr.UserResource())
+	res := mgr.ImpersonationResource()
+	disp.ResourceSeparate("ImpersonationWire", &ImpersonationWire{}, res, nil, res, nil, res)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	do := func(method string, path string, body string, s Session) *http.Response {
+		return sendRequest(t, srv, method, path, body, sessionCookie(disp, s))
+	}
+	start := func(s Session, target Id) int {
+		return do("POST", "/rest/impersonationwire", fmt.Sprintf(`{"Id":%d}`, target), s).StatusCode
+	}
+	user := func(id Id) string {
+		return fmt.Sprintf("/rest/linkedwire/%d", id)
+	}
+
+	if start(alice, bobId) != http.StatusForbidden {
+		t.Errorf("expected non-staff to be refused")
+	}
+	if start(staff, staffId) != http.StatusForbidden {
+		t.Errorf("expected staff not to be able to impersonate staff")
+	}
+	if resp := do("GET", user(bobId), "", staff); resp.StatusCode != http.StatusOK || resp.Header.Get(IMPERSONATION_HEADER) != "" {
+		t.Errorf("staff should be able to see bob before impersonating: %s", resp.Status)
+	}
+	if start(staff, aliceId) != http.StatusCreated {
+		t.Fatalf("unable to start impersonation")
+	}
+	if start(staff, bobId) != http.StatusConflict {
+		t.Errorf("expected nested impersonation to be refused")
+	}
+
+	//now the staff member's requests are checked as alice's
+	resp := do("GET", user(aliceId), "", staff)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(IMPERSONATION_HEADER) != fmt.Sprint(aliceId) {
+		t.Errorf("expected to see alice as alice with header: %s %v", resp.Status, resp.Header)
+	}
+	if resp := do("GET", user(bobId), "", staff); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("alice can't see bob, so neither can her impersonator: %s", resp.Status)
+	}
+	if resp := do("PUT", user(aliceId), `{"Id":1}`, staff); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected impersonator to be able to update alice: %s", resp.Status)
+	}
+	if resp := do("DELETE", "/rest/impersonationwire/0", "", staff); resp.StatusCode != http.StatusOK {
+		t.Errorf("unable to stop impersonating: %s", resp.Status)
+	}
+	if resp := do("GET", user(bobId), "", staff); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected staff to be back to themselves: %s", resp.Status)
+	}
+
+	entries, _ := log.Query(&AuditFilter{})
+	methods := []string{}
+	for _, e := range entries {
+		methods = append(methods, e.Method)
+		if e.Method != "POST" && (e.Actor != UserKey(staff) || e.User != UserKey(alice)) {
+			t.Errorf("expected %s to be by staff as alice: %+v", e.Method, e)
+		}
+	}
+	if strings.Join(methods, " ") != "IMPERSONATE POST PUT UNIMPERSONATE DELETE" {
+		t.Errorf("unexpected audit entries: %v", methods)
+	}
+	pb, _ := NewSimplePBundle(httptest.NewRequest("GET", "/rest/auditwire?actor="+UserKey(staff), nil), staff)
+	l, err := NewAuditResource(log, nil).Index(pb)
+	if err != nil {
+		t.Fatalf("unable to query audit log: %s", err)
+	}
+	if list := l.([]*AuditWire); len(list) != 4 || list[0].Actor != String255(UserKey(staff)) || list[0].Session == "" {
+		t.Errorf("expected the impersonated changes by actor: %+v", list)
+	}
+
+	//impersonations run out
+	mgr.ImpersonationTTL = time.Millisecond
+	if _, err := mgr.Impersonate(staff.SessionId(), bobId); err != nil {
+		t.Fatalf("unable to impersonate: %s", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if s, _ := mgr.Find(staff.SessionId()); s != staff {
+		t.Errorf("expected impersonation to have expired")
+	}
+}
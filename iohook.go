@@ -18,7 +18,7 @@ import (
 type IOHook interface {
 	SendHook(d *restObj, w http.ResponseWriter, pb PBundle, i interface{}, location string)
 	BundleHook(w http.ResponseWriter, r *http.Request, sm SessionManager) (PBundle, error)
-	BodyHook(r *http.Request, obj *restObj) (interface{}, error) 
+	BodyHook(r *http.Request, obj *restObj, pb PBundle) (interface{}, error) 
 	CookieMapper() CookieMapper
 }
 
@@ -27,6 +27,11 @@ type RawIOHook struct {
 	Dec Decoder
 	Enc Encoder
 	CookieMap CookieMapper
+	//Bearer, if not nil, resolves "Authorization: Bearer" tokens to sessions
+	Bearer BearerResolver
+	//Roles decides which restricted fields of wire types a request may read and write.
+	//If nil, BundleRoles is used without a RoleStore.
+	Roles RoleSource
 }
 
 //CookieMapper is exposed because other parts of the system may need access to the 
@@ -48,12 +53,16 @@ func NewRawIOHook(d Decoder, e Encoder, c CookieMapper) *RawIOHook{
 //BodyHook is called to create a wire object of the appopriate type and fill in the values
 //in that object from the request body.  BodyHook calls the decoder provided at creation time
 //take the bytes provided by the body and initialize the object that is ultimately returned.
-func (self *RawIOHook) BodyHook(r *http.Request, obj *restObj) (interface{}, error) {
+//If the body sets a field that the roles of the request may not write, BodyHook returns
+//a 403 *Error.  The dispatcher sends an *Error from BodyHook only after the request has
+//been authorized; any other error is sent at once as a 400.
+func (self *RawIOHook) BodyHook(r *http.Request, obj *restObj, pb PBundle) (interface{}, error) {
 	limitedData := make([]byte, MAX_FORM_SIZE)
 	curr := 0
 	gotEof := false
 	for curr < len(limitedData) {
 		n, err := r.Body.Read(limitedData[curr:])
+		curr += n
 		if err != nil && err == io.EOF {
 			gotEof = true
 			break
@@ -61,7 +70,6 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restObj) (interface{}, err
 		if err != nil {
 			return nil, err
 		}
-		curr += n
 	}
 	//if curr==0 then we are done because there is no body
 	if curr == 0 {
@@ -75,6 +83,20 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restObj) (interface{}, err
 	if err := self.Dec.Decode(limitedData[:curr], wireObj.Interface()); err != nil {
 		return nil, err
 	}
+	if len(obj.fields) > 0 || obj.desc != nil {
+		fields := make(map[string]interface{})
+		if err := self.Dec.Decode(limitedData[:curr], &fields); err != nil {
+			return nil, err
+		}
+		if obj.desc != nil {
+			if err := checkWire(obj.desc, fields, obj.name, obj.nulls); err != nil {
+				return nil, err
+			}
+		}
+		if err := checkWritable(obj.fields, self.roles(pb), fields); err != nil {
+			return nil, err
+		}
+	}
 
 	return wireObj.Interface(), nil
 }
@@ -84,7 +106,24 @@ func (self *RawIOHook) BodyHook(r *http.Request, obj *restObj) (interface{}, err
 //using cookies and sessions to compute the bundle.  Note that the ResponseWriter is passed
 //here but the BundleHook _must_ be careful to not force it out the server--it should only
 //add headers.
+//A session attached to the request with WithSession is used as is.  Otherwise, if the
+//request has a bearer token and a BearerResolver is configured, the token decides the
+//session (and scopes) and the cookie is ignored.  A bad token results in BAD_BEARER_TOKEN.
+//If the session is an ImpersonationSession, the IMPERSONATION_HEADER is added to the response.
 func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm SessionManager) (PBundle, error) {
+	if s := RequestSession(r); s != nil {
+		return NewSimplePBundle(r, s)
+	}
+	if tok, ok := bearerToken(r); ok && self.Bearer != nil {
+		session, scopes, err := self.Bearer.ResolveBearer(tok)
+		if err != nil {
+			return nil, err
+		}
+		if scopes == nil {
+			return NewSimplePBundle(r, session)
+		}
+		return NewScopedPBundle(r, session, scopes)
+	}
 	var session Session
 	if self.CookieMap != nil {
 		var err error
@@ -103,6 +142,9 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 			}
 		}
 	}
+	if imp, ok := UnwrapSession(session).(*ImpersonationSession); ok {
+		w.Header().Set(IMPERSONATION_HEADER, fmt.Sprint(imp.WireId()))
+	}
 	pb, err := NewSimplePBundle(r, session)
 	if err != nil {
 		return nil, err
@@ -116,12 +158,18 @@ func (self *RawIOHook) BundleHook(w http.ResponseWriter, r *http.Request, sm Ses
 //parameter is provided, then the response code is "Created" otherwise "OK" is returned.
 //SendHook calls the encoder for the encoding of the object into a sequence of bytes for transmission.
 //If the pb is not null, then the SendHook should examine it for outgoing headers, trailers, and
-//transmit them.
+//transmit them.  Fields of the object that the roles of the request may not read are
+//not sent.
 func (self *RawIOHook) SendHook(d *restObj, w http.ResponseWriter, pb PBundle, i interface{}, location string) {
 	if err := self.verifyReturnType(d, i); err != nil {
 		http.Error(w, fmt.Sprintf("%s", err), http.StatusExpectationFailed)
 		return
 	}
+	if len(d.fields) > 0 && i != nil {
+		if roles := self.roles(pb); hidesAny(d.fields, roles) {
+			i = withoutFields(i, d.fields, roles)
+		}
+	}
 	encoded, err := self.Enc.Encode(i, true)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("unable to encode: %s", err), http.StatusInternalServerError)
@@ -143,6 +191,13 @@ func (self *RawIOHook) SendHook(d *restObj, w http.ResponseWriter, pb PBundle, i
 	}
 }
 
+func (self *RawIOHook) roles(pb PBundle) []string {
+	if self.Roles != nil {
+		return self.Roles.Roles(pb)
+	}
+	return BundleRoles(pb, nil)
+}
+
 func (self *RawIOHook) verifyReturnType(obj *restObj, w interface{}) error {
 	if w == nil {
 		return nil
@@ -0,0 +1,153 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//JSON_SCHEMA_DIALECT is the version of JSON Schema used by WireTypeSchema.
+const JSON_SCHEMA_DIALECT = "https://json-schema.org/draft/2020-12/schema"
+
+//Schema is a JSON Schema describing a wire type or one of its fields.  Only the keywords that
+//seven5 needs are present.  It is used both on its own (see WireTypeSchema) and inside
+//OpenAPI documents.
+type Schema struct {
+	Dialect     string             `json:"$schema,omitempty"`
+	Id          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Ref         string             `json:"$ref,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Minimum     *int64             `json:"minimum,omitempty"`
+	MaxLength   *int               `json:"maxLength,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Defs        map[string]*Schema `json:"$defs,omitempty"`
+	AnyOf       []*Schema          `json:"anyOf,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	//AdditionalProperties is the schema of the values of a map
+	AdditionalProperties *Schema `json:"additionalProperties,omitempty"`
+}
+
+//fieldSchema returns the schema of a field.  Structs are referred to by refPrefix followed by
+//their StructName; structSchema gives the definition.
+func fieldSchema(f *FieldDescription, refPrefix string) *Schema {
+	if f.Optional {
+		basic := *f
+		basic.Optional = false
+		return &Schema{AnyOf: []*Schema{fieldSchema(&basic, refPrefix), &Schema{Type: "null"}}}
+	}
+	if f.EnumName != "" {
+		return &Schema{Type: "string", Title: f.EnumName, Enum: f.Enum}
+	}
+	switch f.TypeName {
+	case "Id":
+		zero := int64(0)
+		return &Schema{Type: "integer", Format: "int64", Minimum: &zero}
+	case "Integer":
+		return &Schema{Type: "integer", Format: "int64"}
+	case "Floating":
+		return &Schema{Type: "number", Format: "double"}
+	case "String255":
+		max := 255
+		return &Schema{Type: "string", MaxLength: &max, Description: "at most 255 bytes when encoded as UTF-8"}
+	case "Textblob":
+		return &Schema{Type: "string"}
+	case "Boolean":
+		return &Schema{Type: "boolean"}
+	case "DateTime":
+		return &Schema{Type: "number", Format: "double", Description: "seconds since the unix epoch"}
+	}
+	if f.Array != nil {
+		return &Schema{Type: "array", Items: fieldSchema(f.Array, refPrefix)}
+	}
+	if f.Map != nil {
+		return &Schema{Type: "object", AdditionalProperties: fieldSchema(f.Map, refPrefix)}
+	}
+	if f.StructName != "" {
+		return &Schema{Ref: refPrefix + f.StructName}
+	}
+	panic(fmt.Sprintf("unable to convert type %s to a schema!", f.TypeName))
+}
+
+//structSchema returns the definition of a struct.  All the fields except the optional ones
+//are required, since the encoder always sends them.
+func structSchema(f *FieldDescription, refPrefix string) *Schema {
+	result := &Schema{Type: "object", Properties: make(map[string]*Schema), Required: []string{}}
+	for _, c := range f.Struct {
+		result.Properties[c.Name] = fieldSchema(c, refPrefix)
+		if !c.Optional {
+			result.Required = append(result.Required, c.Name)
+		}
+	}
+	return result
+}
+
+//WireTypeSchema returns a complete JSON Schema document for the wire type f.  Nested
+//structs are defined in $defs.
+func WireTypeSchema(f *FieldDescription) *Schema {
+	const ref = "#/$defs/"
+	result := structSchema(f, ref)
+	result.Dialect = JSON_SCHEMA_DIALECT
+	result.Title = f.Name
+	for _, s := range collectStructs(f) {
+		if s == f {
+			continue
+		}
+		if result.Defs == nil {
+			result.Defs = make(map[string]*Schema)
+		}
+		if _, ok := result.Defs[s.StructName]; !ok {
+			result.Defs[s.StructName] = structSchema(s, ref)
+		}
+	}
+	return result
+}
+
+//JSONSchemaContent adds an http handler at urlPath, which should end in a /, that serves the
+//JSON Schema of each type in holder at urlPath followed by the lower case name of the type.
+//The urlPath itself serves a json object with the location of every schema in "resources".
+func JSONSchemaContent(mux *ServeMux, holder TypeHolder, urlPath string) {
+	mux.HandleFunc(urlPath, jsonSchemaFunc(holder, urlPath))
+}
+
+//jsonSchemaFunc returns the handler used by JSONSchemaContent.
+func jsonSchemaFunc(holder TypeHolder, urlPath string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, urlPath), ".json")
+		var result interface{}
+		if name == "" {
+			index := make(map[string]string)
+			for _, f := range holder.All() {
+				index[f.Name] = urlPath + strings.ToLower(f.Name)
+			}
+			result = map[string]interface{}{"resources": index}
+		}
+		for _, f := range holder.All() {
+			if strings.ToLower(f.Name) == strings.ToLower(name) {
+				s := WireTypeSchema(f)
+				s.Id = urlPath + strings.ToLower(f.Name)
+				result = s
+			}
+		}
+		if result == nil {
+			http.NotFound(w, r)
+			return
+		}
+		if name == "" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "application/schema+json")
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write JSON schema to the client: %s\n", err)
+		}
+	}
+}
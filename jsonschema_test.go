@@ -0,0 +1,62 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+type Deep struct {
+	Sched  *ScheduleWire
+	Matrix [][]Floating
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestWireTypeSchema(t *testing.T) {
+	s := WireTypeSchema(WalkWireType("Deep", reflect.TypeOf(&Deep{})))
+	if s.Dialect != JSON_SCHEMA_DIALECT || s.Title != "Deep" || s.Type != "object" || len(s.Required) != 2 {
+		t.Errorf("bad top level: %+v", s)
+	}
+	if s.Properties["Sched"].Ref != "#/$defs/ScheduleWire" || s.Defs["ScheduleWire"] == nil || s.Defs["Nested"] == nil {
+		t.Errorf("expected nested structs in $defs: %+v", s.Defs)
+	}
+	if m := s.Properties["Matrix"]; m.Type != "array" || m.Items.Type != "array" || m.Items.Items.Format != "double" {
+		t.Errorf("bad nested array: %+v", m)
+	}
+	sched := s.Defs["ScheduleWire"]
+	if p := sched.Properties["Title"]; p.Type != "string" || *p.MaxLength != 255 || p.Description == "" {
+		t.Errorf("expected length hint on String255: %+v", p)
+	}
+	if p := sched.Properties["Count"]; p.Type != "integer" || p.Format != "int64" {
+		t.Errorf("bad integer: %+v", p)
+	}
+	if p := sched.Properties["Attendees"]; p.Items.Ref != "#/$defs/Nested" {
+		t.Errorf("expected refs within $defs to use $defs: %+v", p.Items)
+	}
+
+	holder := NewSimpleTypeHolder()
+	holder.Add("Deep", &Deep{})
+	holder.Add("NoteWire", &NoteWire{})
+	mux := NewServeMux()
+	JSONSchemaContent(mux, holder, "/describe/schema/")
+	get := func(path string) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var result map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return w.Code, result
+	}
+	code, index := get("/describe/schema/")
+	if r, ok := index["resources"].(map[string]interface{}); code != http.StatusOK || !ok || r["NoteWire"] != "/describe/schema/notewire" {
+		t.Errorf("bad index: %d %v", code, index)
+	}
+	code, note := get("/describe/schema/notewire.json")
+	if code != http.StatusOK || note["$schema"] != JSON_SCHEMA_DIALECT || note["$id"] != "/describe/schema/notewire" {
+		t.Errorf("bad schema: %d %v", code, note)
+	}
+	if code, _ := get("/describe/schema/nosuch"); code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown type but got %d", code)
+	}
+}
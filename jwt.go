@@ -0,0 +1,280 @@
+package seven5
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+var (
+	JWT_MALFORMED     = errors.New("JWT is not three base64url encoded parts")
+	JWT_BAD_SIGNATURE = errors.New("JWT signature does not verify")
+	JWT_UNKNOWN_KEY   = errors.New("JWT is signed with a key we don't know")
+)
+
+//jwtHeader is the "JOSE" header of a JWT.  We only care about the fields needed to pick a key.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+//parsedJWT is a JWT split into its pieces but not yet verified.  The signing input is the
+//original text of the first two parts, which is what the signature covers.
+type parsedJWT struct {
+	header       *jwtHeader
+	payload      []byte
+	signingInput string
+	signature    []byte
+}
+
+//parseJWT splits a compact-form JWT and decodes the header.  It does not check the signature.
+func parseJWT(token string) (*parsedJWT, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, JWT_MALFORMED
+	}
+	h, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, JWT_MALFORMED
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, JWT_MALFORMED
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, JWT_MALFORMED
+	}
+	header := &jwtHeader{}
+	if err := json.Unmarshal(h, header); err != nil {
+		return nil, JWT_MALFORMED
+	}
+	return &parsedJWT{
+		header:       header,
+		payload:      payload,
+		signingInput: parts[0] + "." + parts[1],
+		signature:    sig,
+	}, nil
+}
+
+//verifySignature checks the signature of a parsed token with a public key (or, for HS256,
+//the shared secret as a []byte).  The algorithm named in the header must agree with the
+//type of key; "none" is never accepted.
+func (self *parsedJWT) verifySignature(key crypto.PublicKey) error {
+	switch k := key.(type) {
+	case []byte:
+		if self.header.Alg != "HS256" {
+			break
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(self.signingInput))
+		if !hmac.Equal(mac.Sum(nil), self.signature) {
+			return JWT_BAD_SIGNATURE
+		}
+		return nil
+	case ed25519.PublicKey:
+		if self.header.Alg != "EdDSA" {
+			break
+		}
+		if !ed25519.Verify(k, []byte(self.signingInput), self.signature) {
+			return JWT_BAD_SIGNATURE
+		}
+		return nil
+	case *rsa.PublicKey:
+		if self.header.Alg != "RS256" {
+			break
+		}
+		sum := sha256.Sum256([]byte(self.signingInput))
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], self.signature); err != nil {
+			return JWT_BAD_SIGNATURE
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if self.header.Alg != "ES256" || len(self.signature) != 64 {
+			break
+		}
+		sum := sha256.Sum256([]byte(self.signingInput))
+		r := new(big.Int).SetBytes(self.signature[:32])
+		s := new(big.Int).SetBytes(self.signature[32:])
+		if !ecdsa.Verify(k, sum[:], r, s) {
+			return JWT_BAD_SIGNATURE
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("JWT algorithm %s does not match key of type %T", self.header.Alg, key))
+}
+
+//JSONWebKey is a single public key as published in a JWKS document (RFC 7517).  Only the
+//fields needed for RSA and elliptic curve signature keys are understood.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+//JSONWebKeySet is the document found at an OpenID provider's jwks_uri.
+type JSONWebKeySet struct {
+	Keys []*JSONWebKey `json:"keys"`
+}
+
+//PublicKey converts the JSON form of the key to an *rsa.PublicKey, *ecdsa.PublicKey or
+//ed25519.PublicKey.
+func (self *JSONWebKey) PublicKey() (crypto.PublicKey, error) {
+	switch self.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(self.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(self.E)
+		if err != nil {
+			return nil, err
+		}
+		exp := new(big.Int).SetBytes(e)
+		if !exp.IsInt64() || exp.Int64() > 1<<31 {
+			return nil, errors.New("RSA exponent in JWK is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}, nil
+	case "EC":
+		if self.Crv != "P-256" {
+			return nil, errors.New(fmt.Sprintf("unsupported elliptic curve in JWK: %s", self.Crv))
+		}
+		x, err := base64.RawURLEncoding.DecodeString(self.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(self.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		x, err := base64.RawURLEncoding.DecodeString(self.X)
+		if err != nil {
+			return nil, err
+		}
+		if self.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New(fmt.Sprintf("unsupported OKP key in JWK: %s", self.Crv))
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unsupported key type in JWK: %s", self.Kty))
+}
+
+//VerifyJWT checks the signature of token with key (see verifySignature for the kinds of key
+//allowed) and unmarshals its claims into claims.  It checks nothing else.
+func VerifyJWT(token string, key crypto.PublicKey, claims interface{}) error {
+	parsed, err := parseJWT(token)
+	if err != nil {
+		return err
+	}
+	if err := parsed.verifySignature(key); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(parsed.payload, claims); err != nil {
+		return JWT_MALFORMED
+	}
+	return nil
+}
+
+//JWTSigningKey is a key used to sign JWTs that we issue.  Create one with NewHS256Key,
+//NewRS256Key or NewEdDSAKey.
+type JWTSigningKey struct {
+	Alg string
+	Kid string
+	key interface{}
+}
+
+//NewHS256Key returns a key that signs with HMAC-SHA256.  Anyone that verifies these tokens
+//must have the secret, so prefer an asymmetric key if the verifiers are not trusted.
+func NewHS256Key(secret []byte, kid string) *JWTSigningKey {
+	return &JWTSigningKey{Alg: "HS256", Kid: kid, key: secret}
+}
+
+//NewRS256Key returns a key that signs with RSA PKCS #1 v1.5 and SHA256.
+func NewRS256Key(key *rsa.PrivateKey, kid string) *JWTSigningKey {
+	return &JWTSigningKey{Alg: "RS256", Kid: kid, key: key}
+}
+
+//NewEdDSAKey returns a key that signs with Ed25519.
+func NewEdDSAKey(key ed25519.PrivateKey, kid string) *JWTSigningKey {
+	return &JWTSigningKey{Alg: "EdDSA", Kid: kid, key: key}
+}
+
+//Sign returns the compact form of a JWT with the claims given.
+func (self *JWTSigningKey) Sign(claims interface{}) (string, error) {
+	h, err := json.Marshal(&jwtHeader{Alg: self.Alg, Kid: self.Kid, Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	var sig []byte
+	switch k := self.key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(input))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			return "", err
+		}
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(k, []byte(input))
+	default:
+		return "", errors.New(fmt.Sprintf("can't sign with key of type %T", self.key))
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+//VerificationKey returns the key to pass to VerifyJWT for tokens signed by this key.
+func (self *JWTSigningKey) VerificationKey() crypto.PublicKey {
+	switch k := self.key.(type) {
+	case *rsa.PrivateKey:
+		return &k.PublicKey
+	case ed25519.PrivateKey:
+		return k.Public()
+	}
+	return self.key
+}
+
+//JWK returns the public half of this key as a JSONWebKey, or nil for HS256 since the
+//secret must not be published.
+func (self *JWTSigningKey) JWK() *JSONWebKey {
+	switch k := self.key.(type) {
+	case *rsa.PrivateKey:
+		return &JSONWebKey{
+			Kty: "RSA", Kid: self.Kid, Use: "sig", Alg: self.Alg,
+			N: base64.RawURLEncoding.EncodeToString(k.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(k.E)).Bytes()),
+		}
+	case ed25519.PrivateKey:
+		return &JSONWebKey{
+			Kty: "OKP", Kid: self.Kid, Use: "sig", Alg: self.Alg, Crv: "Ed25519",
+			X: base64.RawURLEncoding.EncodeToString(k.Public().(ed25519.PublicKey)),
+		}
+	}
+	return nil
+}
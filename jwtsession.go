@@ -0,0 +1,404 @@
+package seven5
+
+import (
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	JWT_ACCESS_TTL  = 5 * time.Minute
+	JWT_REFRESH_TTL = 30 * 24 * time.Hour
+	JWT_CLOCK_SKEW  = 30 * time.Second
+)
+
+var (
+	JWT_EXPIRED       = errors.New("JWT has expired")
+	JWT_REVOKED       = errors.New("JWT has been revoked")
+	JWT_WRONG_ISSUER  = errors.New("JWT was issued by someone else")
+	BAD_REFRESH_TOKEN = errors.New("Refresh token is not valid (or it has expired)")
+)
+
+//RoleHolder can be implemented by a Session to name the roles of the user.  The roles are
+//copied into JWT access tokens so that other services can make decisions without asking
+//us about the user.
+type RoleHolder interface {
+	Roles() []string
+}
+
+//AccessClaims are the claims in the access tokens issued by a JWTSessionManager.  The
+//subject is the id of the session the token stands for.
+type AccessClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Expires  int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Id       string   `json:"jti"`
+	Roles    []string `json:"roles,omitempty"`
+}
+
+//VerifyAccessToken checks the signature, issuer and expiration of an access token issued
+//by a JWTSessionManager and returns its claims.  This is meant for other services that
+//accept our tokens; key comes from JWTSigningKey.VerificationKey or from our JWKS.  It
+//can't know about revoked tokens, which is why access tokens are short-lived.
+func VerifyAccessToken(token string, key crypto.PublicKey, issuer string) (*AccessClaims, error) {
+	claims := &AccessClaims{}
+	if err := VerifyJWT(token, key, claims); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != issuer {
+		return nil, JWT_WRONG_ISSUER
+	}
+	if time.Now().Add(-JWT_CLOCK_SKEW).Unix() > claims.Expires {
+		return nil, JWT_EXPIRED
+	}
+	return claims, nil
+}
+
+//JWTSession is the Session returned by a JWTSessionManager.  It wraps the session created
+//by the underlying SessionManager, but its SessionId is the signed access token so it is
+//what CookieMappers put in the cookie.
+type JWTSession struct {
+	Session
+	Claims  *AccessClaims
+	token   string
+	refresh string
+}
+
+//SessionId returns the access token.
+func (self *JWTSession) SessionId() string {
+	return self.token
+}
+
+//RefreshToken returns the refresh token issued with the access token, or "" if the
+//session was found from an access token.
+func (self *JWTSession) RefreshToken() string {
+	return self.refresh
+}
+
+//TokenKey is the key of the underlying session, since the access token changes on refresh.
+func (self *JWTSession) TokenKey() string {
+	return tokenKey(self.Session)
+}
+
+//Roles returns the roles in the token, except while the session is impersonating: the token
+//was issued to the Actor, so its roles are not those of the user being impersonated.
+func (self *JWTSession) Roles() []string {
+	if _, ok := self.Session.(*ImpersonationSession); ok {
+		if rh, ok := self.Session.(RoleHolder); ok {
+			return rh.Roles()
+		}
+		return nil
+	}
+	return self.Claims.Roles
+}
+
+//Wrapped returns the session of the inner SessionManager.
+func (self *JWTSession) Wrapped() Session {
+	return self.Session
+}
+
+//SessionWrapper is implemented by a Session that wraps the session of another
+//SessionManager, as JWTSession does.  Code that needs the concrete type of a session, such
+//as BasicUser or *ImpersonationSession, should look at UnwrapSession(s) instead of s.
+type SessionWrapper interface {
+	Wrapped() Session
+}
+
+//UnwrapSession returns the session underneath any SessionWrappers around s.
+func UnwrapSession(s Session) Session {
+	for {
+		w, ok := s.(SessionWrapper)
+		if !ok {
+			return s
+		}
+		s = w.Wrapped()
+	}
+}
+
+//JWTSessionManager is a SessionManager that represents sessions as short-lived signed
+//JWTs.  The sessions themselves are kept by another SessionManager; the tokens contain the
+//id of that session and the user's roles (see RoleHolder).  Since the session id is the
+//token, the cookie holds the token, and JWTSessionManager is also a BearerResolver so the
+//token can be sent in an Authorization header instead.  Use JWTCookieMapper to also keep
+//the refresh token in a cookie.
+//
+//JWTSessionManager is a Dispatcher for the token endpoints: map it at a prefix like
+///auth/token/ to get refresh, revoke and jwks below that.
+type JWTSessionManager struct {
+	Inner     SessionManager
+	Key       *JWTSigningKey
+	Issuer    string
+	CookieMap CookieMapper
+	accessTTL time.Duration
+	refreshes *expiringMap
+	revoked   *expiringMap
+}
+
+//NewJWTSessionManager returns a SessionManager that signs access tokens with key.  Access
+//tokens last for accessTTL and refresh tokens for refreshTTL (see JWT_ACCESS_TTL and
+//JWT_REFRESH_TTL for reasonable values).
+func NewJWTSessionManager(inner SessionManager, key *JWTSigningKey, issuer string, accessTTL time.Duration, refreshTTL time.Duration) *JWTSessionManager {
+	return &JWTSessionManager{
+		Inner:     inner,
+		Key:       key,
+		Issuer:    issuer,
+		accessTTL: accessTTL,
+		refreshes: newExpiringMap(refreshTTL),
+		//a revoked token only needs to be remembered until it would have expired anyway
+		revoked: newExpiringMap(accessTTL + JWT_CLOCK_SKEW),
+	}
+}
+
+//Generate creates a session with the inner SessionManager and issues tokens for it.
+func (self *JWTSessionManager) Generate(c OauthConnection, id string, r *http.Request, state string, code string) (Session, error) {
+	s, err := self.Inner.Generate(c, self.innerId(id), r, state, code)
+	if err != nil || s == nil {
+		return s, err
+	}
+	return self.issue(s)
+}
+
+//Find returns the session for an access token, or nil if the token is not valid, has been
+//revoked, or refers to a session that has been destroyed.
+func (self *JWTSessionManager) Find(token string) (Session, error) {
+	if token == "" {
+		return nil, nil
+	}
+	claims, err := self.verify(token)
+	if err != nil {
+		return nil, nil
+	}
+	s, err := self.Inner.Find(claims.Subject)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return &JWTSession{Session: s, Claims: claims, token: token}, nil
+}
+
+//Destroy revokes the access token and destroys the underlying session, which also makes
+//its refresh tokens useless.
+func (self *JWTSessionManager) Destroy(token string) error {
+	claims := &AccessClaims{}
+	if err := VerifyJWT(token, self.Key.VerificationKey(), claims); err != nil {
+		return nil
+	}
+	self.revoked.Put(claims.Id, true)
+	return self.Inner.Destroy(claims.Subject)
+}
+
+//ResolveBearer makes JWTSessionManager a BearerResolver.  Access tokens are not limited by
+//scopes.
+func (self *JWTSessionManager) ResolveBearer(token string) (Session, []string, error) {
+	s, err := self.Find(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	if s == nil {
+		return nil, nil, BAD_BEARER_TOKEN
+	}
+	return s, nil, nil
+}
+
+//Refresh exchanges a refresh token for a new access token and refresh token.  Refresh
+//tokens can only be used once.
+func (self *JWTSessionManager) Refresh(refreshToken string) (*JWTSession, error) {
+	id, ok := self.refreshes.Take(refreshToken)
+	if !ok {
+		return nil, BAD_REFRESH_TOKEN
+	}
+	s, err := self.Inner.Find(id.(string))
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, BAD_REFRESH_TOKEN
+	}
+	return self.issue(s)
+}
+
+//Revoke makes an access token unusable here before it expires.  Other services that check
+//tokens with VerifyAccessToken will still accept it until it expires.
+func (self *JWTSessionManager) Revoke(token string) error {
+	claims := &AccessClaims{}
+	if err := VerifyJWT(token, self.Key.VerificationKey(), claims); err != nil {
+		return err
+	}
+	self.revoked.Put(claims.Id, true)
+	return nil
+}
+
+//innerId converts the old session id given to Generate, which is an access token, to the
+//id of the inner session.
+func (self *JWTSessionManager) innerId(token string) string {
+	claims := &AccessClaims{}
+	if token == "" || VerifyJWT(token, self.Key.VerificationKey(), claims) != nil {
+		return ""
+	}
+	return claims.Subject
+}
+
+func (self *JWTSessionManager) verify(token string) (*AccessClaims, error) {
+	claims, err := VerifyAccessToken(token, self.Key.VerificationKey(), self.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := self.revoked.Get(claims.Id); ok {
+		return nil, JWT_REVOKED
+	}
+	return claims, nil
+}
+
+func (self *JWTSessionManager) issue(s Session) (*JWTSession, error) {
+	jti, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	refresh, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claims := &AccessClaims{
+		Issuer:   self.Issuer,
+		Subject:  s.SessionId(),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(self.accessTTL).Unix(),
+		Id:       jti,
+	}
+	if rh, ok := s.(RoleHolder); ok {
+		claims.Roles = rh.Roles()
+	}
+	token, err := self.Key.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	self.refreshes.Put(refresh, s.SessionId())
+	return &JWTSession{Session: s, Claims: claims, token: token, refresh: refresh}, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//jwtTokenResponse is what the refresh endpoint returns, in the style of an oauth2 token
+//endpoint.
+type jwtTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+//Dispatch handles the token endpoints, which are named by the last part of the path.
+//POST refresh takes a refresh_token form value (or the refresh cookie of a JWTCookieMapper)
+//and returns new tokens as json, also setting the cookie if CookieMap is set.  POST revoke
+//takes a token form value.  GET jwks returns the public key for other services, unless the
+//key is HS256.
+func (self *JWTSessionManager) Dispatch(mux *ServeMux, w http.ResponseWriter, r *http.Request) *ServeMux {
+	op := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	switch op {
+	case "jwks":
+		jwk := self.Key.JWK()
+		if jwk == nil {
+			http.NotFound(w, r)
+			return nil
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []*JSONWebKey{jwk}})
+		return nil
+	case "refresh", "revoke":
+		if r.Method != "POST" {
+			http.Error(w, fmt.Sprintf("%s must be POSTed", r.URL.Path), http.StatusMethodNotAllowed)
+			return nil
+		}
+	default:
+		http.NotFound(w, r)
+		return nil
+	}
+	if op == "revoke" {
+		if err := self.Revoke(r.PostFormValue("token")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return nil
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	rt := r.PostFormValue("refresh_token")
+	if jcm, ok := self.CookieMap.(*JWTCookieMapper); ok && rt == "" {
+		rt, _ = jcm.RefreshValue(r)
+	}
+	s, err := self.Refresh(rt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
+	if self.CookieMap != nil {
+		self.CookieMap.AssociateCookie(w, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(&jwtTokenResponse{
+		AccessToken:  s.token,
+		RefreshToken: s.refresh,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(self.accessTTL / time.Second),
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write to client connection: %s\n", err)
+	}
+	return nil
+}
+
+//JWTCookieMapper is a CookieMapper for use with a JWTSessionManager.  Along with the access
+//token cookie it keeps the refresh token in a second cookie that is only sent to the
+//refresh endpoint and can't be read by scripts.  RemoveCookie leaves the refresh cookie
+//alone, since it is called when the access token expires; after a logout the refresh
+//token is useless anyway.
+type JWTCookieMapper struct {
+	CookieMapper
+	refreshPath string
+}
+
+//NewJWTCookieMapper returns a JWTCookieMapper for the application.  The refreshPath is the
+//URL of the refresh endpoint, such as /auth/token/refresh.
+func NewJWTCookieMapper(appName string, refreshPath string) *JWTCookieMapper {
+	return &JWTCookieMapper{CookieMapper: NewSimpleCookieMapper(appName), refreshPath: refreshPath}
+}
+
+func (self *JWTCookieMapper) refreshName() string {
+	return self.CookieName() + "-refresh"
+}
+
+//AssociateCookie sets the access token cookie and, if the session has one, the refresh
+//token cookie.
+func (self *JWTCookieMapper) AssociateCookie(w http.ResponseWriter, s Session) {
+	self.CookieMapper.AssociateCookie(w, s)
+	if js, ok := s.(*JWTSession); ok && js.refresh != "" {
+		http.SetCookie(w, &http.Cookie{
+			Name:     self.refreshName(),
+			Value:    js.refresh,
+			Path:     self.refreshPath,
+			HttpOnly: true,
+		})
+	}
+}
+
+//RefreshValue returns the refresh token from the request's cookie.
+func (self *JWTCookieMapper) RefreshValue(r *http.Request) (string, error) {
+	c, err := r.Cookie(self.refreshName())
+	if err == http.ErrNoCookie {
+		return "", NO_SUCH_COOKIE
+	}
+	return strings.TrimSpace(c.Value), nil
+}
@@ -0,0 +1,200 @@
+package seven5
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestJWTSigningKeys(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := []*JWTSigningKey{
+		NewHS256Key([]byte("sekrit"), "h"),
+		NewRS256Key(rsaKey, "r"),
+		NewEdDSAKey(edKey, "e"),
+	}
+	for _, k := range keys {
+		token, err := k.Sign(map[string]interface{}{"sub": "1138"})
+		if err != nil {
+			t.Fatalf("%s: unable to sign: %s", k.Alg, err)
+		}
+		claims := map[string]interface{}{}
+		if err := VerifyJWT(token, k.VerificationKey(), &claims); err != nil || claims["sub"] != "1138" {
+			t.Errorf("%s: failed to verify: %v %v", k.Alg, err, claims)
+		}
+		tampered := token[:strings.LastIndex(token, ".")-2] + "xx" + token[strings.LastIndex(token, "."):]
+		if VerifyJWT(tampered, k.VerificationKey(), &claims) == nil {
+			t.Errorf("%s: tampered token verified", k.Alg)
+		}
+		//a token must not verify with a key of another algorithm
+		for _, other := range keys {
+			if other != k && VerifyJWT(token, other.VerificationKey(), &claims) == nil {
+				t.Errorf("%s: verified with %s key", k.Alg, other.Alg)
+			}
+		}
+		jwk := k.JWK()
+		if k.Alg == "HS256" {
+			if jwk != nil {
+				t.Errorf("shared secret should not be published")
+			}
+			continue
+		}
+		pub, err := jwk.PublicKey()
+		if err != nil || VerifyJWT(token, pub, &claims) != nil {
+			t.Errorf("%s: published key does not verify: %v", k.Alg, err)
+		}
+	}
+}
+
+//roleSessionManager creates sessions for admins.
+type roleSessionManager struct {
+	*SimpleSessionManager
+}
+
+type roleSession struct {
+	*SimpleSession
+}
+
+func (self *roleSession) Roles() []string {
+	return []string{"admin"}
+}
+
+func (self *roleSessionManager) Generate(c OauthConnection, id string, r *http.Request, state string, code string) (Session, error) {
+	return self.Assign(&roleSession{NewSimpleSession()})
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestJWTSessions(t *testing.T) {
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	key := NewEdDSAKey(edKey, "k1")
+	jsm := NewJWTSessionManager(&roleSessionManager{NewSimpleSessionManager()}, key, "seven5test", time.Minute, time.Hour)
+	cm := NewJWTCookieMapper(appName, "/auth/token/refresh")
+	jsm.CookieMap = cm
+
+	disp := NewBaseDispatcher(appName, jsm)
+	disp.UseBearer(MultiBearerResolver{NewSimpleAPITokenStore(), jsm})
+	res := &scopedResource{}
+	disp.ResourceSeparate("NoteWire", &NoteWire{}, res, nil, res, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	mux.Dispatch("/auth/token/", jsm)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	s, err := jsm.Generate(nil, "", nil, "", "")
+	if err != nil {
+		t.Fatalf("unable to generate session: %s", err)
+	}
+	first := s.(*JWTSession)
+	claims, err := VerifyAccessToken(first.SessionId(), key.VerificationKey(), "seven5test")
+	if err != nil || len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Errorf("bad access token: %v %+v", err, claims)
+	}
+
+	get := func(token string, cookie bool) int {
+		if cookie {
+			return sendRequest(t, srv, "GET", "/rest/notewire", "", &http.Cookie{Name: cm.CookieName(), Value: token}).StatusCode
+		}
+		return sendRequest(t, srv, "GET", "/rest/notewire", "", nil, "Authorization", "Bearer "+token).StatusCode
+	}
+	if get(first.SessionId(), true) != http.StatusOK || get(first.SessionId(), false) != http.StatusOK {
+		t.Errorf("access token not accepted from cookie and header")
+	}
+	expired, _ := key.Sign(&AccessClaims{Issuer: "seven5test", Subject: first.Claims.Subject, Expires: time.Now().Add(-time.Hour).Unix()})
+	if get(expired, false) != http.StatusUnauthorized || get(expired, true) != http.StatusUnauthorized {
+		t.Errorf("expired token accepted")
+	}
+
+	//other services can verify with the published key
+	resp, _ := http.Get(srv.URL + "/auth/token/jwks")
+	set := &JSONWebKeySet{}
+	json.NewDecoder(resp.Body).Decode(set)
+	if len(set.Keys) != 1 {
+		t.Fatalf("bad key set: %+v", set)
+	}
+	pub, _ := set.Keys[0].PublicKey()
+	if _, err := VerifyAccessToken(first.SessionId(), pub, "seven5test"); err != nil {
+		t.Errorf("published key does not verify access token: %s", err)
+	}
+
+	//refresh from the cookie, then check the refresh token was rotated
+	resp = sendRequest(t, srv, "POST", "/auth/token/refresh", "", &http.Cookie{Name: cm.refreshName(), Value: first.RefreshToken()})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unable to refresh: %s", resp.Status)
+	}
+	tr := &jwtTokenResponse{}
+	json.NewDecoder(resp.Body).Decode(tr)
+	if tr.AccessToken == "" || tr.RefreshToken == first.RefreshToken() || len(resp.Cookies()) != 2 {
+		t.Errorf("expected new tokens and cookies: %+v %v", tr, resp.Cookies())
+	}
+	resp, _ = http.PostForm(srv.URL+"/auth/token/refresh", url.Values{"refresh_token": {first.RefreshToken()}})
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("refresh token reused: %s", resp.Status)
+	}
+
+	//revoked tokens stop working here at once
+	resp, _ = http.PostForm(srv.URL+"/auth/token/revoke", url.Values{"token": {tr.AccessToken}})
+	if resp.StatusCode != http.StatusNoContent || get(tr.AccessToken, false) != http.StatusUnauthorized {
+		t.Errorf("revoke failed: %s", resp.Status)
+	}
+
+	//logging out kills the refresh token too
+	if err := jsm.Destroy(first.SessionId()); err != nil {
+		t.Fatalf("destroy failed: %s", err)
+	}
+	if _, err := jsm.Refresh(tr.RefreshToken); err != BAD_REFRESH_TOKEN {
+		t.Errorf("refresh after logout should fail but got %v", err)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestJWTWithBasicManager(t *testing.T) {
+	mgr := NewBasicManager(&linkedSupport{})
+	mgr.Roles = NewSimpleRoleStore()
+	jsm := NewJWTSessionManager(mgr, NewHS256Key([]byte("sekrit"), "h"), "seven5test", time.Minute, time.Hour)
+	staff, _ := jsm.Generate(&PasswordConnection{Username: "staff"}, "", nil, "", "")
+	alice, _ := jsm.Generate(&PasswordConnection{Username: "alice"}, "", nil, "", "")
+	bob, _ := jsm.Generate(&PasswordConnection{Username: "bob"}, "", nil, "", "")
+	mgr.Roles.Assign(UserKey(staff), ROLE_STAFF)
+	aliceId := UnwrapSession(alice).(BasicUser).WireId()
+	bobId := UnwrapSession(bob).(BasicUser).WireId()
+	if UserKey(alice) != fmt.Sprint(aliceId) {
+		t.Errorf("expected the user key of a JWT session to be the user id but got %s", UserKey(alice))
+	}
+
+	disp := NewBaseDispatcher(appName, jsm)
+	disp.Resource("LinkedWire", &LinkedWire{}, mgr.UserResource())
+	res := mgr.ImpersonationResource()
+	disp.ResourceSeparate("ImpersonationWire", &ImpersonationWire{}, res, nil, res, nil, res)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	do := func(method string, path string, body string, s Session) *http.Response {
+		return sendRequest(t, srv, method, path, body, sessionCookie(disp, s))
+	}
+
+	if resp := do("GET", fmt.Sprintf("/rest/linkedwire/%d", aliceId), "", alice); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected alice to see herself with a JWT session but got %s", resp.Status)
+	}
+	if resp := do("POST", "/rest/impersonationwire", fmt.Sprintf(`{"Id":%d}`, aliceId), staff); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("unable to impersonate with a JWT session: %s", resp.Status)
+	}
+	resp := do("GET", fmt.Sprintf("/rest/linkedwire/%d", aliceId), "", staff)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get(IMPERSONATION_HEADER) != fmt.Sprint(aliceId) {
+		t.Errorf("expected staff to see alice as alice: %s %v", resp.Status, resp.Header)
+	}
+	if resp := do("GET", fmt.Sprintf("/rest/linkedwire/%d", bobId), "", staff); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected the impersonation not to be ignored: %s", resp.Status)
+	}
+}
@@ -0,0 +1,408 @@
+package seven5
+
+import (
+	oauth2 "code.google.com/p/goauth2/oauth"
+	"crypto"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	OIDC_DISCOVERY_PATH = "/.well-known/openid-configuration"
+	//OIDC_CLOCK_SKEW is how far we allow our clock and the provider's to disagree when
+	//checking the times in an id_token.
+	OIDC_CLOCK_SKEW = 2 * time.Minute
+)
+
+//OIDCDiscovery is the part of an OpenID provider's discovery document that we use.
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//IdTokenClaims are the claims of an id_token that has been verified.  The standard claims
+//that applications commonly need are fields; everything the provider sent is in Raw.
+type IdTokenClaims struct {
+	Issuer          string                 `json:"iss"`
+	Subject         string                 `json:"sub"`
+	Audience        audience               `json:"aud"`
+	Expiry          int64                  `json:"exp"`
+	IssuedAt        int64                  `json:"iat"`
+	Nonce           string                 `json:"nonce"`
+	AuthorizedParty string                 `json:"azp"`
+	Email           string                 `json:"email"`
+	EmailVerified   bool                   `json:"email_verified"`
+	Name            string                 `json:"name"`
+	GivenName       string                 `json:"given_name"`
+	FamilyName      string                 `json:"family_name"`
+	Picture         string                 `json:"picture"`
+	Locale          string                 `json:"locale"`
+	Raw             map[string]interface{} `json:"-"`
+}
+
+//audience is the aud claim, which the spec allows to be a single string or a list.
+type audience []string
+
+func (self *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*self = audience{one}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*self = audience(many)
+	return nil
+}
+
+func (self audience) contains(s string) bool {
+	for _, a := range self {
+		if a == s {
+			return true
+		}
+	}
+	return false
+}
+
+//ClaimsConnection is implemented by OauthConnections that carry the verified identity of
+//the user.  SessionManager.Generate implementations can check for this interface rather
+//than making a separate call to the provider to find out who logged in.
+type ClaimsConnection interface {
+	OauthConnection
+	Claims() *IdTokenClaims
+}
+
+//OIDCConnector is an OauthConnector for any OpenID Connect provider.  It reads the provider's
+//discovery document and signing keys when created and verifies the id_token returned from
+//the code exchange.  It always uses PKCE and the nonce and redirect_uri sent to the provider
+//are remembered against the PKCE challenge, so it must be used via the PKCEConnector methods
+//(which is what the AuthDispatcher does).
+type OIDCConnector struct {
+	name   string
+	host   string
+	cfg    *oauth2.Config
+	disc   *OIDCDiscovery
+	nonces *expiringMap
+
+	keyLock sync.Mutex
+	keys    map[string]crypto.PublicKey
+}
+
+//NewOIDCConnector returns a connector for the OpenID provider at issuer.  The name is used
+//for the URLs of the AuthDispatcher and for looking up the client id and secret.  The scope
+//"openid" is added to the scope if it is not already present.  This makes network calls
+//to the provider to read the discovery document and keys.
+func NewOIDCConnector(name string, issuer string, scope string, d OauthClientDetail,
+	dep DeploymentEnvironment) (*OIDCConnector, error) {
+	issuer = strings.TrimSuffix(issuer, "/")
+	disc := &OIDCDiscovery{}
+	if err := getJSON(issuer+OIDC_DISCOVERY_PATH, disc); err != nil {
+		return nil, err
+	}
+	if disc.Issuer != issuer {
+		return nil, errors.New(fmt.Sprintf("discovery document is for issuer %s, not %s", disc.Issuer, issuer))
+	}
+	if disc.AuthorizationEndpoint == "" || disc.TokenEndpoint == "" || disc.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing required endpoints")
+	}
+	if !strings.Contains(" "+scope+" ", " openid ") {
+		scope = strings.TrimSpace("openid " + scope)
+	}
+	result := &OIDCConnector{
+		name: name,
+		host: dep.RedirectHost(name),
+		cfg: &oauth2.Config{
+			ClientId:     d.ClientId(name),
+			ClientSecret: d.ClientSecret(name),
+			Scope:        scope,
+			AuthURL:      disc.AuthorizationEndpoint,
+			TokenURL:     disc.TokenEndpoint,
+		},
+		disc:   disc,
+		nonces: newExpiringMap(PKCE_VERIFIER_TTL),
+	}
+	if err := result.fetchKeys(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+//Discovery returns the discovery document read from the provider.
+func (self *OIDCConnector) Discovery() *OIDCDiscovery {
+	return self.disc
+}
+
+func (self *OIDCConnector) Name() string {
+	return self.name
+}
+
+func (self *OIDCConnector) ClientTokenValueName() string {
+	return "notused"
+}
+
+func (self *OIDCConnector) CodeValueName() string {
+	return "code"
+}
+
+func (self *OIDCConnector) ErrorValueName() string {
+	return "error"
+}
+
+func (self *OIDCConnector) StateValueName() string {
+	return "state"
+}
+
+func (self *OIDCConnector) Phase1(state string, callbackPath string) (OauthCred, error) {
+	return nil, nil
+}
+
+//UserInteractionURL is present to satisfy OauthConnector but a login started this way
+//cannot be completed because there is no nonce to check; use UserInteractionURLWithChallenge.
+func (self *OIDCConnector) UserInteractionURL(ignored OauthCred, state string, callbackPath string) string {
+	return self.authURL(state, callbackPath, url.Values{})
+}
+
+//Phase2 always fails because the id_token cannot be checked without the nonce, which is
+//only known via Phase2WithVerifier.
+func (self *OIDCConnector) Phase2(ignored string, code string) (OauthConnection, error) {
+	return nil, errors.New("OpenID connect logins must use PKCE")
+}
+
+//UserInteractionURLWithChallenge creates a nonce for this login and sends the user to the
+//provider's authorization endpoint.
+func (self *OIDCConnector) UserInteractionURLWithChallenge(ignored OauthCred, state string, callbackPath string,
+	challenge string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("unable to read random bytes for nonce: %s", err))
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	self.nonces.Put(challenge, &oidcLogin{nonce: nonce, redirect: self.host + callbackPath})
+	return self.authURL(state, callbackPath, url.Values{
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {PKCE_METHOD},
+	})
+}
+
+//oidcLogin is what is remembered against the PKCE challenge of a login that has been started.
+type oidcLogin struct {
+	nonce    string
+	redirect string
+}
+
+//authURL is the URL of the provider's authorization endpoint for a login.  The connector is
+//shared by all logins, so nothing about this login is stored in it.
+func (self *OIDCConnector) authURL(state string, callbackPath string, extra url.Values) string {
+	u, err := url.Parse(self.disc.AuthorizationEndpoint)
+	if err != nil {
+		panic(fmt.Sprintf("unable to understand authorization endpoint %s: %s", self.disc.AuthorizationEndpoint, err))
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", self.cfg.ClientId)
+	q.Set("redirect_uri", self.host+callbackPath)
+	q.Set("scope", self.cfg.Scope)
+	q.Set("state", state)
+	for k, v := range extra {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+//Phase2WithVerifier exchanges the code and verifies the id_token that comes back with it.
+//The resulting connection carries the verified claims.  The redirect_uri sent is the one
+//used when this login was started.
+func (self *OIDCConnector) Phase2WithVerifier(ignored string, code string, verifier string) (OauthConnection, error) {
+	v, ok := self.nonces.Take(PKCEChallenge(verifier))
+	if !ok {
+		return nil, errors.New("no nonce known for this login (or it took too long)")
+	}
+	login := v.(*oidcLogin)
+	cfg := *self.cfg
+	cfg.RedirectURL = login.redirect
+	tok, err := exchangeWithVerifier(&cfg, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	raw := tok.Extra["id_token"]
+	if raw == "" {
+		return nil, errors.New("provider did not return an id_token")
+	}
+	claims, err := self.VerifyIdToken(raw, login.nonce)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDCConnection{
+		Transport: &oauth2.Transport{Config: self.cfg, Token: tok},
+		claims:    claims,
+	}, nil
+}
+
+//VerifyIdToken checks the signature of the id_token against the provider's keys and then
+//checks the issuer, audience, times and nonce.  It returns the claims if everything is ok.
+func (self *OIDCConnector) VerifyIdToken(raw string, nonce string) (*IdTokenClaims, error) {
+	p, err := parseJWT(raw)
+	if err != nil {
+		return nil, err
+	}
+	key, err := self.key(p.header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verifySignature(key); err != nil {
+		return nil, err
+	}
+	claims := &IdTokenClaims{}
+	if err := json.Unmarshal(p.payload, claims); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(p.payload, &claims.Raw); err != nil {
+		return nil, err
+	}
+	if claims.Issuer != self.disc.Issuer {
+		return nil, errors.New(fmt.Sprintf("id_token issued by %s, expected %s", claims.Issuer, self.disc.Issuer))
+	}
+	if !claims.Audience.contains(self.cfg.ClientId) {
+		return nil, errors.New("id_token is not intended for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != self.cfg.ClientId {
+		return nil, errors.New("id_token has multiple audiences but we are not the authorized party")
+	}
+	now := time.Now()
+	if claims.Expiry == 0 || now.Add(-OIDC_CLOCK_SKEW).After(time.Unix(claims.Expiry, 0)) {
+		return nil, errors.New("id_token has expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(OIDC_CLOCK_SKEW)) {
+		return nil, errors.New("id_token was issued in the future")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("id_token nonce does not match this login")
+	}
+	return claims, nil
+}
+
+//key returns the provider's key with the given id.  If we don't have it, the provider may
+//have rotated its keys so we fetch them again (once) before giving up.
+func (self *OIDCConnector) key(kid string) (crypto.PublicKey, error) {
+	self.keyLock.Lock()
+	k, ok := self.keys[kid]
+	self.keyLock.Unlock()
+	if ok {
+		return k, nil
+	}
+	if err := self.fetchKeys(); err != nil {
+		return nil, err
+	}
+	self.keyLock.Lock()
+	defer self.keyLock.Unlock()
+	if k, ok = self.keys[kid]; !ok {
+		return nil, JWT_UNKNOWN_KEY
+	}
+	return k, nil
+}
+
+//fetchKeys reads the provider's JWKS and replaces our copy of the keys.  Keys that are
+//marked for encryption or that we don't understand are skipped.
+func (self *OIDCConnector) fetchKeys() error {
+	set := &JSONWebKeySet{}
+	if err := getJSON(self.disc.JWKSURI, set); err != nil {
+		return err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		k, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = k
+	}
+	self.keyLock.Lock()
+	self.keys = keys
+	self.keyLock.Unlock()
+	return nil
+}
+
+//getJSON fetches a URL and decodes the json body into result.
+func getJSON(u string, result interface{}) error {
+	resp, err := http.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(fmt.Sprintf("unable to fetch %s: %s", u, resp.Status))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+//OIDCConnection is the connection returned by an OIDCConnector.  It sends requests with the
+//access token, refreshing it if necessary, and carries the verified claims of the id_token.
+type OIDCConnection struct {
+	*oauth2.Transport
+	tokenPersistence
+	claims *IdTokenClaims
+	lock   sync.Mutex
+}
+
+//oidcCredentials is the stored form of an OIDCConnection.  The claims were verified when the
+//user logged in so they are kept rather than verifying an (expired) id_token again.
+type oidcCredentials struct {
+	Token  *oauth2.Token
+	Claims map[string]interface{}
+}
+
+//Claims returns the verified claims of the id_token received at login.
+func (self *OIDCConnection) Claims() *IdTokenClaims {
+	return self.claims
+}
+
+func (self *OIDCConnection) SendAuthenticated(r *http.Request) (*http.Response, error) {
+	return sendOauth2(&self.lock, self.Transport, r, func(t *oauth2.Token) error {
+		return self.save(json.Marshal(&oidcCredentials{t, self.claims.Raw}))
+	})
+}
+
+//MarshalCredentials returns the token and claims of this connection as json.
+func (self *OIDCConnection) MarshalCredentials() ([]byte, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return json.Marshal(&oidcCredentials{self.Token, self.claims.Raw})
+}
+
+//RestoreConnection creates a connection from the json written by OIDCConnection.MarshalCredentials.
+func (self *OIDCConnector) RestoreConnection(data []byte) (OauthConnection, error) {
+	creds := &oidcCredentials{}
+	if err := json.Unmarshal(data, creds); err != nil {
+		return nil, err
+	}
+	raw, err := json.Marshal(creds.Claims)
+	if err != nil {
+		return nil, err
+	}
+	claims := &IdTokenClaims{Raw: creds.Claims}
+	if err := json.Unmarshal(raw, claims); err != nil {
+		return nil, err
+	}
+	return &OIDCConnection{
+		Transport: &oauth2.Transport{Config: self.cfg, Token: creds.Token},
+		claims:    claims,
+	}, nil
+}
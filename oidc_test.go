@@ -0,0 +1,234 @@
+package seven5
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------------------------*/
+//fakeOIDC is a stand-in OpenID provider.  The claims function lets each test case decide
+//what goes into the id_token.
+type fakeOIDC struct {
+	srv       *httptest.Server
+	key       *rsa.PrivateKey
+	signer    *rsa.PrivateKey
+	challenge string
+	nonce     string
+	redirect  string
+	claims    func(issuer string, nonce string) map[string]interface{}
+}
+
+func newFakeOIDC(t *testing.T) *fakeOIDC {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	result := &fakeOIDC{key: key, signer: key}
+	result.srv = httptest.NewServer(result)
+	return result
+}
+
+func (self *fakeOIDC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	iss := self.srv.URL
+	switch r.URL.Path {
+	case OIDC_DISCOVERY_PATH:
+		json.NewEncoder(w).Encode(&OIDCDiscovery{
+			Issuer:                iss,
+			AuthorizationEndpoint: iss + "/authorize",
+			TokenEndpoint:         iss + "/token",
+			JWKSURI:               iss + "/jwks",
+		})
+	case "/jwks":
+		json.NewEncoder(w).Encode(&JSONWebKeySet{Keys: []*JSONWebKey{&JSONWebKey{
+			Kty: "RSA", Kid: "k1", Use: "sig",
+			N: base64.RawURLEncoding.EncodeToString(self.key.N.Bytes()),
+			E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(self.key.E)).Bytes()),
+		}}})
+	case "/token":
+		r.ParseForm()
+		self.redirect = r.Form.Get("redirect_uri")
+		if PKCEChallenge(r.Form.Get("code_verifier")) != self.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at",
+			"expires_in":   60,
+			"id_token":     signRS256(self.signer, "k1", self.claims(iss, self.nonce)),
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	h, _ := json.Marshal(&jwtHeader{Alg: "RS256", Kid: kid, Typ: "JWT"})
+	c, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	sum := sha256.Sum256([]byte(input))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+//claimSessionManager remembers the connection it was given to create a session.
+type claimSessionManager struct {
+	*SimpleSessionManager
+	conn OauthConnection
+}
+
+func (self *claimSessionManager) Generate(c OauthConnection, id string, r *http.Request, state string, code string) (Session, error) {
+	self.conn = c
+	return self.SimpleSessionManager.Generate(c, id, r, state, code)
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestOIDCLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	provider := newFakeOIDC(t)
+	defer provider.srv.Close()
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+	mux := NewServeMux()
+	app := httptest.NewServer(mux)
+	defer app.Close()
+
+	deploy := NewMockDeploymentEnvironment(ctrl)
+	deploy.EXPECT().RedirectHost("fakeid").Return(app.URL)
+	detail := NewMockOauthClientDetail(ctrl)
+	detail.EXPECT().ClientId("fakeid").Return(id)
+	detail.EXPECT().ClientSecret("fakeid").Return(seekret)
+
+	conn, err := NewOIDCConnector("fakeid", provider.srv.URL+"/", "email", detail, deploy)
+	if err != nil {
+		t.Fatalf("unable to create connector from discovery: %s", err)
+	}
+	if conn.cfg.Scope != "openid email" {
+		t.Errorf("expected openid to be added to scope but got '%s'", conn.cfg.Scope)
+	}
+	sm := &claimSessionManager{SimpleSessionManager: NewSimpleSessionManager()}
+	disp := NewAuthDispatcherRaw("/auth", NewSimplePageMapper(three, two, "notused"), NewSimpleCookieMapper(appName), sm)
+	disp.AddConnector(conn, mux)
+
+	client := new(http.Client)
+	client.Jar, _ = cookiejar.New(nil)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return stopProcessing
+	}
+
+	good := func(iss string, nonce string) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": iss, "sub": "1138", "aud": id, "nonce": nonce, "email": "thx@example.com",
+			"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix(),
+		}
+	}
+	tweak := func(k string, v interface{}) func(string, string) map[string]interface{} {
+		return func(iss string, nonce string) map[string]interface{} {
+			c := good(iss, nonce)
+			c[k] = v
+			return c
+		}
+	}
+	cases := []struct {
+		name    string
+		claims  func(string, string) map[string]interface{}
+		signer  *rsa.PrivateKey
+		landing string
+	}{
+		{"good", good, provider.key, two},
+		{"wrong audience", tweak("aud", []string{"someone else"}), provider.key, three},
+		{"expired", tweak("exp", time.Now().Add(-time.Hour).Unix()), provider.key, three},
+		{"wrong nonce", tweak("nonce", "fishy"), provider.key, three},
+		{"wrong issuer", tweak("iss", "https://evil.example.com"), provider.key, three},
+		{"bad signature", good, other, three},
+	}
+	for _, c := range cases {
+		provider.claims = c.claims
+		provider.signer = c.signer
+		sm.conn = nil
+
+		resp := createReqAndDo(t, client, app.URL+"/auth/fakeid/login?state=s", nil)
+		loc, _ := url.Parse(resp.Header.Get("Location"))
+		if !strings.HasPrefix(loc.String(), provider.srv.URL+"/authorize") {
+			t.Fatalf("%s: expected to be sent to provider but went to %s", c.name, loc)
+		}
+		provider.challenge = loc.Query().Get("code_challenge")
+		provider.nonce = loc.Query().Get("nonce")
+		if provider.nonce == "" || loc.Query().Get("redirect_uri") != app.URL+"/auth/fakeid/oauth2callback" {
+			t.Errorf("%s: bad authorization url %s", c.name, loc)
+		}
+
+		resp = createReqAndDo(t, client, app.URL+"/auth/fakeid/oauth2callback?state=s&code=c", nil)
+		if !strings.HasPrefix(resp.Header.Get("Location"), c.landing) {
+			t.Errorf("%s: expected to land on %s but got %s", c.name, c.landing, resp.Header.Get("Location"))
+		}
+		if c.landing == three {
+			if sm.conn != nil {
+				t.Errorf("%s: should not have created a session", c.name)
+			}
+			continue
+		}
+		cc, ok := sm.conn.(ClaimsConnection)
+		if !ok {
+			t.Fatalf("%s: expected a connection with claims but got %T", c.name, sm.conn)
+		}
+		if cc.Claims().Subject != "1138" || cc.Claims().Email != "thx@example.com" {
+			t.Errorf("%s: wrong claims passed to session manager: %+v", c.name, cc.Claims())
+		}
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestOIDCRedirectPerLogin(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	provider := newFakeOIDC(t)
+	defer provider.srv.Close()
+	deploy := NewMockDeploymentEnvironment(ctrl)
+	deploy.EXPECT().RedirectHost("fakeid").Return("https://app.example.com")
+	detail := NewMockOauthClientDetail(ctrl)
+	detail.EXPECT().ClientId("fakeid").Return(id)
+	detail.EXPECT().ClientSecret("fakeid").Return(seekret)
+	conn, err := NewOIDCConnector("fakeid", provider.srv.URL, "", detail, deploy)
+	if err != nil {
+		t.Fatalf("unable to create connector from discovery: %s", err)
+	}
+	provider.claims = func(iss string, nonce string) map[string]interface{} {
+		return map[string]interface{}{"iss": iss, "sub": "1138", "aud": id, "nonce": nonce,
+			"exp": time.Now().Add(time.Minute).Unix(), "iat": time.Now().Unix()}
+	}
+
+	//two logins are started before either finishes
+	first, _ := NewPKCEVerifier()
+	second, _ := NewPKCEVerifier()
+	u, _ := url.Parse(conn.UserInteractionURLWithChallenge(nil, "s1", "/first/cb", PKCEChallenge(first)))
+	conn.UserInteractionURLWithChallenge(nil, "s2", "/second/cb", PKCEChallenge(second))
+	provider.challenge = PKCEChallenge(first)
+	provider.nonce = u.Query().Get("nonce")
+	if _, err := conn.Phase2WithVerifier("", "code", first); err != nil {
+		t.Fatalf("unable to finish first login: %s", err)
+	}
+	if provider.redirect != "https://app.example.com/first/cb" {
+		t.Errorf("expected the first login's redirect_uri but got %s", provider.redirect)
+	}
+	if conn.cfg.RedirectURL != "" {
+		t.Errorf("expected the shared config to be left alone but got %s", conn.cfg.RedirectURL)
+	}
+}
@@ -0,0 +1,210 @@
+package seven5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+//OPENAPI_VERSION is the version of the OpenAPI specification that OpenAPI documents follow.
+const OPENAPI_VERSION = "3.1.0"
+
+//OpenAPIDoc is an OpenAPI document describing the REST resources of a RawDispatcher.  Only
+//the parts of the specification that seven5 needs are present.
+type OpenAPIDoc struct {
+	OpenAPI    string                  `json:"openapi"`
+	Info       *OpenAPIInfo            `json:"info"`
+	Paths      map[string]*OpenAPIPath `json:"paths"`
+	Components *OpenAPIComponents      `json:"components"`
+	Security   []map[string][]string   `json:"security,omitempty"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+type OpenAPIPath struct {
+	Get        *OpenAPIOperation   `json:"get,omitempty"`
+	Put        *OpenAPIOperation   `json:"put,omitempty"`
+	Post       *OpenAPIOperation   `json:"post,omitempty"`
+	Delete     *OpenAPIOperation   `json:"delete,omitempty"`
+	Parameters []*OpenAPIParameter `json:"parameters,omitempty"`
+}
+
+type OpenAPIOperation struct {
+	OperationId string                      `json:"operationId"`
+	Tags        []string                    `json:"tags,omitempty"`
+	RequestBody *OpenAPIRequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*OpenAPIResponse `json:"responses"`
+}
+
+type OpenAPIParameter struct {
+	Name     string  `json:"name"`
+	In       string  `json:"in"`
+	Required bool    `json:"required"`
+	Schema   *Schema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                     `json:"required"`
+	Content  map[string]*OpenAPIMedia `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                   `json:"description"`
+	Content     map[string]*OpenAPIMedia `json:"content,omitempty"`
+}
+
+type OpenAPIMedia struct {
+	Schema *Schema `json:"schema"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]*Schema                `json:"schemas"`
+	SecuritySchemes map[string]*OpenAPISecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type        string `json:"type"`
+	Scheme      string `json:"scheme,omitempty"`
+	In          string `json:"in,omitempty"`
+	Name        string `json:"name,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+//securitySchemes returns the ways that a request can be authenticated with this dispatcher:
+//the cookie of a RawIOHook, bearer tokens if it has a BearerResolver, and HTTP basic if the
+//Challenge says so.
+func (self *RawDispatcher) securitySchemes() map[string]*OpenAPISecurityScheme {
+	result := make(map[string]*OpenAPISecurityScheme)
+	if io, ok := self.IO.(*RawIOHook); ok {
+		if io.CookieMap != nil {
+			result["cookie"] = &OpenAPISecurityScheme{Type: "apiKey", In: "cookie", Name: io.CookieMap.CookieName(),
+				Description: "session cookie set by logging in"}
+		}
+		if io.Bearer != nil {
+			result["bearer"] = &OpenAPISecurityScheme{Type: "http", Scheme: "bearer"}
+		}
+	}
+	if strings.HasPrefix(self.Challenge, "Basic") {
+		result["basic"] = &OpenAPISecurityScheme{Type: "http", Scheme: "basic"}
+	}
+	return result
+}
+
+func jsonContent(s *Schema) map[string]*OpenAPIMedia {
+	return map[string]*OpenAPIMedia{"application/json": &OpenAPIMedia{Schema: s}}
+}
+
+//operation returns an operation with the responses every seven5 operation can have.
+func (self *RawDispatcher) operation(id string, tag string, success string, desc string, s *Schema) *OpenAPIOperation {
+	result := &OpenAPIOperation{
+		OperationId: id,
+		Tags:        []string{tag},
+		Responses: map[string]*OpenAPIResponse{
+			success: &OpenAPIResponse{Description: desc, Content: jsonContent(s)},
+			"400":   &OpenAPIResponse{Description: "badly formed request"},
+		},
+	}
+	if self.Auth != nil {
+		result.Responses["401"] = &OpenAPIResponse{Description: "not logged in"}
+		result.Responses["403"] = &OpenAPIResponse{Description: "not permitted"}
+	}
+	return result
+}
+
+//OpenAPI returns a description of the resources of this dispatcher.  The paths and
+//operations come from the Rest methods each resource implements and the schemas from the
+//TypeHolder.
+func (self *RawDispatcher) OpenAPI(title string, version string) *OpenAPIDoc {
+	const ref = "#/components/schemas/"
+	doc := &OpenAPIDoc{
+		OpenAPI:    OPENAPI_VERSION,
+		Info:       &OpenAPIInfo{Title: title, Version: version},
+		Paths:      make(map[string]*OpenAPIPath),
+		Components: &OpenAPIComponents{Schemas: make(map[string]*Schema)},
+	}
+	for _, f := range self.All() {
+		for _, s := range collectStructs(f) {
+			if _, ok := doc.Components.Schemas[s.StructName]; !ok && s != f {
+				doc.Components.Schemas[s.StructName] = structSchema(s, ref)
+			}
+		}
+		doc.Components.Schemas[f.Name] = structSchema(f, ref)
+		d, ok := self.Res[strings.ToLower(f.Name)]
+		if !ok {
+			continue
+		}
+		wire := &Schema{Ref: ref + f.Name}
+		body := &OpenAPIRequestBody{Required: true, Content: jsonContent(wire)}
+		collection := &OpenAPIPath{}
+		if d.index != nil {
+			collection.Get = self.operation("index"+f.Name, f.Name, "200", "all the "+f.Name+" visible to the caller",
+				&Schema{Type: "array", Items: wire})
+		}
+		if d.post != nil {
+			collection.Post = self.operation("post"+f.Name, f.Name, "201", "the new "+f.Name, wire)
+			collection.Post.RequestBody = body
+		}
+		single := &OpenAPIPath{Parameters: []*OpenAPIParameter{
+			&OpenAPIParameter{Name: "id", In: "path", Required: true, Schema: fieldSchema(&FieldDescription{TypeName: "Id"}, ref)},
+		}}
+		if d.find != nil {
+			single.Get = self.operation("find"+f.Name, f.Name, "200", "the "+f.Name, wire)
+		}
+		if d.put != nil {
+			single.Put = self.operation("put"+f.Name, f.Name, "200", "the updated "+f.Name, wire)
+			single.Put.RequestBody = body
+		}
+		if d.del != nil {
+			single.Delete = self.operation("delete"+f.Name, f.Name, "200", "the deleted "+f.Name, wire)
+		}
+		for _, op := range []*OpenAPIOperation{single.Get, single.Put, single.Delete} {
+			if op != nil {
+				op.Responses["404"] = &OpenAPIResponse{Description: "no such " + f.Name}
+			}
+		}
+		path := self.Prefix + "/" + strings.ToLower(f.Name)
+		if collection.Get != nil || collection.Post != nil {
+			doc.Paths[path] = collection
+		}
+		if single.Get != nil || single.Put != nil || single.Delete != nil {
+			doc.Paths[path+"/{id}"] = single
+		}
+	}
+	if self.Auth != nil {
+		doc.Components.SecuritySchemes = self.securitySchemes()
+		names := []string{}
+		for name := range doc.Components.SecuritySchemes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			doc.Security = append(doc.Security, map[string][]string{name: []string{}})
+		}
+	}
+	return doc
+}
+
+//OpenAPIContent adds an http handler at urlPath that serves the OpenAPI document of the
+//dispatcher as json.  The document is computed for each request, so resources added later
+//are included.
+func OpenAPIContent(mux *ServeMux, d *RawDispatcher, urlPath string, title string, version string) {
+	mux.HandleFunc(urlPath, openAPIFunc(d, title, version))
+}
+
+//openAPIFunc returns the handler used by OpenAPIContent.
+func openAPIFunc(d *RawDispatcher, title string, version string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d.OpenAPI(title, version)); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write OpenAPI document to the client: %s\n", err)
+		}
+	}
+}
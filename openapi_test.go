@@ -0,0 +1,89 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type ScheduleWire struct {
+	Id        Id
+	Title     String255
+	Notes     Textblob
+	Start     DateTime
+	Weight    Floating
+	Count     Integer
+	Done      Boolean
+	Attendees []Nested
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestOpenAPI(t *testing.T) {
+	disp := NewBaseDispatcher(appName, nil)
+	disp.Resource("NoteWire", &NoteWire{}, &noteStore{notes: make(map[Id]*NoteWire)})
+	log := NewSimpleAuditLog()
+	audit := NewAuditResource(log, nil)
+	disp.ResourceSeparate("AuditWire", &AuditWire{}, audit, audit, nil, nil, nil)
+	disp.ResourceSeparate("ScheduleWire", &ScheduleWire{}, nil, nil, &noteStore{}, nil, nil)
+	disp.UseBearer(NewSimpleAPITokenStore())
+
+	doc := disp.OpenAPI("test api", "1.0")
+	if doc.OpenAPI != OPENAPI_VERSION || doc.Info.Title != "test api" {
+		t.Errorf("bad header: %+v", doc)
+	}
+	notes, single := doc.Paths["/rest/notewire"], doc.Paths["/rest/notewire/{id}"]
+	if notes == nil || notes.Get == nil || notes.Post == nil || single == nil || single.Put == nil || single.Delete == nil {
+		t.Fatalf("expected all the operations of notewire: %+v %+v", notes, single)
+	}
+	if notes.Post.Responses["201"] == nil || notes.Post.RequestBody.Content["application/json"].Schema.Ref != "#/components/schemas/NoteWire" {
+		t.Errorf("bad post: %+v", notes.Post)
+	}
+	if single.Get.Responses["404"] == nil || single.Get.Responses["403"] == nil || single.Parameters[0].Name != "id" {
+		t.Errorf("bad find: %+v", single.Get)
+	}
+	audits := doc.Paths["/rest/auditwire"]
+	if audits == nil || audits.Get == nil || audits.Post != nil || doc.Paths["/rest/auditwire/{id}"].Put != nil {
+		t.Errorf("auditwire is read only: %+v", audits)
+	}
+	if doc.Paths["/rest/schedulewire/{id}"] != nil || doc.Paths["/rest/schedulewire"].Get != nil {
+		t.Errorf("schedulewire only has post")
+	}
+
+	s := doc.Components.Schemas["ScheduleWire"]
+	if s == nil || len(s.Required) != 8 {
+		t.Fatalf("bad schedule schema: %+v", s)
+	}
+	check := func(field string, typ string, format string) {
+		p := s.Properties[field]
+		if p.Type != typ || p.Format != format {
+			t.Errorf("%s should be %s/%s but is %+v", field, typ, format, p)
+		}
+	}
+	check("Id", "integer", "int64")
+	check("Count", "integer", "int64")
+	check("Weight", "number", "double")
+	check("Start", "number", "double")
+	check("Done", "boolean", "")
+	check("Notes", "string", "")
+	if *s.Properties["Title"].MaxLength != 255 || *s.Properties["Id"].Minimum != 0 {
+		t.Errorf("expected String255 to have a max length and Id a minimum")
+	}
+	if a := s.Properties["Attendees"]; a.Type != "array" || a.Items.Ref != "#/components/schemas/Nested" || doc.Components.Schemas["Nested"] == nil {
+		t.Errorf("bad nested array: %+v", a)
+	}
+
+	sec := doc.Components.SecuritySchemes
+	if sec["cookie"] == nil || sec["cookie"].Name != disp.IO.CookieMapper().CookieName() || sec["bearer"] == nil || len(doc.Security) != 2 {
+		t.Errorf("expected cookie and bearer security: %+v %+v", sec, doc.Security)
+	}
+
+	mux := NewServeMux()
+	OpenAPIContent(mux, disp.RawDispatcher, "/openapi.json", "test api", "1.0")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	var served map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &served); err != nil || w.Code != http.StatusOK || served["openapi"] != OPENAPI_VERSION {
+		t.Errorf("bad served document: %d %v %s", w.Code, err, w.Body.String())
+	}
+}
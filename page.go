@@ -1,8 +1,18 @@
 package seven5
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	//RETURN_TO_PARAM is the query (or form) parameter that names the page to go back to after
+	//logging in or out.  It is only honored if it passes ValidReturnTo.
+	RETURN_TO_PARAM = "return_to"
 )
 
 //PageMapper is an interface for expressing the "landing" pages for a particular action in the user application.
@@ -60,3 +70,144 @@ func (self *SimplePageMapper) LogoutLandingPage(conn OauthConnector) string {
 	}
 	return fmt.Sprintf("%s?%s", self.logoutOk, v.Encode())
 }
+
+//AuthOutcome describes the result of a request to the AuthDispatcher.  The Action is "login"
+//or "logout" on success, "error" on failure and "redirect" when the browser has to go to the
+//provider to log in.  Location is where the browser would have been redirected: the provider,
+//the return_to page, or a page of the PageMapper.
+type AuthOutcome struct {
+	Service  string `json:"service"`
+	Action   string `json:"action"`
+	State    string `json:"state,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Location string `json:"location,omitempty"`
+}
+
+//AuthResponder can be implemented by a PageMapper that wants to answer requests to the
+//AuthDispatcher itself rather than have the browser redirected to the Location of the outcome.
+type AuthResponder interface {
+	Respond(outcome *AuthOutcome, w http.ResponseWriter, r *http.Request)
+}
+
+//SPAPageMapper is a PageMapper for single page applications that log in with XHR or in a popup
+//window.  Requests that ask for json (with an Accept header of application/json or an
+//X-Requested-With header) are answered with the AuthOutcome as json; a "redirect" outcome
+//gives the provider URL the application should open.  Other requests, such as the provider
+//sending the popup back to the oauth callback, get a page that posts the AuthOutcome to the
+//window that opened it and then closes.  Messages are only posted to Origin, which should be
+//the origin of the application, such as "https://example.com".  Pages, if not nil, supplies the
+//Location of outcomes.
+type SPAPageMapper struct {
+	Pages  PageMapper
+	Origin string
+}
+
+//NewSPAPageMapper returns a PageMapper that sends outcomes to the application at origin.
+func NewSPAPageMapper(pages PageMapper, origin string) *SPAPageMapper {
+	return &SPAPageMapper{Pages: pages, Origin: origin}
+}
+
+func (self *SPAPageMapper) ErrorPage(conn OauthConnector, errorText string) string {
+	if self.Pages == nil {
+		return ""
+	}
+	return self.Pages.ErrorPage(conn, errorText)
+}
+
+func (self *SPAPageMapper) LoginLandingPage(conn OauthConnector, state string, code string) string {
+	if self.Pages == nil {
+		return ""
+	}
+	return self.Pages.LoginLandingPage(conn, state, code)
+}
+
+func (self *SPAPageMapper) LogoutLandingPage(conn OauthConnector) string {
+	if self.Pages == nil {
+		return ""
+	}
+	return self.Pages.LogoutLandingPage(conn)
+}
+
+//Respond sends the outcome as json or in a page that posts it to the opener.  Errors sent as
+//json have the status 401.
+func (self *SPAPageMapper) Respond(outcome *AuthOutcome, w http.ResponseWriter, r *http.Request) {
+	encoded, err := json.Marshal(outcome)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to encode: %s", err), http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if outcome.Action == "error" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+		w.Write(encoded)
+		return
+	}
+	if outcome.Action == "redirect" {
+		http.Redirect(w, r, outcome.Location, http.StatusFound)
+		return
+	}
+	//json.Marshal escapes <, > and & so the values are safe inside the script
+	origin, _ := json.Marshal(self.Origin)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, postMessagePage, encoded, origin)
+}
+
+const postMessagePage = `<!DOCTYPE html>
+<html><head><title>Logging in</title></head><body><script>
+var outcome = %s;
+if (window.opener) {
+	window.opener.postMessage(outcome, %s);
+	window.close();
+} else if (outcome.location) {
+	window.location.replace(outcome.location);
+}
+</script></body></html>
+`
+
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json") || r.Header.Get("X-Requested-With") != ""
+}
+
+//ValidReturnTo is true if target is a safe page to send the browser to after logging in or
+//out: it must start with one of the allowed prefixes, which are either paths on this site
+//(like "/app/") or absolute URLs (like "https://app.example.com/").  Paths that would be read
+//by browsers as another host, such as "//evil.com" or "/\evil.com", are never allowed, and
+//paths are compared after removing any ".." in them.
+func ValidReturnTo(target string, allowed []string) bool {
+	if target == "" || strings.ContainsAny(target, "\\\r\n\t") {
+		return false
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.User != nil {
+		return false
+	}
+	relative := !u.IsAbs() && u.Host == ""
+	if relative && (!strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//")) {
+		return false
+	}
+	clean := path.Clean("/" + u.Path)
+	if strings.HasSuffix(u.Path, "/") && clean != "/" {
+		clean += "/"
+	}
+	for _, a := range allowed {
+		prefix, err := url.Parse(a)
+		if err != nil {
+			continue
+		}
+		if relative != (!prefix.IsAbs() && prefix.Host == "") {
+			continue
+		}
+		if !relative && (!strings.EqualFold(prefix.Scheme, u.Scheme) || !strings.EqualFold(prefix.Host, u.Host)) {
+			continue
+		}
+		if strings.HasPrefix(clean, prefix.Path) && (strings.HasSuffix(prefix.Path, "/") || len(clean) == len(prefix.Path) ||
+			clean[len(prefix.Path)] == '/') {
+			return true
+		}
+	}
+	return false
+}
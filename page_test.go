@@ -0,0 +1,120 @@
+package seven5
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestValidReturnTo(t *testing.T) {
+	allowed := []string{"/app/", "/home", "https://spa.example.com/"}
+	cases := map[string]bool{
+		"/app/":                         true,
+		"/app/inbox?x=1#top":            true,
+		"/home":                         true,
+		"/home/x":                       true,
+		"/homepage":                     false,
+		"/app/../admin":                 false,
+		"/app/%2e%2e/admin":             false,
+		"//evil.com/app/":               false,
+		"/\\evil.com":                   false,
+		"app/":                          false,
+		"https://spa.example.com/":      true,
+		"https://spa.example.com/a/b":   true,
+		"http://spa.example.com/":       false,
+		"https://spa.example.com.evil/": false,
+		"https://me@spa.example.com/":   false,
+		"javascript:alert(1)":           false,
+		"":                              false,
+		"/app/\r\nSet-Cookie: x=y":      false,
+	}
+	for target, ok := range cases {
+		if ValidReturnTo(target, allowed) != ok {
+			t.Errorf("%q: expected %v", target, ok)
+		}
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestSPAPageMapper(t *testing.T) {
+	store := NewSimpleCredentialStore()
+	pw := NewPasswordAuthenticator(store, &captureNotifier{})
+	pw.Hasher = &BcryptHasher{Cost: bcrypt.MinCost}
+	if _, err := pw.Register("iansmith", "correct horse"); err != nil {
+		t.Fatalf("unable to register: %s", err)
+	}
+
+	mux := NewServeMux()
+	app := httptest.NewServer(mux)
+	defer app.Close()
+	sm := NewSimpleSessionManager()
+	pages := NewSimplePageMapper(three, two, "/loggedout")
+	disp := NewAuthDispatcherRaw("/auth", NewSPAPageMapper(pages, "https://spa.example.com"), NewSimpleCookieMapper(appName), sm)
+	disp.ReturnTo = []string{"/app/"}
+	disp.AddPasswordAuthenticator(pw, mux)
+
+	client := new(http.Client)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return stopProcessing
+	}
+	post := func(path string, v url.Values, xhr bool) (*http.Response, string) {
+		req, _ := http.NewRequest("POST", app.URL+path, strings.NewReader(v.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if xhr {
+			req.Header.Set("Accept", "application/json")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %s", err)
+		}
+		b, _ := ioutil.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+	decode := func(body string) *AuthOutcome {
+		outcome := &AuthOutcome{}
+		if err := json.Unmarshal([]byte(body), outcome); err != nil {
+			t.Fatalf("bad json %q: %s", body, err)
+		}
+		return outcome
+	}
+
+	resp, body := post("/auth/local/login", url.Values{"username": {"iansmith"}, "password": {"wrong horse"}}, true)
+	if o := decode(body); resp.StatusCode != http.StatusUnauthorized || o.Action != "error" || o.Error == "" {
+		t.Errorf("expected json error but got %s %+v", resp.Status, o)
+	}
+	resp, body = post("/auth/local/login", url.Values{"username": {"iansmith"}, "password": {"correct horse"},
+		"state": {"s1"}, RETURN_TO_PARAM: {"/app/inbox"}}, true)
+	o := decode(body)
+	if resp.StatusCode != http.StatusOK || o.Action != "login" || o.State != "s1" || o.Location != "/app/inbox" || len(resp.Cookies()) == 0 {
+		t.Errorf("expected json login to /app/inbox but got %s %+v", resp.Status, o)
+	}
+	resp, body = post("/auth/local/login", url.Values{"username": {"iansmith"}, "password": {"correct horse"},
+		RETURN_TO_PARAM: {"https://evil.com/app/"}}, true)
+	if o := decode(body); !strings.HasPrefix(o.Location, two) {
+		t.Errorf("expected return_to not on the allow-list to be ignored: %+v", o)
+	}
+
+	//without json, the outcome goes to the window that opened the popup
+	resp, body = post("/auth/local/login", url.Values{"username": {"iansmith"}, "password": {"correct horse"}}, false)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, `postMessage(outcome, "https://spa.example.com")`) ||
+		!strings.Contains(body, `"action":"login"`) {
+		t.Errorf("expected post message page but got %s %s", resp.Status, body)
+	}
+
+	//the allow-list also works with the ordinary redirects
+	disp.PageMap = pages
+	req, _ := http.NewRequest("GET", app.URL+"/auth/local/logout?return_to=/app/bye", nil)
+	resp, err := client.Do(req)
+	if err != nil && !strings.Contains(err.Error(), stopProcessing.Error()) {
+		t.Fatalf("logout failed: %s", err)
+	}
+	if resp.Header.Get("Location") != "/app/bye" {
+		t.Errorf("expected logout to go to return_to but got %s", resp.Header.Get("Location"))
+	}
+}
@@ -0,0 +1,338 @@
+package seven5
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	PASSWORD_CONNECTOR_NAME = "local"
+	PASSWORD_MIN_LENGTH     = 8
+	//PASSWORD_MAX_LENGTH is in bytes; bcrypt ignores everything after the 72nd byte.
+	PASSWORD_MAX_LENGTH      = 72
+	PASSWORD_MAX_FAILURES    = 5
+	PASSWORD_LOCKOUT         = 15 * time.Minute
+	PASSWORD_RESET_TOKEN_TTL = time.Hour
+)
+
+var (
+	NO_SUCH_ACCOUNT      = errors.New("No account with that username")
+	ACCOUNT_EXISTS       = errors.New("An account with that username already exists")
+	BAD_PASSWORD         = errors.New("Username or password is incorrect")
+	BAD_RESET_TOKEN      = errors.New("Password reset token is not valid (or it has expired)")
+	NO_PASSWORD_LOGIN    = errors.New("Local accounts log in with a username and password, not a redirect")
+	NO_REMOTE_CONNECTION = errors.New("Local accounts are not connected to a remote service")
+)
+
+//PasswordHasher turns passwords into something safe to store and checks passwords against
+//what was stored.  Compare returns nil only if the password matches.  The default is
+//BcryptHasher; implement this to use argon2 or scrypt instead.
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	Compare(hash string, password string) error
+}
+
+//BcryptHasher is a PasswordHasher using bcrypt with the given cost.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (self *BcryptHasher) Hash(password string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), self.Cost)
+	return string(h), err
+}
+
+func (self *BcryptHasher) Compare(hash string, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+//PasswordAccount is what a CredentialStore keeps about each local user.  Hash is the output
+//of a PasswordHasher, never the password itself.
+type PasswordAccount struct {
+	Username    string
+	Hash        string
+	Failures    int
+	LockedUntil time.Time
+}
+
+//CredentialStore holds local accounts.  Lookup returns NO_SUCH_ACCOUNT for unknown users and
+//Create returns ACCOUNT_EXISTS if the username is taken.  Implementations must be safe
+//to call from multiple goroutines.
+type CredentialStore interface {
+	Lookup(username string) (*PasswordAccount, error)
+	Create(account *PasswordAccount) error
+	Update(account *PasswordAccount) error
+}
+
+//SimpleCredentialStore is a CredentialStore that keeps accounts in memory.
+type SimpleCredentialStore struct {
+	sync.Mutex
+	accounts map[string]*PasswordAccount
+}
+
+//NewSimpleCredentialStore returns an empty, in-memory CredentialStore.
+func NewSimpleCredentialStore() *SimpleCredentialStore {
+	return &SimpleCredentialStore{accounts: make(map[string]*PasswordAccount)}
+}
+
+//Lookup returns a copy of the account so callers can't change the store without Update.
+func (self *SimpleCredentialStore) Lookup(username string) (*PasswordAccount, error) {
+	self.Lock()
+	defer self.Unlock()
+	a, ok := self.accounts[username]
+	if !ok {
+		return nil, NO_SUCH_ACCOUNT
+	}
+	result := *a
+	return &result, nil
+}
+
+func (self *SimpleCredentialStore) Create(account *PasswordAccount) error {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.accounts[account.Username]; ok {
+		return ACCOUNT_EXISTS
+	}
+	a := *account
+	self.accounts[account.Username] = &a
+	return nil
+}
+
+func (self *SimpleCredentialStore) Update(account *PasswordAccount) error {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.accounts[account.Username]; !ok {
+		return NO_SUCH_ACCOUNT
+	}
+	a := *account
+	self.accounts[account.Username] = &a
+	return nil
+}
+
+//ResetNotifier delivers password reset tokens to users, typically by email.  The application
+//is expected to send the user a link to a page that posts the token and a new password to
+//the resetconfirm URL.
+type ResetNotifier interface {
+	SendReset(username string, token string) error
+}
+
+//PasswordConnection is the OauthConnection given to SessionManager.Generate when a user logs
+//in with a local account.  There is no remote service, so SendAuthenticated always fails.
+type PasswordConnection struct {
+	Username string
+}
+
+func (self *PasswordConnection) SendAuthenticated(r *http.Request) (*http.Response, error) {
+	return nil, NO_REMOTE_CONNECTION
+}
+
+//PasswordAuthenticator authenticates users with a username and password kept in a
+//CredentialStore.  It is an OauthConnector (named "local") so that it can share the
+//PageMapper, CookieMapper and SessionManager of an AuthDispatcher; use
+//AuthDispatcher.AddPasswordAuthenticator to map it.  After MaxFailures bad passwords in a
+//row an account is locked for Lockout, even to the correct password.  A locked account
+//answers BAD_PASSWORD, like an unknown user, so the lock does not show the account exists.
+//Passwords longer than MaxLength bytes (if it is not zero) can't be set or used.
+type PasswordAuthenticator struct {
+	Store       CredentialStore
+	Hasher      PasswordHasher
+	Notifier    ResetNotifier
+	MinLength   int
+	MaxLength   int
+	MaxFailures int
+	Lockout     time.Duration
+	lock        sync.Mutex
+	resets      *expiringMap
+	dummy       string
+}
+
+//NewPasswordAuthenticator returns a PasswordAuthenticator that hashes with bcrypt and uses
+//the default limits.  The notifier may be nil if password resets are not wanted.
+func NewPasswordAuthenticator(store CredentialStore, notifier ResetNotifier) *PasswordAuthenticator {
+	return &PasswordAuthenticator{
+		Store:       store,
+		Hasher:      &BcryptHasher{Cost: bcrypt.DefaultCost},
+		Notifier:    notifier,
+		MinLength:   PASSWORD_MIN_LENGTH,
+		MaxLength:   PASSWORD_MAX_LENGTH,
+		MaxFailures: PASSWORD_MAX_FAILURES,
+		Lockout:     PASSWORD_LOCKOUT,
+		resets:      newExpiringMap(PASSWORD_RESET_TOKEN_TTL),
+	}
+}
+
+//Register creates an account.  The password is hashed before it reaches the store.
+func (self *PasswordAuthenticator) Register(username string, password string) (OauthConnection, error) {
+	if username == "" {
+		return nil, errors.New("A username is required")
+	}
+	if err := self.checkLength(password); err != nil {
+		return nil, err
+	}
+	h, err := self.Hasher.Hash(password)
+	if err != nil {
+		return nil, err
+	}
+	if err := self.Store.Create(&PasswordAccount{Username: username, Hash: h}); err != nil {
+		return nil, err
+	}
+	return &PasswordConnection{Username: username}, nil
+}
+
+//Authenticate checks a username and password.  Unknown users and wrong passwords produce
+//the same error (and take about the same time) so that the login form can't be used to
+//discover usernames.
+func (self *PasswordAuthenticator) Authenticate(username string, password string) (OauthConnection, error) {
+	account, err := self.Store.Lookup(username)
+	if err == NO_SUCH_ACCOUNT {
+		self.Hasher.Compare(self.dummyHash(), password)
+		return nil, BAD_PASSWORD
+	}
+	if err != nil {
+		return nil, err
+	}
+	//hashing is slow on purpose, so only the bookkeeping is done holding the lock; the hash
+	//is compared even when the account is locked so that every failure takes as long
+	ok := self.Hasher.Compare(account.Hash, password) == nil && !self.tooLong(password)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if account, err = self.Store.Lookup(username); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if now.Before(account.LockedUntil) {
+		return nil, BAD_PASSWORD
+	}
+	if !ok {
+		account.Failures++
+		if self.MaxFailures > 0 && account.Failures >= self.MaxFailures {
+			account.Failures = 0
+			account.LockedUntil = now.Add(self.Lockout)
+		}
+		if err := self.Store.Update(account); err != nil {
+			return nil, err
+		}
+		return nil, BAD_PASSWORD
+	}
+	if account.Failures != 0 {
+		account.Failures = 0
+		if err := self.Store.Update(account); err != nil {
+			return nil, err
+		}
+	}
+	return &PasswordConnection{Username: username}, nil
+}
+
+//checkLength returns an error if password is too short or too long to be set.
+func (self *PasswordAuthenticator) checkLength(password string) error {
+	if len(password) < self.MinLength {
+		return errors.New(fmt.Sprintf("Password must be at least %d characters", self.MinLength))
+	}
+	if self.tooLong(password) {
+		return errors.New(fmt.Sprintf("Password must be at most %d bytes", self.MaxLength))
+	}
+	return nil
+}
+
+func (self *PasswordAuthenticator) tooLong(password string) bool {
+	return self.MaxLength > 0 && len(password) > self.MaxLength
+}
+
+//dummyHash is a hash of nothing in particular, compared against when the user is unknown.
+func (self *PasswordAuthenticator) dummyHash() string {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.dummy == "" {
+		self.dummy, _ = self.Hasher.Hash("not a password anyone has")
+	}
+	return self.dummy
+}
+
+//StartReset creates a single use token for changing the password of username and hands it
+//to the Notifier.  Nothing is sent for unknown users, but no error is returned either.
+func (self *PasswordAuthenticator) StartReset(username string) error {
+	if self.Notifier == nil {
+		return errors.New("Password reset is not available")
+	}
+	if _, err := self.Store.Lookup(username); err != nil {
+		if err == NO_SUCH_ACCOUNT {
+			return nil
+		}
+		return err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	self.resets.Put(token, username)
+	return self.Notifier.SendReset(username, token)
+}
+
+//FinishReset sets a new password for the user that token was issued to.  This also unlocks
+//the account, since the user has proven they can read its mail.
+func (self *PasswordAuthenticator) FinishReset(token string, password string) (OauthConnection, error) {
+	if err := self.checkLength(password); err != nil {
+		return nil, err
+	}
+	u, ok := self.resets.Take(token)
+	if !ok {
+		return nil, BAD_RESET_TOKEN
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	account, err := self.Store.Lookup(u.(string))
+	if err != nil {
+		return nil, err
+	}
+	if account.Hash, err = self.Hasher.Hash(password); err != nil {
+		return nil, err
+	}
+	account.Failures = 0
+	account.LockedUntil = time.Time{}
+	if err := self.Store.Update(account); err != nil {
+		return nil, err
+	}
+	return &PasswordConnection{Username: account.Username}, nil
+}
+
+//Name returns "local".
+func (self *PasswordAuthenticator) Name() string {
+	return PASSWORD_CONNECTOR_NAME
+}
+
+func (self *PasswordAuthenticator) StateValueName() string {
+	return "state"
+}
+
+func (self *PasswordAuthenticator) ClientTokenValueName() string {
+	return "username"
+}
+
+func (self *PasswordAuthenticator) CodeValueName() string {
+	return "password"
+}
+
+func (self *PasswordAuthenticator) ErrorValueName() string {
+	return "error"
+}
+
+//Phase1 is part of the OauthConnector interface but local logins don't redirect anywhere.
+func (self *PasswordAuthenticator) Phase1(state string, callbackPath string) (OauthCred, error) {
+	return nil, NO_PASSWORD_LOGIN
+}
+
+func (self *PasswordAuthenticator) UserInteractionURL(p1creds OauthCred, state string, callbackPath string) string {
+	return ""
+}
+
+//Phase2 authenticates with the username as the client token and the password as the code.
+func (self *PasswordAuthenticator) Phase2(username string, password string) (OauthConnection, error) {
+	return self.Authenticate(username, password)
+}
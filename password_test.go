@@ -0,0 +1,128 @@
+package seven5
+
+import (
+	"code.google.com/p/go.crypto/bcrypt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+//captureNotifier remembers the last reset token instead of mailing it.
+type captureNotifier struct {
+	username string
+	token    string
+}
+
+func (self *captureNotifier) SendReset(username string, token string) error {
+	self.username = username
+	self.token = token
+	return nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func postFormAndDo(t *testing.T, client *http.Client, targ string, v url.Values) *http.Response {
+	resp, err := client.PostForm(targ, v)
+	if err != nil {
+		if uerr, ok := err.(*url.Error); !ok || uerr.Err != stopProcessing {
+			t.Fatalf("failed to post to %s: %s", targ, err)
+		}
+	}
+	return resp
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestPasswordLogin(t *testing.T) {
+	store := NewSimpleCredentialStore()
+	notifier := &captureNotifier{}
+	pw := NewPasswordAuthenticator(store, notifier)
+	pw.Hasher = &BcryptHasher{Cost: bcrypt.MinCost}
+	pw.MaxFailures = 3
+
+	mux := NewServeMux()
+	app := httptest.NewServer(mux)
+	defer app.Close()
+	sm := &claimSessionManager{SimpleSessionManager: NewSimpleSessionManager()}
+	disp := NewAuthDispatcherRaw("/auth", NewSimplePageMapper(three, two, "notused"), NewSimpleCookieMapper(appName), sm)
+	disp.AddPasswordAuthenticator(pw, mux)
+
+	client := new(http.Client)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return stopProcessing
+	}
+	login := func(user string, pass string) *http.Response {
+		sm.conn = nil
+		return postFormAndDo(t, client, app.URL+"/auth/local/login?state=s",
+			url.Values{"username": {user}, "password": {pass}})
+	}
+	landed := func(resp *http.Response, page string) bool {
+		return strings.HasPrefix(resp.Header.Get("Location"), page)
+	}
+
+	resp := postFormAndDo(t, client, app.URL+"/auth/local/register",
+		url.Values{"username": {"iansmith"}, "password": {"short"}})
+	if !landed(resp, three) {
+		t.Errorf("short password should be rejected: %s", resp.Header.Get("Location"))
+	}
+	resp = postFormAndDo(t, client, app.URL+"/auth/local/register",
+		url.Values{"username": {"iansmith"}, "password": {"correct horse"}})
+	if !landed(resp, two) || len(resp.Cookies()) == 0 {
+		t.Errorf("register should log in: %s %v", resp.Header.Get("Location"), resp.Cookies())
+	}
+	resp = postFormAndDo(t, client, app.URL+"/auth/local/register",
+		url.Values{"username": {"toolong"}, "password": {strings.Repeat("x", PASSWORD_MAX_LENGTH+1)}})
+	if !landed(resp, three) {
+		t.Errorf("password longer than bcrypt uses should be rejected: %s", resp.Header.Get("Location"))
+	}
+	if a, _ := store.Lookup("iansmith"); a.Hash == "correct horse" {
+		t.Errorf("password stored in the clear")
+	}
+
+	resp = login("iansmith", "correct horse")
+	if !landed(resp, two) || strings.Contains(resp.Header.Get("Location"), "horse") {
+		t.Errorf("expected login to land on %s without the password but got %s", two, resp.Header.Get("Location"))
+	}
+	if pc, ok := sm.conn.(*PasswordConnection); !ok || pc.Username != "iansmith" {
+		t.Errorf("session manager should be given the user's connection but got %+v", sm.conn)
+	}
+	if resp = login("nobody", "correct horse"); !landed(resp, three) || sm.conn != nil {
+		t.Errorf("unknown user logged in: %s", resp.Header.Get("Location"))
+	}
+	resp, _ = client.Get(app.URL + "/auth/local/login?username=iansmith&password=correct+horse")
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("logins must be posted but got %s", resp.Status)
+	}
+
+	//three strikes locks the account even against the right password
+	for i := 0; i < 3; i++ {
+		if resp = login("iansmith", "wrong"); !landed(resp, three) {
+			t.Errorf("wrong password accepted: %s", resp.Header.Get("Location"))
+		}
+	}
+	//the locked account fails just like an unknown user, so it does not reveal the username
+	unknown := login("nobody", "correct horse").Header.Get("Location")
+	resp = login("iansmith", "correct horse")
+	if !landed(resp, three) || sm.conn != nil || resp.Header.Get("Location") != unknown {
+		t.Errorf("expected locked account to fail like an unknown user (%s) but got %s", unknown, resp.Header.Get("Location"))
+	}
+
+	//reset unlocks and changes the password, and the token only works once
+	resp = postFormAndDo(t, client, app.URL+"/auth/local/reset", url.Values{"username": {"iansmith"}})
+	if resp.StatusCode != http.StatusNoContent || notifier.username != "iansmith" || notifier.token == "" {
+		t.Fatalf("reset not sent: %s %+v", resp.Status, notifier)
+	}
+	confirm := url.Values{"token": {notifier.token}, "password": {"battery staple"}}
+	if resp = postFormAndDo(t, client, app.URL+"/auth/local/resetconfirm", confirm); !landed(resp, two) {
+		t.Errorf("reset failed: %s", resp.Header.Get("Location"))
+	}
+	if resp = postFormAndDo(t, client, app.URL+"/auth/local/resetconfirm", confirm); !landed(resp, three) {
+		t.Errorf("reset token reused: %s", resp.Header.Get("Location"))
+	}
+	if resp = login("iansmith", "correct horse"); !landed(resp, three) {
+		t.Errorf("old password still works")
+	}
+	if resp = login("iansmith", "battery staple"); !landed(resp, two) {
+		t.Errorf("new password rejected: %s", resp.Header.Get("Location"))
+	}
+}
@@ -20,6 +20,18 @@ type simplePBundle struct {
 	q map[string]string
 	s Session
 	out map[string] string
+	scoped bool
+	scopes []string
+}
+
+//Scoped is true if the bundle was created by NewScopedPBundle.
+func (self *simplePBundle) Scoped() bool {
+	return self.scoped
+}
+
+//Scopes returns the scopes given to NewScopedPBundle.
+func (self *simplePBundle) Scopes() []string {
+	return self.scopes
 }
 
 func (self *simplePBundle) ReturnHeaders() []string {
@@ -63,6 +75,19 @@ func NewSimplePBundle(r *http.Request, s Session) (PBundle,error) {
 	}, nil
 }
 
+//NewScopedPBundle returns a PBundle (that is also a ScopedBundle) for a request that may
+//only act within the given scopes, typically because it was authenticated with a token.
+func NewScopedPBundle(r *http.Request, s Session, scopes []string) (PBundle,error) {
+	pb, err := NewSimplePBundle(r, s)
+	if err != nil {
+		return nil, err
+	}
+	spb := pb.(*simplePBundle)
+	spb.scoped = true
+	spb.scopes = scopes
+	return spb, nil
+}
+
 
 
 //ToSimpleMap converts an http level map with multiple strings as value to single string value.
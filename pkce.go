@@ -0,0 +1,128 @@
+package seven5
+
+import (
+	oauth2 "code.google.com/p/goauth2/oauth"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	PKCE_METHOD = "S256"
+	//PKCE_VERIFIER_TTL is how long a user has to complete the interaction with the provider
+	//before the verifier generated at login is forgotten.
+	PKCE_VERIFIER_TTL = 10 * time.Minute
+)
+
+//NewPKCEVerifier returns a new, random code verifier.  This is 32 bytes from the system's
+//secure random source encoded as unpadded base64url, so it is 43 characters long which is
+//the minimum allowed by RFC 7636.
+func NewPKCEVerifier() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+//PKCEChallenge computes the S256 code challenge for a verifier.  This is the value that is
+//sent to the provider's authorization endpoint; the verifier itself is only sent to the
+//token endpoint.
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//addChallenge adds the code_challenge parameters to an authorization URL.
+func addChallenge(authURL string, challenge string) string {
+	u, err := url.Parse(authURL)
+	if err != nil {
+		panic(fmt.Sprintf("unable to understand our own authorization url %s: %s", authURL, err))
+	}
+	q := u.Query()
+	q.Set("code_challenge", challenge)
+	q.Set("code_challenge_method", PKCE_METHOD)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+//tokenResponse is the json body returned by an oauth2 token endpoint, either for success or
+//failure.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	IdToken      string `json:"id_token"`
+	Error        string `json:"error"`
+	ErrorDesc    string `json:"error_description"`
+}
+
+//exchangeWithVerifier does the authorization code exchange with the token endpoint of cfg,
+//including the PKCE code verifier.  The goauth2 Transport has no way to add parameters to the
+//exchange so we do it ourselves and hand the resulting token to the transport.  The client
+//secret is only sent if there is one, since public clients don't have one.
+func exchangeWithVerifier(cfg *oauth2.Config, code string, verifier string) (*oauth2.Token, error) {
+	v := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"client_id":     {cfg.ClientId},
+		"code_verifier": {verifier},
+	}
+	if cfg.ClientSecret != "" {
+		v.Set("client_secret", cfg.ClientSecret)
+	}
+	return postTokenRequest(cfg.TokenURL, v)
+}
+
+//postTokenRequest sends the form v to an oauth2 token endpoint and converts the result to a
+//goauth2 Token.  The id_token, if any, is placed in the Extra map of the token, as goauth2 does.
+func postTokenRequest(tokenURL string, v url.Values) (*oauth2.Token, error) {
+	req, err := http.NewRequest("POST", tokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var tr tokenResponse
+	if err := json.Unmarshal(body, &tr); err != nil {
+		return nil, errors.New(fmt.Sprintf("token endpoint returned %s with unreadable body: %s", resp.Status, err))
+	}
+	if tr.Error != "" {
+		return nil, errors.New(fmt.Sprintf("token endpoint refused exchange: %s %s", tr.Error, tr.ErrorDesc))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("token endpoint returned %s", resp.Status))
+	}
+	if tr.AccessToken == "" {
+		return nil, errors.New("token endpoint returned no access token")
+	}
+	tok := &oauth2.Token{
+		AccessToken:  tr.AccessToken,
+		RefreshToken: tr.RefreshToken,
+	}
+	if tr.ExpiresIn != 0 {
+		tok.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	if tr.IdToken != "" {
+		tok.Extra = map[string]string{"id_token": tr.IdToken}
+	}
+	return tok, nil
+}
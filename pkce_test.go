@@ -0,0 +1,116 @@
+package seven5
+
+import (
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestPKCEChallenge(t *testing.T) {
+	//this is the example from appendix B of RFC 7636
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	expected := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if c := PKCEChallenge(verifier); c != expected {
+		t.Errorf("wrong challenge for RFC verifier: expected %s but got %s", expected, c)
+	}
+	v1, err := NewPKCEVerifier()
+	if err != nil {
+		t.Fatalf("unable to create verifier: %s", err)
+	}
+	v2, _ := NewPKCEVerifier()
+	if len(v1) != 43 || v1 == v2 {
+		t.Errorf("bad verifiers generated: '%s' and '%s'", v1, v2)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestGooglePKCE(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	code := "tootsie pop"
+	st := "how many licks?"
+	var challenge string
+	exchanged := 0
+
+	//stand-in for the google token endpoint that insists on a matching verifier
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.Form.Get("code") != code || PKCEChallenge(r.Form.Get("code_verifier")) != challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		exchanged++
+		fmt.Fprintf(w, `{"access_token":"abc","expires_in":3600}`)
+	}))
+	defer provider.Close()
+
+	mux := NewServeMux()
+	app := httptest.NewServer(mux)
+	defer app.Close()
+
+	deploy := NewMockDeploymentEnvironment(ctrl)
+	deploy.EXPECT().RedirectHost(gomock.Any()).Return(app.URL)
+	detail := NewMockOauthClientDetail(ctrl)
+	detail.EXPECT().ClientId(gomock.Any()).Return(id)
+	detail.EXPECT().ClientSecret(gomock.Any()).Return("")
+	google := NewGoogleOauth2(SCOPE, PROMPT, detail, deploy)
+	google.cfg.TokenURL = provider.URL + "/token"
+
+	cm := NewSimpleCookieMapper(appName)
+	disp := NewAuthDispatcherRaw("/auth", NewSimplePageMapper(three, two, "notused"), cm,
+		NewSimpleSessionManager())
+	disp.AddConnector(google, mux)
+
+	client := new(http.Client)
+	client.Jar, _ = cookiejar.New(nil)
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return stopProcessing
+	}
+
+	//login should send us to google with the challenge
+	loginURL := fmt.Sprintf("%s/auth/google/login?%s", app.URL, url.Values{"state": {st}}.Encode())
+	resp := createReqAndDo(t, client, loginURL, nil)
+	loc, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("can't understand location of login redirect: %s", err)
+	}
+	challenge = loc.Query().Get("code_challenge")
+	if challenge == "" || loc.Query().Get("code_challenge_method") != PKCE_METHOD {
+		t.Fatalf("expected PKCE parameters in login redirect: %s", loc)
+	}
+
+	//the state is known to whoever made the login link, so a callback from another browser
+	//must not be able to use the verifier
+	cb := fmt.Sprintf("%s/auth/google/oauth2callback?%s", app.URL, url.Values{"state": {st}, "code": {code}}.Encode())
+	stranger := &http.Client{CheckRedirect: client.CheckRedirect}
+	resp = createReqAndDo(t, stranger, cb, nil)
+	if !strings.HasPrefix(resp.Header.Get("Location"), three) || exchanged != 0 {
+		t.Errorf("expected callback without the login cookie to fail but got %s", resp.Header.Get("Location"))
+	}
+
+	//callback with the right state should exchange with the verifier and log us in
+	resp = createReqAndDo(t, client, cb, nil)
+	if !strings.HasPrefix(resp.Header.Get("Location"), two) {
+		t.Errorf("expected to land on login page but got %s", resp.Header.Get("Location"))
+	}
+	if exchanged != 1 || resp.Header.Get("Set-Cookie") == "" {
+		t.Errorf("expected a successful exchange (%d) and a cookie: %v", exchanged, resp.Header)
+	}
+
+	//the verifier is single use, so a replay of the callback must fail
+	resp = createReqAndDo(t, client, cb, nil)
+	if !strings.HasPrefix(resp.Header.Get("Location"), three) {
+		t.Errorf("expected to land on error page but got %s", resp.Header.Get("Location"))
+	}
+	if exchanged != 1 {
+		t.Errorf("replayed callback should not reach the token endpoint")
+	}
+}
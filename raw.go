@@ -38,6 +38,15 @@ type RawDispatcher struct {
 	Auth       Authorizer
 	Prefix     string
 	Holder     TypeHolder
+	//Challenge, if not "", is sent as the WWW-Authenticate header of 401 responses to
+	//requests that the Authorizer decides are UNAUTHENTICATED.
+	Challenge string
+	//Audit, if not nil, is given an AuditEntry for every successful POST, PUT and DELETE.
+	//The object before a PUT or DELETE is fetched with the resource's Find, if it has one.
+	//Find is called with the bundle of the request, so it runs (with any side effects) once
+	//more for each audited PUT and DELETE, and it may filter or refuse as it would for the
+	//caller; if it refuses, the entry has no values from before the change.
+	Audit AuditSink
 }
 
 //ResourceSeparate adds a resource type to this dispatcher with each of the Rest methods 
@@ -55,16 +64,26 @@ func (self *RawDispatcher) ResourceSeparate(name string, wireExample interface{}
 		panic("wire example is not a pointer to a struct (but is a pointer)")
 	}
 
+	fields, err := fieldRules(under)
+	if err != nil {
+		panic(err.Error())
+	}
+
 	self.Add(name,wireExample)
 
 	obj := &restObj{
-		t:     under,
-		name:  name,
-		index: index,
-		find:  find,
-		del:   del,
-		post:  post,
-		put:   put,
+		t:      under,
+		name:   name,
+		index:  index,
+		find:   find,
+		del:    del,
+		post:   post,
+		put:    put,
+		fields: fields,
+	}
+	obj.nulls = checksNulls(under)
+	if desc := WalkWireType(name, t); obj.nulls || hasEnum(desc) {
+		obj.desc = desc
 	}
 	self.Res[strings.ToLower(name)] = obj
 }
@@ -102,15 +121,22 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 
 	//compute the parameter bundle
 	bundle, err := self.IO.BundleHook(w, r, self.SessionMgr)
+	if err == BAD_BEARER_TOKEN {
+		w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil
+	}
 	if err != nil {
 		http.Error(w, fmt.Sprintf("can't create or destroy session:%s", err), http.StatusInternalServerError)
 		return nil
 	}
 
-	//pull anything from the body that's there
-	body, err := self.IO.BodyHook(r, d)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("badly formed body data: %s", err), http.StatusBadRequest)
+	//pull anything from the body that's there; a body that breaks the rules of the wire
+	//type is only refused once the request is authorized, so a caller who is not logged
+	//in is told that first
+	body, bodyErr := self.IO.BodyHook(r, d, bundle)
+	if _, ok := bodyErr.(*Error); !ok && bodyErr != nil {
+		http.Error(w, fmt.Sprintf("badly formed body data: %s", bodyErr), http.StatusBadRequest)
 		return nil
 	}
 
@@ -134,15 +160,16 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 				http.Error(w, "Not implemented (INDEX)", http.StatusNotImplemented)
 				return nil
 			}
-			if self.Auth != nil && !self.Auth.Index(d, bundle) {
-				//typically trips the error dispatcher
-				http.Error(w, "Not authorized (INDEX)", http.StatusUnauthorized)
+			if self.Auth != nil && !self.authorized(self.Auth.Index(d, bundle), "INDEX", w) {
 				return nil
 			}
 			result, err := d.index.Index(bundle)
 			if err != nil {
 				self.SendError(err, w, "Internal error on Index")
 			} else {
+				if rf, ok := d.index.(RowFilter); ok {
+					result = filterRows(rf, result, bundle)
+				}
 				//go through encoding
 				self.IO.SendHook(d, w, bundle, result, "")
 			}
@@ -153,14 +180,14 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 				http.Error(w, "Not implemented (FIND)", http.StatusNotImplemented)
 				return nil
 			}
-			if self.Auth != nil && !self.Auth.Find(d, num, bundle) {
-				//typically trips the error dispatcher
-				http.Error(w, "Not authorized (FIND)", http.StatusUnauthorized)
+			if self.Auth != nil && !self.authorized(self.Auth.Find(d, num, bundle), "FIND", w) {
 				return nil
 			}
 			result, err := d.find.Find(num, bundle)
 			if err != nil {
 				self.SendError(err, w, "Internal error on Find")
+			} else if rf, ok := d.find.(RowFilter); ok && result != nil && !rf.AllowRow(result, bundle) {
+				http.Error(w, "Not found", http.StatusNotFound)
 			} else {
 				self.IO.SendHook(d, w, bundle, result, "")
 			}
@@ -175,14 +202,20 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 			http.Error(w, "Not implemented (POST)", http.StatusNotImplemented)
 			return nil
 		}
-		if self.Auth != nil && !self.Auth.Post(d, bundle) {
-			http.Error(w, "Not authorized (POST)", http.StatusUnauthorized)
+		if self.Auth != nil && !self.authorized(self.Auth.Post(d, bundle), "POST", w) {
+			return nil
+		}
+		if bodyErr != nil {
+			self.SendError(bodyErr, w, "")
 			return nil
 		}
 		result, err := d.post.Post(body, bundle)
 		if err != nil {
 			self.SendError(err, w, "Internal error on Post")
 		} else {
+			if self.Audit != nil {
+				self.audit(r, d, method, num, nil, result, bundle)
+			}
 			self.IO.SendHook(d, w, bundle, result, self.location(d, result))
 		}
 		return nil
@@ -196,14 +229,21 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 				http.Error(w, "Not implemented (PUT)", http.StatusNotImplemented)
 				return nil
 			}
-			if self.Auth != nil && !self.Auth.Put(d, num, bundle) {
-				http.Error(w, "Not authorized (PUT)", http.StatusUnauthorized)
+			if self.Auth != nil && !self.authorized(self.Auth.Put(d, num, bundle), "PUT", w) {
 				return nil
 			}
+			if bodyErr != nil {
+				self.SendError(bodyErr, w, "")
+				return nil
+			}
+			before := self.auditBefore(d, num, bundle)
 			result, err := d.put.Put(num, body, bundle)
 			if err != nil {
 				self.SendError(err, w, "Internal error on Put")
 			} else {
+				if self.Audit != nil {
+					self.audit(r, d, method, num, before, result, bundle)
+				}
 				self.IO.SendHook(d, w, bundle, result, "")
 			}
 		} else {
@@ -211,14 +251,17 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 				http.Error(w, "Not implemented (DELETE)", http.StatusNotImplemented)
 				return nil
 			}
-			if self.Auth != nil && !self.Auth.Delete(d, num, bundle) {
-				http.Error(w, "Not authorized (DELETE)", http.StatusUnauthorized)
+			if self.Auth != nil && !self.authorized(self.Auth.Delete(d, num, bundle), "DELETE", w) {
 				return nil
 			}
+			before := self.auditBefore(d, num, bundle)
 			result, err := d.del.Delete(num, bundle)
 			if err != nil {
 				self.SendError(err, w, "Internal error on Delete")
 			} else {
+				if self.Audit != nil {
+					self.audit(r, d, method, num, before, nil, bundle)
+				}
 				self.IO.SendHook(d, w, bundle, result, "")
 			}
 		}
@@ -227,6 +270,25 @@ func (self *RawDispatcher) Dispatch(mux *ServeMux, w http.ResponseWriter, r *htt
 	panic("should not be able to reach here, probably bad method? from bad client?")
 }
 
+//authorized sends the refusal if the decision is not ALLOW: a 401 (with the Challenge) for
+//UNAUTHENTICATED and a 403 for FORBIDDEN.  The text of a 401 starts with "Not authorized".
+func (self *RawDispatcher) authorized(dec Decision, method string, w http.ResponseWriter) bool {
+	if dec.Allowed() {
+		return true
+	}
+	msg := fmt.Sprintf("Not authorized (%s)", method)
+	if dec.Kind != UNAUTHENTICATED {
+		msg = fmt.Sprintf("Forbidden (%s)", method)
+	} else if self.Challenge != "" {
+		w.Header().Set("WWW-Authenticate", self.Challenge)
+	}
+	if dec.Reason != "" {
+		msg += ": " + dec.Reason
+	}
+	http.Error(w, msg, dec.StatusCode())
+	return false
+}
+
 func (self *RawDispatcher) SendError(err error, w http.ResponseWriter, msg string) {
 	ours, ok:=err.(*Error)
 	if !ok {
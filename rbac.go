@@ -0,0 +1,270 @@
+package seven5
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	//ROLE_ANONYMOUS is a role everyone has, logged in or not.
+	ROLE_ANONYMOUS = "anonymous"
+	//ROLE_AUTHENTICATED is a role everyone with a session has.
+	ROLE_AUTHENTICATED = "authenticated"
+	//ROLE_ADMIN and ROLE_STAFF are the roles that BasicResource treats as privileged.
+	ROLE_ADMIN = "admin"
+	ROLE_STAFF = "staff"
+	//PERMIT_ALL matches any resource or any method in a policy.
+	PERMIT_ALL = "*"
+)
+
+//rbacMethods are the methods that can be named in a policy.
+var rbacMethods = map[string]bool{"index": true, "find": true, "post": true, "put": true, "delete": true, PERMIT_ALL: true}
+
+//RolePolicy is what one role may do.  Permissions maps a resource name (lowercase, as in
+//the URL) to the methods allowed on it: index, find, post, put, and delete.  A role also
+//has the permissions of the roles it inherits.
+type RolePolicy struct {
+	Inherits    []string            `json:"inherits,omitempty"`
+	Permissions map[string][]string `json:"permissions"`
+}
+
+//Policy is a set of named roles.  It is usually loaded from a json file like this one:
+//
+//	{"roles": {
+//		"anonymous": {"permissions": {"article": ["index", "find"]}},
+//		"authenticated": {"inherits": ["anonymous"], "permissions": {"comment": ["post"]}},
+//		"staff": {"inherits": ["authenticated"], "permissions": {"article": ["*"]}},
+//		"admin": {"permissions": {"*": ["*"]}}
+//	}}
+type Policy struct {
+	Roles map[string]*RolePolicy `json:"roles"`
+}
+
+//LoadPolicy reads a policy from a json file.
+func LoadPolicy(path string) (*Policy, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePolicy(data)
+}
+
+//ParsePolicy decodes a json policy and checks that it names only known methods and roles
+//and that no role inherits from itself.  Resource names are converted to lowercase.
+func ParsePolicy(data []byte) (*Policy, error) {
+	result := &Policy{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+	for name, r := range result.Roles {
+		if r == nil {
+			return nil, errors.New(fmt.Sprintf("role %s has no definition", name))
+		}
+		perms := make(map[string][]string)
+		for res, methods := range r.Permissions {
+			for _, m := range methods {
+				if !rbacMethods[m] {
+					return nil, errors.New(fmt.Sprintf("role %s: unknown method %s for %s", name, m, res))
+				}
+			}
+			perms[strings.ToLower(res)] = methods
+		}
+		r.Permissions = perms
+		for _, parent := range r.Inherits {
+			if _, ok := result.Roles[parent]; !ok {
+				return nil, errors.New(fmt.Sprintf("role %s inherits from unknown role %s", name, parent))
+			}
+		}
+		if result.inheritsFrom(name, name, map[string]bool{}) {
+			return nil, errors.New(fmt.Sprintf("role %s inherits from itself", name))
+		}
+	}
+	return result, nil
+}
+
+//inheritsFrom is true if role has target among its ancestors.
+func (self *Policy) inheritsFrom(role string, target string, seen map[string]bool) bool {
+	for _, parent := range self.Roles[role].Inherits {
+		if parent == target {
+			return true
+		}
+		if !seen[parent] {
+			seen[parent] = true
+			if self.inheritsFrom(parent, target, seen) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Allows is true if any of the roles (or the roles they inherit from) permits method on
+//resource.
+func (self *Policy) Allows(roles []string, resource string, method string) bool {
+	seen := map[string]bool{}
+	for _, r := range roles {
+		if self.roleAllows(r, strings.ToLower(resource), method, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+func (self *Policy) roleAllows(role string, resource string, method string, seen map[string]bool) bool {
+	if seen[role] {
+		return false
+	}
+	seen[role] = true
+	r, ok := self.Roles[role]
+	if !ok {
+		return false
+	}
+	for _, res := range []string{resource, PERMIT_ALL} {
+		for _, m := range r.Permissions[res] {
+			if m == method || m == PERMIT_ALL {
+				return true
+			}
+		}
+	}
+	for _, parent := range r.Inherits {
+		if self.roleAllows(parent, resource, method, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+//RoleStore records which roles have been given to which users.  Users are named by
+//UserKey.  Implementations must be safe to call from multiple goroutines.
+type RoleStore interface {
+	RolesOf(user string) ([]string, error)
+	Assign(user string, role string) error
+	Unassign(user string, role string) error
+}
+
+//UserKey is the name of the user of a session for a RoleStore: the id of a BasicUser, or
+//else the TokenKey (see TokenKeyer) of the session.
+func UserKey(s Session) string {
+	s = UnwrapSession(s)
+	if u, ok := s.(BasicUser); ok {
+		return strconv.FormatInt(int64(u.WireId()), 10)
+	}
+	return tokenKey(s)
+}
+
+//SimpleRoleStore is a RoleStore kept in memory.
+type SimpleRoleStore struct {
+	sync.Mutex
+	roles map[string][]string
+}
+
+//NewSimpleRoleStore returns a RoleStore in which no one has any roles.
+func NewSimpleRoleStore() *SimpleRoleStore {
+	return &SimpleRoleStore{roles: make(map[string][]string)}
+}
+
+func (self *SimpleRoleStore) RolesOf(user string) ([]string, error) {
+	self.Lock()
+	defer self.Unlock()
+	return append([]string{}, self.roles[user]...), nil
+}
+
+func (self *SimpleRoleStore) Assign(user string, role string) error {
+	self.Lock()
+	defer self.Unlock()
+	for _, r := range self.roles[user] {
+		if r == role {
+			return nil
+		}
+	}
+	self.roles[user] = append(self.roles[user], role)
+	return nil
+}
+
+func (self *SimpleRoleStore) Unassign(user string, role string) error {
+	self.Lock()
+	defer self.Unlock()
+	current := self.roles[user]
+	for i, r := range current {
+		if r == role {
+			self.roles[user] = append(current[:i:i], current[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+//hasRole is true if user has been given role in store.
+func hasRole(store RoleStore, user string, role string) bool {
+	roles, err := store.RolesOf(user)
+	if err != nil {
+		return false
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+//RoleAuthorizer is an Authorizer that decides with a Policy rather than the Allow methods
+//of each resource.  The roles of a request are ROLE_ANONYMOUS, ROLE_AUTHENTICATED if there
+//is a session, the roles of the session if it is a RoleHolder, and the roles given to
+//the user in Store (which may be nil).  Use BaseDispatcher.UseAuthorizer to install it.
+//A request made with a bearer token that is limited by scopes (see HasScope) must also have
+//ReadScope to index or find and WriteScope to post, put or delete, whatever its roles.
+type RoleAuthorizer struct {
+	Policy     *Policy
+	Store      RoleStore
+	ReadScope  string
+	WriteScope string
+}
+
+//NewRoleAuthorizer returns an Authorizer for the policy and role assignments given.  It
+//asks tokens for SCOPE_READ and SCOPE_WRITE.
+func NewRoleAuthorizer(p *Policy, store RoleStore) *RoleAuthorizer {
+	return &RoleAuthorizer{Policy: p, Store: store, ReadScope: SCOPE_READ, WriteScope: SCOPE_WRITE}
+}
+
+//Roles returns all the roles of the request represented by the bundle (see BundleRoles).
+func (self *RoleAuthorizer) Roles(bundle PBundle) []string {
+	return BundleRoles(bundle, self.Store)
+}
+
+func (self *RoleAuthorizer) allows(d *restObj, method string, bundle PBundle) Decision {
+	scope := self.WriteScope
+	if method == "index" || method == "find" {
+		scope = self.ReadScope
+	}
+	if !HasScope(bundle, scope) {
+		return Decide(false, bundle, fmt.Sprintf("token does not have the %s scope for %s on %s", scope, method, d.name))
+	}
+	ok := self.Policy.Allows(self.Roles(bundle), d.name, method)
+	return Decide(ok, bundle, fmt.Sprintf("no role permits %s on %s", method, d.name))
+}
+
+func (self *RoleAuthorizer) Index(d *restObj, bundle PBundle) Decision {
+	return self.allows(d, "index", bundle)
+}
+
+func (self *RoleAuthorizer) Post(d *restObj, bundle PBundle) Decision {
+	return self.allows(d, "post", bundle)
+}
+
+func (self *RoleAuthorizer) Find(d *restObj, num Id, bundle PBundle) Decision {
+	return self.allows(d, "find", bundle)
+}
+
+func (self *RoleAuthorizer) Put(d *restObj, num Id, bundle PBundle) Decision {
+	return self.allows(d, "put", bundle)
+}
+
+func (self *RoleAuthorizer) Delete(d *restObj, num Id, bundle PBundle) Decision {
+	return self.allows(d, "delete", bundle)
+}
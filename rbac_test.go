@@ -0,0 +1,183 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `{"roles": {
+	"anonymous": {"permissions": {"NoteWire": ["index"]}},
+	"authenticated": {"inherits": ["anonymous"]},
+	"staff": {"inherits": ["authenticated"], "permissions": {"notewire": ["post"]}},
+	"admin": {"permissions": {"*": ["*"]}}
+}}`
+
+/*-------------------------------------------------------------------------------*/
+func TestParsePolicy(t *testing.T) {
+	bad := []string{
+		`{"roles": {"staff": {"permissions": {"notewire": ["write"]}}}}`,
+		`{"roles": {"staff": {"inherits": ["nobody"]}}}`,
+		`{"roles": {"a": {"inherits": ["b"]}, "b": {"inherits": ["a"]}}}`,
+	}
+	for _, b := range bad {
+		if _, err := ParsePolicy([]byte(b)); err == nil {
+			t.Errorf("expected policy to be refused: %s", b)
+		}
+	}
+	p, err := ParsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatalf("unable to parse policy: %s", err)
+	}
+	cases := []struct {
+		roles  []string
+		method string
+		ok     bool
+	}{
+		{[]string{"anonymous"}, "index", true},
+		{[]string{"anonymous"}, "post", false},
+		{[]string{"staff"}, "index", true},
+		{[]string{"staff"}, "delete", false},
+		{[]string{"anonymous", "admin"}, "delete", true},
+		{[]string{"unknown"}, "index", false},
+	}
+	for _, c := range cases {
+		if p.Allows(c.roles, "NoteWire", c.method) != c.ok {
+			t.Errorf("%v %s: expected %v", c.roles, c.method, c.ok)
+		}
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestRoleAuthorizer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5policy")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "policy.json")
+	ioutil.WriteFile(path, []byte(testPolicy), 0600)
+	policy, err := LoadPolicy(path)
+	if err != nil {
+		t.Fatalf("unable to load policy: %s", err)
+	}
+
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	roles := NewSimpleRoleStore()
+	disp.UseAuthorizer(NewRoleAuthorizer(policy, roles))
+	//the resource's own Allow methods would refuse anonymous reads; the policy replaces them
+	res := &scopedResource{}
+	disp.ResourceSeparate("NoteWire", &NoteWire{}, res, nil, res, nil, nil)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	session, _ := sm.Generate(nil, "", nil, "", "")
+	cookie := sessionCookie(disp, session)
+	post := func(c *http.Cookie) int {
+		return sendRequest(t, srv, "POST", "/rest/notewire", `{"Text":"hi"}`, c).StatusCode
+	}
+
+	//authenticated inherits index from anonymous
+	if resp := sendRequest(t, srv, "GET", "/rest/notewire", "", cookie); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected logged in user to be able to index: %s", resp.Status)
+	}
+	if post(nil) != http.StatusUnauthorized || post(cookie) != http.StatusForbidden {
+		t.Errorf("only staff should be able to post")
+	}
+	roles.Assign(UserKey(session), ROLE_STAFF)
+	if post(cookie) != http.StatusCreated {
+		t.Errorf("staff should be able to post")
+	}
+	roles.Unassign(UserKey(session), ROLE_STAFF)
+	if post(cookie) != http.StatusForbidden {
+		t.Errorf("role should have been taken away")
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestAnonymousUnderPermissivePolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"roles": {"anonymous": {"permissions": {"*": ["*"]}}}}`))
+	if err != nil {
+		t.Fatalf("unable to parse policy: %s", err)
+	}
+	mgr := NewBasicManager(&linkedSupport{})
+	mgr.Identities = NewSimpleIdentityTable()
+	disp := NewBaseDispatcher(appName, mgr)
+	disp.UseAuthorizer(NewRoleAuthorizer(policy, nil))
+	disp.Resource("LinkedWire", &LinkedWire{}, mgr.UserResource())
+	ids := mgr.IdentityResource()
+	disp.ResourceSeparate("IdentityWire", &IdentityWire{}, ids, nil, nil, nil, ids)
+	tokens := NewAPITokenResource(NewSimpleAPITokenStore(), nil)
+	disp.ResourceSeparate("ApiToken", &ApiTokenWire{}, tokens, nil, tokens, nil, tokens)
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+
+	//the policy lets everything through, so the resources must cope with no user
+	for _, c := range []struct{ method, path, body string }{
+		{"GET", "/rest/linkedwire", ""},
+		{"GET", "/rest/linkedwire/1", ""},
+		{"GET", "/rest/identitywire", ""},
+		{"DELETE", "/rest/identitywire/1", ""},
+		{"GET", "/rest/apitoken", ""},
+		{"POST", "/rest/apitoken", `{"Name":"ci","Scopes":""}`},
+		{"DELETE", "/rest/apitoken/1", ""},
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected 401 for anonymous %s %s but got %d", c.method, c.path, w.Code)
+		}
+	}
+
+	//a session that is not a BasicUser is no better
+	pb, _ := NewSimplePBundle(httptest.NewRequest("GET", "/rest/linkedwire", nil), NewSimpleSession())
+	if _, err := mgr.UserResource().Index(pb); err == nil {
+		t.Errorf("expected an error for a session that is not a BasicUser")
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestRoleAuthorizerScopes(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`{"roles": {"authenticated": {"permissions": {"*": ["*"]}}}}`))
+	if err != nil {
+		t.Fatalf("unable to parse policy: %s", err)
+	}
+	sm := NewSimpleSessionManager()
+	disp := NewBaseDispatcher(appName, sm)
+	store := NewSimpleAPITokenStore()
+	disp.UseBearer(store)
+	disp.UseAuthorizer(NewRoleAuthorizer(policy, nil))
+	disp.Resource("Profile", &Profile{}, &profileEcho{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", disp)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	session, _ := sm.Generate(nil, "", nil, "", "")
+	_, readOnly, _ := store.Issue(session, "ro", []string{SCOPE_READ})
+	_, readWrite, _ := store.Issue(session, "rw", []string{SCOPE_READ, SCOPE_WRITE})
+	with := func(method string, token string) int {
+		return sendRequest(t, srv, method, "/rest/profile/1", `{"Id":1}`, nil, "Authorization", "Bearer "+token).StatusCode
+	}
+
+	//the policy lets the user do anything, but the token only lets them read
+	if with("GET", readOnly) != http.StatusOK {
+		t.Errorf("expected read only token to be able to find")
+	}
+	if code := with("PUT", readOnly); code != http.StatusForbidden {
+		t.Errorf("expected read only token to be refused PUT but got %d", code)
+	}
+	if code := with("PUT", readWrite); code != http.StatusOK {
+		t.Errorf("expected read write token to be able to PUT but got %d", code)
+	}
+	if resp := sendRequest(t, srv, "PUT", "/rest/profile/1", `{"Id":1}`, sessionCookie(disp, session)); resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the cookie not to be limited by scopes but got %s", resp.Status)
+	}
+}
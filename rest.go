@@ -29,11 +29,16 @@ type RestAll interface {
 }
 
 type restObj struct {
-	t     reflect.Type
-	name  string
-	index RestIndex
-	find  RestFind
-	del   RestDelete
-	post  RestPost
-	put   RestPut
+	t      reflect.Type
+	name   string
+	index  RestIndex
+	find   RestFind
+	del    RestDelete
+	post   RestPost
+	put    RestPut
+	fields []*fieldRule
+	//desc is nil if bodies of the wire type are not checked with checkWire
+	desc *FieldDescription
+	//nulls is true if checkWire refuses nulls for basic fields (see RegisterNullChecks)
+	nulls bool
 }
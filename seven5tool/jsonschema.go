@@ -0,0 +1,79 @@
+package seven5tool
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+var Jsonschema = &Command{jsonschemaFn, "jsonschema",
+	"write the JSON Schemas of the wire types of a running seven5 server to files",
+	`
+jsonschema fetches JSON Schema documents from a running server, where the application
+mapped them with seven5.JSONSchemaContent.  Given the URL of a single schema it writes
+that schema to the -out file (or stdout).  Given the URL of the index (the path passed to
+JSONSchemaContent) it writes every schema to the -dir directory as Name.schema.json.
+For example:
+
+	seven5tool jsonschema -dir schemas http://localhost:3003/describe/schema/
+`,
+}
+
+func jsonschemaFn(argv []string, l *log.Logger) {
+	var outfile, dir string
+	fset := flag.NewFlagSet("jsonschemaFlags", flag.ExitOnError)
+	fset.StringVar(&outfile, "out", "stdout", "file to write a single schema to, or stdout")
+	fset.StringVar(&dir, "dir", ".", "directory to write all the schemas to when given the index")
+	fset.Parse(argv)
+	if len(fset.Args()) != 1 {
+		l.Printf("must supply exactly one URL (not %d), of a schema or of the index of schemas", len(fset.Args()))
+		return
+	}
+	base, err := url.Parse(fset.Arg(0))
+	if err != nil {
+		l.Printf("Can't understand url %s: %s", fset.Arg(0), err)
+		return
+	}
+	if body, err := fetchDocument(base.String(), "$schema"); err == nil {
+		if err := writeDocument(outfile, body); err != nil {
+			l.Printf("Can't write %s: %s", outfile, err)
+		}
+		return
+	}
+	body, err := fetchDocument(base.String(), "resources")
+	if err != nil {
+		l.Printf("Can't get a schema or the index of schemas: %s", err)
+		return
+	}
+	var index struct {
+		Resources map[string]string `json:"resources"`
+	}
+	if err := json.Unmarshal(body, &index); err != nil {
+		l.Printf("Can't understand the index of schemas: %s", err)
+		return
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|os.ModePerm); err != nil {
+		l.Printf("Can't create directory %s: %s", dir, err)
+		return
+	}
+	for name, loc := range index.Resources {
+		u, err := base.Parse(loc)
+		if err != nil {
+			l.Printf("Can't understand location %s of %s: %s", loc, name, err)
+			return
+		}
+		schema, err := fetchDocument(u.String(), "$schema")
+		if err != nil {
+			l.Printf("Can't get the schema of %s: %s", name, err)
+			return
+		}
+		path := filepath.Join(dir, name+".schema.json")
+		if err := writeDocument(path, schema); err != nil {
+			l.Printf("Can't write %s: %s", path, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package seven5tool
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+)
+
+var Openapi = &Command{openapiFn, "openapi",
+	"write the OpenAPI document of a running seven5 server to a file",
+	`
+openapi fetches the OpenAPI document from a running server, at the URL where the
+application mapped it with seven5.OpenAPIContent, and writes it to a file (or
+stdout) so it can be checked in or given to other tools.  For example:
+
+	seven5tool openapi -out api.json http://localhost:3003/openapi.json
+`,
+}
+
+func openapiFn(argv []string, l *log.Logger) {
+	var outfile string
+	fset := flag.NewFlagSet("openapiFlags", flag.ExitOnError)
+	fset.StringVar(&outfile, "out", "openapi.json", "file to write the document to, or stdout")
+	fset.Parse(argv)
+	if len(fset.Args()) != 1 {
+		l.Printf("must supply exactly one URL (not %d), where the server serves its OpenAPI document", len(fset.Args()))
+		return
+	}
+	body, err := fetchDocument(fset.Arg(0), "openapi")
+	if err != nil {
+		l.Printf("Can't get the OpenAPI document: %s", err)
+		return
+	}
+	if err := writeDocument(outfile, body); err != nil {
+		l.Printf("Can't write %s: %s", outfile, err)
+	}
+}
+
+//fetchDocument gets the json document at url and checks that it has the top level key
+//given, so that an error page or the wrong url is not mistaken for the document.
+func fetchDocument(url string, key string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("%s returned %s", url, resp.Status))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, errors.New(fmt.Sprintf("%s did not return json: %s", url, err))
+	}
+	if _, ok := doc[key]; !ok {
+		return nil, errors.New(fmt.Sprintf("%s did not return a document with %q in it", url, key))
+	}
+	return body, nil
+}
+
+//writeDocument writes body to the file named, or to standard out if the name is "stdout".
+func writeDocument(outfile string, body []byte) error {
+	if outfile == "stdout" {
+		_, err := os.Stdout.Write(body)
+		return err
+	}
+	return ioutil.WriteFile(outfile, body, 0644)
+}
@@ -0,0 +1,258 @@
+package seven5
+
+import (
+	oauth2 "code.google.com/p/goauth2/oauth"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var NO_SUCH_TOKEN = errors.New("No token stored for that key and service")
+
+//TokenStore persists the credentials of OauthConnections so that API calls can be made on
+//behalf of a user after their access token has been refreshed or the process has restarted.
+//The key is usually a session id or a user id (see TokenKeyer) and the service is the name
+//of the connector.  The data is opaque to the store.  Implementations must be safe to call
+//from multiple goroutines.
+type TokenStore interface {
+	Load(key string, service string) ([]byte, error)
+	Save(key string, service string, data []byte) error
+	Remove(key string, service string) error
+}
+
+//PersistentConnection is implemented by OauthConnections whose credentials can be written
+//to a TokenStore.  Once attached to a store, a connection saves its credentials again
+//whenever they change (typically, because they were refreshed).
+type PersistentConnection interface {
+	OauthConnection
+	MarshalCredentials() ([]byte, error)
+	AttachStore(store TokenStore, key string, service string)
+}
+
+//ConnectionRestorer is implemented by OauthConnectors that can recreate a connection from
+//the data written by PersistentConnection.MarshalCredentials.
+type ConnectionRestorer interface {
+	RestoreConnection(data []byte) (OauthConnection, error)
+}
+
+//TokenKeyer can be implemented by a Session to control the key used to store the tokens
+//of connections made during that session.  Sessions that represent users should return
+//something stable, like the user's id, so that tokens outlive the session.  Sessions that
+//don't implement this interface store tokens by session id.
+type TokenKeyer interface {
+	TokenKey() string
+}
+
+//tokenKey returns the TokenStore key for connections made by a session.
+func tokenKey(s Session) string {
+	if k, ok := s.(TokenKeyer); ok {
+		return k.TokenKey()
+	}
+	return s.SessionId()
+}
+
+//SaveConnection writes the credentials of conn to the store and attaches the store to the
+//connection so that later changes are saved too.  Connections that are not persistent
+//are ignored.
+func SaveConnection(store TokenStore, conn OauthConnection, key string, service string) error {
+	pc, ok := conn.(PersistentConnection)
+	if !ok {
+		return nil
+	}
+	data, err := pc.MarshalCredentials()
+	if err != nil {
+		return err
+	}
+	if err := store.Save(key, service, data); err != nil {
+		return err
+	}
+	pc.AttachStore(store, key, service)
+	return nil
+}
+
+//RestoreConnection recreates a connection to the service of connector from the credentials
+//in the store.  It returns NO_SUCH_TOKEN if nothing has been stored for key.
+func RestoreConnection(store TokenStore, connector OauthConnector, key string) (OauthConnection, error) {
+	r, ok := connector.(ConnectionRestorer)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("connector %s cannot restore connections", connector.Name()))
+	}
+	data, err := store.Load(key, connector.Name())
+	if err != nil {
+		return nil, err
+	}
+	conn, err := r.RestoreConnection(data)
+	if err != nil {
+		return nil, err
+	}
+	if pc, ok := conn.(PersistentConnection); ok {
+		pc.AttachStore(store, key, connector.Name())
+	}
+	return conn, nil
+}
+
+//SimpleTokenStore is a TokenStore that keeps tokens in memory.  Tokens survive sessions
+//but not restarts.
+type SimpleTokenStore struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+//NewSimpleTokenStore returns an empty, in-memory TokenStore.
+func NewSimpleTokenStore() *SimpleTokenStore {
+	return &SimpleTokenStore{data: make(map[string][]byte)}
+}
+
+func (self *SimpleTokenStore) Load(key string, service string) ([]byte, error) {
+	self.Lock()
+	defer self.Unlock()
+	d, ok := self.data[service+"\x00"+key]
+	if !ok {
+		return nil, NO_SUCH_TOKEN
+	}
+	return d, nil
+}
+
+func (self *SimpleTokenStore) Save(key string, service string, data []byte) error {
+	self.Lock()
+	defer self.Unlock()
+	self.data[service+"\x00"+key] = data
+	return nil
+}
+
+func (self *SimpleTokenStore) Remove(key string, service string) error {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.data, service+"\x00"+key)
+	return nil
+}
+
+//FileTokenStore is a TokenStore that keeps each token in its own file in a directory.  File
+//names are a hash of the key and service so keys may contain any characters.  Files are
+//only readable by the owner since they contain secrets.
+type FileTokenStore struct {
+	sync.Mutex
+	dir string
+}
+
+//NewFileTokenStore returns a TokenStore that writes to dir, creating it if needed.
+func NewFileTokenStore(dir string) (*FileTokenStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileTokenStore{dir: dir}, nil
+}
+
+func (self *FileTokenStore) path(key string, service string) string {
+	sum := sha256.Sum256([]byte(service + "\x00" + key))
+	return filepath.Join(self.dir, fmt.Sprintf("%x.token", sum))
+}
+
+func (self *FileTokenStore) Load(key string, service string) ([]byte, error) {
+	self.Lock()
+	defer self.Unlock()
+	d, err := ioutil.ReadFile(self.path(key, service))
+	if os.IsNotExist(err) {
+		return nil, NO_SUCH_TOKEN
+	}
+	return d, err
+}
+
+//Save writes to a temporary file and renames it so that a crash never leaves a partial token.
+func (self *FileTokenStore) Save(key string, service string, data []byte) error {
+	self.Lock()
+	defer self.Unlock()
+	p := self.path(key, service)
+	if err := ioutil.WriteFile(p+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (self *FileTokenStore) Remove(key string, service string) error {
+	self.Lock()
+	defer self.Unlock()
+	err := os.Remove(self.path(key, service))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+//tokenPersistence is the part of a connection that remembers which store (if any) it is
+//attached to.
+type tokenPersistence struct {
+	store   TokenStore
+	key     string
+	service string
+}
+
+func (self *tokenPersistence) AttachStore(store TokenStore, key string, service string) {
+	self.store = store
+	self.key = key
+	self.service = service
+}
+
+func (self *tokenPersistence) save(data []byte, err error) error {
+	if self.store == nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return self.store.Save(self.key, self.service, data)
+}
+
+//sendOauth2 sends a request using an oauth2 transport.  The token is refreshed before the
+//request if it has expired, and once after the request if the server answers 401 (as long
+//as the request can be sent again).  If the token changes it is passed to changed, so it
+//can be persisted.  The lock is held only to read, refresh, and replace the token; the
+//request is sent with a copy of the token so a slow server doesn't hold up the connection.
+func sendOauth2(lock *sync.Mutex, t *oauth2.Transport, r *http.Request, changed func(*oauth2.Token) error) (*http.Response, error) {
+	current, err := usableOauth2(lock, t, "", changed)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := current.Client().Do(r)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && current.RefreshToken != "" &&
+		(r.Body == nil || r.GetBody != nil) {
+		resp.Body.Close()
+		if current, err = usableOauth2(lock, t, current.AccessToken, changed); err != nil {
+			return nil, err
+		}
+		again := r.Clone(r.Context())
+		if r.GetBody != nil {
+			if again.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+		resp, err = current.Client().Do(again)
+	}
+	return resp, err
+}
+
+//usableOauth2 returns a copy of t with a token that can be sent.  The token is refreshed if
+//it has expired, or if it is still the rejected one (another request may have refreshed it
+//already).
+func usableOauth2(lock *sync.Mutex, t *oauth2.Transport, rejected string, changed func(*oauth2.Token) error) (*oauth2.Transport, error) {
+	lock.Lock()
+	defer lock.Unlock()
+	if t.Token == nil {
+		return nil, errors.New("connection has no token")
+	}
+	if t.RefreshToken != "" && (t.Expired() || (rejected != "" && t.AccessToken == rejected)) {
+		if err := t.Refresh(); err != nil {
+			return nil, err
+		}
+		if err := changed(t.Token); err != nil {
+			fmt.Fprintf(os.Stderr, "unable to save refreshed token: %s\n", err)
+		}
+	}
+	tok := *t.Token
+	return &oauth2.Transport{Config: t.Config, Token: &tok, Transport: t.Transport}, nil
+}
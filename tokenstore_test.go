@@ -0,0 +1,174 @@
+package seven5
+
+import (
+	oauth2 "code.google.com/p/goauth2/oauth"
+	"code.google.com/p/gomock/gomock"
+	"fmt"
+	oauth1 "github.com/garyburd/go-oauth/oauth"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*-------------------------------------------------------------------------------*/
+func TestFileTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "seven5tokens")
+	if err != nil {
+		t.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewFileTokenStore(dir)
+	if err != nil {
+		t.Fatalf("can't create token store: %s", err)
+	}
+	for _, s := range []TokenStore{store, NewSimpleTokenStore()} {
+		if _, err := s.Load("user/1", "google"); err != NO_SUCH_TOKEN {
+			t.Errorf("%T: expected NO_SUCH_TOKEN but got %v", s, err)
+		}
+		s.Save("user/1", "google", []byte("goog"))
+		s.Save("user/1", "evernote", []byte("ever"))
+		if d, _ := s.Load("user/1", "google"); string(d) != "goog" {
+			t.Errorf("%T: wrong data loaded: %s", s, d)
+		}
+		s.Remove("user/1", "google")
+		if _, err := s.Load("user/1", "google"); err != NO_SUCH_TOKEN {
+			t.Errorf("%T: expected token to be removed but got %v", s, err)
+		}
+		if d, _ := s.Load("user/1", "evernote"); string(d) != "ever" {
+			t.Errorf("%T: removed wrong token: %s", s, d)
+		}
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestGoogleRefresh(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	refreshes := 0
+	entered, release := make(chan bool), make(chan bool)
+	//token endpoint that hands out a new access token for our refresh token and an
+	//api endpoint that only likes the newest access token
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "rt" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			refreshes++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"access_token":"at%d","expires_in":3600}`, refreshes)
+		case "/api":
+			if r.Header.Get("Authorization") != fmt.Sprintf("Bearer at%d", refreshes) {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			fmt.Fprintf(w, "ok %s", body)
+		case "/slow":
+			entered <- true
+			<-release
+		}
+	}))
+	defer srv.Close()
+
+	deploy := NewMockDeploymentEnvironment(ctrl)
+	deploy.EXPECT().RedirectHost(gomock.Any()).Return("http://localhost")
+	detail := NewMockOauthClientDetail(ctrl)
+	detail.EXPECT().ClientId(gomock.Any()).Return(id)
+	detail.EXPECT().ClientSecret(gomock.Any()).Return(seekret)
+	google := NewGoogleOauth2(SCOPE, PROMPT, detail, deploy)
+	google.cfg.TokenURL = srv.URL + "/token"
+
+	store := NewSimpleTokenStore()
+	conn := &GoogleConnection{Transport: &oauth2.Transport{
+		Config: google.cfg,
+		Token:  &oauth2.Token{AccessToken: "stale", RefreshToken: "rt"},
+	}}
+	if err := SaveConnection(store, conn, "user1", google.Name()); err != nil {
+		t.Fatalf("unable to save connection: %s", err)
+	}
+
+	//the server refuses our token so we should refresh and send the body again
+	req, _ := http.NewRequest("POST", srv.URL+"/api", strings.NewReader("hello"))
+	resp, err := conn.SendAuthenticated(req)
+	if err != nil {
+		t.Fatalf("failed to send: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok hello" || refreshes != 1 {
+		t.Errorf("expected refresh and retry: %s, '%s', %d refreshes", resp.Status, body, refreshes)
+	}
+
+	//the refreshed token must be in the store, so a restored connection works without refreshing
+	restored, err := RestoreConnection(store, google, "user1")
+	if err != nil {
+		t.Fatalf("unable to restore connection: %s", err)
+	}
+	if restored.(*GoogleConnection).AccessToken != "at1" {
+		t.Errorf("refreshed token not saved, got %s", restored.(*GoogleConnection).AccessToken)
+	}
+
+	//an expired token is refreshed before sending, and the new one saved
+	restored.(*GoogleConnection).Expiry = time.Now().Add(-time.Minute)
+	req, _ = http.NewRequest("GET", srv.URL+"/api", nil)
+	resp, err = restored.SendAuthenticated(req)
+	if err != nil || resp.StatusCode != http.StatusOK || refreshes != 2 {
+		t.Errorf("expected refresh of expired token: %v %v %d", err, resp, refreshes)
+	}
+	again, _ := RestoreConnection(store, google, "user1")
+	if again.(*GoogleConnection).AccessToken != "at2" {
+		t.Errorf("refreshed token not saved, got %s", again.(*GoogleConnection).AccessToken)
+	}
+
+	//the connection is not locked while a request is in flight
+	go func() {
+		req, _ := http.NewRequest("GET", srv.URL+"/slow", nil)
+		if resp, err := restored.SendAuthenticated(req); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-entered
+	done := make(chan bool)
+	go func() {
+		restored.(*GoogleConnection).MarshalCredentials()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("connection stayed locked while a request was being sent")
+	}
+	close(release)
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestEvernoteCredentials(t *testing.T) {
+	ns, _ := url.Parse("https://sandbox.evernote.com/shard/s1/notestore")
+	conn := &EvernoteConnection{
+		Credentials: &oauth1.Credentials{Token: "tok", Secret: "sec"},
+		EvernoteId:  1999,
+		Notestore:   ns,
+	}
+	store := NewSimpleTokenStore()
+	if err := SaveConnection(store, conn, "user1", "evernote"); err != nil {
+		t.Fatalf("unable to save connection: %s", err)
+	}
+	ever := &EvernoteOauth1{}
+	c, err := RestoreConnection(store, ever, "user1")
+	if err != nil {
+		t.Fatalf("unable to restore connection: %s", err)
+	}
+	restored := c.(*EvernoteConnection)
+	if restored.Token != "tok" || restored.Secret != "sec" || restored.EvernoteId != 1999 ||
+		restored.Notestore.String() != ns.String() {
+		t.Errorf("connection not restored properly: %+v", restored)
+	}
+}
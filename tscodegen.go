@@ -0,0 +1,159 @@
+package seven5
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+var typescriptTemplate *template.Template
+
+//init creates the template needed for TypeScript code generation.
+func init() {
+	fnMap := template.FuncMap{
+		"tolower": strings.ToLower,
+	}
+	typescriptTemplate = template.Must(template.New("TYPESCRIPT_TMPL").Funcs(fnMap).Parse(typescript_tmpl))
+}
+
+//TypeScript returns the TypeScript name for a particular _type_ name or panics if it does not
+//understand.
+func (self *FieldDescription) TypeScript() string {
+	if self.Optional {
+		basic := *self
+		basic.Optional = false
+		return basic.TypeScript() + " | null"
+	}
+	if self.EnumName != "" {
+		return self.EnumName
+	}
+	switch self.TypeName {
+	case "Boolean":
+		return "boolean"
+	case "DateTime", "Integer", "Floating", "Id":
+		return "number"
+	case "String255", "Textblob":
+		return "string"
+	}
+	if self.Array != nil {
+		if self.Array.Optional {
+			return "(" + self.Array.TypeScript() + ")[]"
+		}
+		return self.Array.TypeScript() + "[]"
+	}
+	if self.Map != nil {
+		return "{ [key: string]: " + self.Map.TypeScript() + " }"
+	}
+	if self.StructName != "" {
+		return self.StructName
+	}
+	panic(fmt.Sprintf("unable to convert type %s to TypeScript type!", self.TypeName))
+}
+
+//typeScriptEnumConstants returns the members of a TypeScript string enum for an enumeration.
+//Values that are not identifiers are quoted, which TypeScript allows for member names.
+func typeScriptEnumConstants(f *FieldDescription) []*enumConstant {
+	result := []*enumConstant{}
+	for _, v := range f.Enum {
+		b, _ := json.Marshal(v)
+		literal := string(b)
+		ident := v
+		for i, c := range v {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$' || (i > 0 && c >= '0' && c <= '9')) {
+				ident = literal
+				break
+			}
+		}
+		if ident == "" {
+			ident = literal
+		}
+		result = append(result, &enumConstant{ident, literal})
+	}
+	return result
+}
+
+func generateTypeScript(name string, data interface{}) string {
+	var buffer bytes.Buffer
+	if err := typescriptTemplate.ExecuteTemplate(&buffer, name, data); err != nil {
+		return err.Error()
+	}
+	return buffer.String()
+}
+
+//wrappedTypeScriptCodeGen is the top level of the TypeScript code generation.  It produces an
+//interface for every resource and support struct, a class of static methods for each
+//resource that calls the server with fetch, and a string enum for every enumeration.
+func wrappedTypeScriptCodeGen(holder TypeHolder, prefix string) bytes.Buffer {
+	var text bytes.Buffer
+	resourceStructs := []*FieldDescription{}
+	supportStructs := []*FieldDescription{}
+	text.WriteString(generateTypeScript("TS_LIBRARY", nil))
+	for _, d := range holder.All() {
+		text.WriteString("\n")
+		text.WriteString(generateTypeScript("TS_RESOURCE", &fdWrapper{d, prefix}))
+		resourceStructs = append(resourceStructs, d)
+	}
+	for _, d := range holder.All() {
+		for _, s := range collectStructs(d) {
+			if !containsType(resourceStructs, s) && !containsType(supportStructs, s) {
+				supportStructs = append(supportStructs, s)
+			}
+		}
+	}
+	for _, s := range supportStructs {
+		text.WriteString("\n")
+		text.WriteString(generateTypeScript("TS_SUPPORT_STRUCT", s))
+	}
+	for _, e := range holderEnums(holder) {
+		text.WriteString("\n")
+		text.WriteString(generateTypeScript("TS_ENUM", &enumWrapper{e, typeScriptEnumConstants(e)}))
+	}
+	return text
+}
+
+//generateTypeScriptFunc returns a function that outputs the TypeScript for all the wire types
+//associated with the resources known to the type holder.
+func generateTypeScriptFunc(holder TypeHolder, prefix string) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		text := wrappedTypeScriptCodeGen(holder, prefix)
+		w.Header().Set("Content-Type", "application/typescript")
+		if _, err := w.Write(text.Bytes()); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write result of code generation to the client: %s\n", err)
+		}
+	}
+}
+
+//GeneratedTypeScriptContent adds an http handler at urlPath that serves the TypeScript for the
+//types in holder.  The restPrefix must be the same one used by the TypeHolder (probably a
+//dispatcher) to map its rest resources.
+func GeneratedTypeScriptContent(mux *ServeMux, holder TypeHolder, urlPath string, restPrefix string) {
+	mux.HandleFunc(urlPath, generateTypeScriptFunc(holder, restPrefix))
+}
+
+//GenerateTypeScriptForWireTypes emits TypeScript source code that allows client side code to
+//manipulate the defined types (in TypeHolder argument) conveniently.  It uses the
+//projectfinder supplied to know where to place the resulting file, which is
+//generated/seven5.ts inside the TYPESCRIPT_FLAVOR directory of the project.
+func GenerateTypeScriptForWireTypes(t TypeHolder, pre string, name string, pf ProjectFinder) error {
+	dir, err := pf.ProjectFind("", name, TYPESCRIPT_FLAVOR)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return errors.New(fmt.Sprintf("No directory for typescript code (%s)", filepath.Clean(dir)))
+	}
+	buffer := wrappedTypeScriptCodeGen(t, pre)
+	c, err := createPath(dir, "generated", "seven5.ts")
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.Write(buffer.Bytes())
+	return err
+}
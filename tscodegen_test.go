@@ -0,0 +1,72 @@
+package seven5
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+type dirFinder string
+
+func (self dirFinder) ProjectFind(target string, projectName string, flavor FileFlavor) (string, error) {
+	return filepath.Join(string(self), target), nil
+}
+
+type NestedHolder struct {
+	Id    Id
+	Tags  []String255
+	Inner *Test1
+}
+
+/*-------------------------------------------------------------------------*/
+func TestTypeScriptFields(T *testing.T) {
+	f := WalkWireType("Test1", reflect.TypeOf(Test1{}))
+	verifyHasString(T, "number", f.Struct[0].TypeScript())
+	verifyHasString(T, "number[]", f.Struct[1].TypeScript())
+	verifyHasString(T, "Nested", f.Struct[2].TypeScript())
+}
+
+func TestTypeScriptFullResource(T *testing.T) {
+	holder := NewSimpleTypeHolder()
+	holder.Add("someWire", &someWire{})
+	holder.Add("NestedHolder", &NestedHolder{})
+
+	b := wrappedTypeScriptCodeGen(holder, "/rest/")
+	decl := b.String()
+	verifyHasString(T, "export interface someWire {\n\tId: number;\n\tFoo: string;\n}", decl)
+	verifyHasString(T, `static readonly resourceURL = "/rest/somewire/";`, decl)
+	verifyHasString(T, "static Index(opts?: Seven5Options): Promise<someWire[]>", decl)
+	verifyHasString(T, "static Find(id: number, opts?: Seven5Options): Promise<someWire>", decl)
+	verifyHasString(T, `seven5Request<someWire>("PUT", someWireResource.resourceURL + obj.Id, obj, opts)`, decl)
+	verifyHasString(T, `seven5Request<someWire>("DELETE"`, decl)
+	verifyHasString(T, "\tTags: string[];\n\tInner: Test1;", decl)
+	verifyHasString(T, "export interface Test1 {\n\tF: number;\n\tA: number[];\n\tS: Nested;\n}", decl)
+	verifyHasString(T, "export interface Nested {", decl)
+	verifyHasString(T, "async function seven5Request<T>", decl)
+
+	//served over http
+	w := httptest.NewRecorder()
+	generateTypeScriptFunc(holder, "/rest/")(w, httptest.NewRequest("GET", "/generated.ts", nil))
+	if w.Body.String() != decl {
+		T.Errorf("served code differs from generated code")
+	}
+
+	//written into the project
+	dir, err := ioutil.TempDir("", "seven5ts")
+	if err != nil {
+		T.Fatalf("can't create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := GenerateTypeScriptForWireTypes(holder, "/rest/", "proj", dirFinder(filepath.Join(dir, "missing"))); err == nil {
+		T.Errorf("expected error for missing typescript directory")
+	}
+	if err := GenerateTypeScriptForWireTypes(holder, "/rest/", "proj", dirFinder(dir)); err != nil {
+		T.Fatalf("unable to write typescript: %s", err)
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "generated", "seven5.ts")); err != nil || string(b) != decl {
+		T.Errorf("expected generated code in file: %v", err)
+	}
+}
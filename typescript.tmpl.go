@@ -0,0 +1,94 @@
+package seven5
+
+//typescript_tmpl is the template for the TypeScript client.  TS_LIBRARY is emitted once and
+//the others once for each wire type.  Unlike the Dart version, the support code is part of
+//the generated file, so there is nothing else to install.
+const typescript_tmpl = `
+{{- define "TS_LIBRARY" -}}
+//Generated by seven5 from the wire types of the server.  Do not edit.
+
+export interface Seven5Options {
+	headers?: { [name: string]: string };
+	params?: { [name: string]: string };
+}
+
+export class Seven5Error extends Error {
+	constructor(public status: number, public body: string) {
+		super("request failed with status " + status + ": " + body);
+	}
+}
+
+async function seven5Request<T>(method: string, url: string, body?: any, opts?: Seven5Options): Promise<T> {
+	if (opts && opts.params) {
+		const q = new URLSearchParams(opts.params).toString();
+		if (q !== "") {
+			url += "?" + q;
+		}
+	}
+	const headers: { [name: string]: string } = { "Accept": "application/json" };
+	if (body !== undefined) {
+		headers["Content-Type"] = "application/json";
+	}
+	if (opts && opts.headers) {
+		Object.assign(headers, opts.headers);
+	}
+	const resp = await fetch(url, {
+		method: method,
+		headers: headers,
+		credentials: "same-origin",
+		body: body === undefined ? undefined : JSON.stringify(body),
+	});
+	const text = await resp.text();
+	if (!resp.ok) {
+		throw new Seven5Error(resp.status, text);
+	}
+	return (text === "" ? undefined : JSON.parse(text)) as T;
+}
+{{end -}}
+
+{{- define "TS_FIELDS" -}}
+{{range .Struct}}	{{.Name}}{{if .Optional}}?{{end}}: {{.TypeScript}};
+{{end -}}
+{{end -}}
+
+{{- define "TS_RESOURCE" -}}
+export interface {{.Name}} {
+{{template "TS_FIELDS" .}}}
+
+export class {{.Name}}Resource {
+	static readonly resourceURL = "{{.RestPrefix}}{{tolower .Name}}/";
+
+	static Index(opts?: Seven5Options): Promise<{{.Name}}[]> {
+		return seven5Request<{{.Name}}[]>("GET", {{.Name}}Resource.resourceURL, undefined, opts);
+	}
+
+	static Find(id: number, opts?: Seven5Options): Promise<{{.Name}}> {
+		return seven5Request<{{.Name}}>("GET", {{.Name}}Resource.resourceURL + id, undefined, opts);
+	}
+
+	static Post(example: {{.Name}}, opts?: Seven5Options): Promise<{{.Name}}> {
+		return seven5Request<{{.Name}}>("POST", {{.Name}}Resource.resourceURL, example, opts);
+	}
+{{if .HasId}}
+	static Put(obj: {{.Name}}, opts?: Seven5Options): Promise<{{.Name}}> {
+		return seven5Request<{{.Name}}>("PUT", {{.Name}}Resource.resourceURL + obj.Id, obj, opts);
+	}
+{{end}}
+	static Delete(id: number, opts?: Seven5Options): Promise<{{.Name}}> {
+		return seven5Request<{{.Name}}>("DELETE", {{.Name}}Resource.resourceURL + id, undefined, opts);
+	}
+}
+{{end -}}
+
+{{- define "TS_SUPPORT_STRUCT" -}}
+export interface {{.StructName}} {
+{{template "TS_FIELDS" .}}}
+{{end -}}
+
+{{- define "TS_ENUM" -}}
+export enum {{.EnumName}} {
+{{range .Constants}}	{{.Ident}} = {{.Literal}},
+{{end -}}
+}
+{{end -}}
+`
@@ -0,0 +1,120 @@
+package seven5
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+var nullCheckLock sync.RWMutex
+var nullChecks = make(map[reflect.Type]bool)
+
+//RegisterNullChecks makes the resources of a wire type refuse, with 422, bodies that have a
+//null anywhere in the wire type for a basic field that is not optional.  Otherwise such a
+//null is decoded as the zero value, as it always has been, so the resource can't tell it
+//from a zero that was sent on purpose.  The example is a pointer to the wire type, as given
+//to ResourceSeparate.  Register wire types (usually in init) before adding resources that use
+//them, and say so in the comment of the wire type, since nothing in the type itself shows it.
+//The values of enumerations (see RegisterEnum) are checked whether or not the wire type is
+//registered.  It panics if the example is not a pointer to a struct.
+func RegisterNullChecks(wireExample interface{}) {
+	t := reflect.TypeOf(wireExample)
+	if t == nil || t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("null checks must be registered with a pointer to a wire type, not %v", t))
+	}
+	nullCheckLock.Lock()
+	defer nullCheckLock.Unlock()
+	nullChecks[t.Elem()] = true
+}
+
+//checksNulls is true if the wire type t was registered with RegisterNullChecks.
+func checksNulls(t reflect.Type) bool {
+	nullCheckLock.RLock()
+	defer nullCheckLock.RUnlock()
+	return nullChecks[t]
+}
+
+//checkWire compares a decoded body with the description of its wire type and returns a 422
+//error for a value that is not one of the values of an enumeration (including ""), or for an
+//enumeration that is not optional but is null or missing from an object.  If nulls is true
+//(see RegisterNullChecks), it also refuses a null where the wire type has a basic field that
+//is not optional.  The decoder would quietly turn such a missing value or null into the zero
+//value.  Keys are compared without case, as encoding/json does, and keys that are not fields
+//are ignored.  Values of the wrong type are left to the decoder.
+func checkWire(f *FieldDescription, v interface{}, path string, nulls bool) error {
+	if v == nil {
+		if (f.EnumName != "" || (nulls && f.TypeName != "")) && !f.Optional {
+			return HTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("%s may not be null", path))
+		}
+		return nil
+	}
+	switch {
+	case f.EnumName != "":
+		if s, ok := v.(string); ok && !f.containsValue(s) {
+			return HTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("%s may not be %q (it is a %s)", path, s, f.EnumName))
+		}
+	case f.Array != nil:
+		list, _ := v.([]interface{})
+		for i, e := range list {
+			if err := checkWire(f.Array, e, fmt.Sprintf("%s[%d]", path, i), nulls); err != nil {
+				return err
+			}
+		}
+	case f.Map != nil:
+		m, _ := v.(map[string]interface{})
+		for k, e := range m {
+			if err := checkWire(f.Map, e, fmt.Sprintf("%s[%q]", path, k), nulls); err != nil {
+				return err
+			}
+		}
+	case f.StructName != "":
+		obj, _ := v.(map[string]interface{})
+		for k, e := range obj {
+			for _, field := range f.Struct {
+				if !strings.EqualFold(k, field.Name) {
+					continue
+				}
+				if err := checkWire(field, e, path+"."+field.Name, nulls); err != nil {
+					return err
+				}
+			}
+		}
+		for _, field := range f.Struct {
+			if field.EnumName != "" && !field.Optional && !hasKey(obj, field.Name) {
+				return HTTPError(http.StatusUnprocessableEntity, fmt.Sprintf("%s.%s is required (it is a %s)", path, field.Name, field.EnumName))
+			}
+		}
+	}
+	return nil
+}
+
+//hasKey is true if obj has the key name, compared without case.
+func hasKey(obj map[string]interface{}, name string) bool {
+	for k := range obj {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+//hasEnum is true if there is an enumeration anywhere in the wire type, so its bodies are
+//checked with checkWire even if it is not registered with RegisterNullChecks.
+func hasEnum(f *FieldDescription) bool {
+	switch {
+	case f.EnumName != "":
+		return true
+	case f.Array != nil:
+		return hasEnum(f.Array)
+	case f.Map != nil:
+		return hasEnum(f.Map)
+	}
+	for _, field := range f.Struct {
+		if hasEnum(field) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package seven5
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Profile is registered with RegisterNullChecks in init, so bodies with a null for Id or for
+//a score are refused.
+type Profile struct {
+	Id     Id
+	Nick   *String255
+	Born   *DateTime
+	Scores map[String255]Integer
+	Maybe  []*Integer
+	Homes  map[String255]*Address
+}
+
+func init() {
+	RegisterNullChecks(&Profile{})
+}
+
+//Draft has optional fields but is not registered with RegisterNullChecks, so null for Count
+//is zero.
+type Draft struct {
+	Id    Id
+	Title *String255
+	Count Integer
+}
+
+//profileEcho is a RestAll that sends back what it is given.
+type profileEcho struct{}
+
+func (self *profileEcho) Index(pb PBundle) (interface{}, error) { return []*Profile{}, nil }
+func (self *profileEcho) Find(id Id, pb PBundle) (interface{}, error) {
+	return &Profile{Id: id}, nil
+}
+func (self *profileEcho) Post(i interface{}, pb PBundle) (interface{}, error) { return i, nil }
+func (self *profileEcho) Put(id Id, i interface{}, pb PBundle) (interface{}, error) {
+	return i, nil
+}
+func (self *profileEcho) Delete(id Id, pb PBundle) (interface{}, error) {
+	return &Profile{Id: id}, nil
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestMapAndOptionalFields(t *testing.T) {
+	f := WalkWireType("Profile", reflect.TypeOf(&Profile{}))
+	if nick := f.Struct[1]; !nick.Optional || nick.TypeName != "String255" {
+		t.Errorf("expected optional String255: %+v", nick)
+	}
+	if scores := f.Struct[3]; scores.Map == nil || scores.Map.TypeName != "Integer" {
+		t.Errorf("expected map of Integer: %+v", scores)
+	}
+	if maybe := f.Struct[4]; !maybe.Array.Optional {
+		t.Errorf("expected array of optional Integer: %+v", maybe)
+	}
+	if homes := collectStructs(f); len(homes) != 3 || homes[1].StructName != "Address" {
+		t.Errorf("expected structs in maps to be found: %+v", homes)
+	}
+	for _, bad := range []interface{}{map[Integer]Integer{}, map[string]Integer{}, new(*Integer)} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected %T to be refused", bad)
+				}
+			}()
+			WalkWireType("bad", reflect.TypeOf(bad))
+		}()
+	}
+
+	dart := generateDartForResource(f, "/rest/")
+	verifyHasString(t, "String? Nick;", dart)
+	verifyHasString(t, "Map<String, int> Scores = {};", dart)
+	verifyHasString(t, `Born = json["Born"] == null ? null : Seven5Support.dateTimeFromJson(json["Born"]);`, dart)
+	verifyHasString(t, `"Born": Born == null ? null : Seven5Support.dateTimeToJson(Born!),`, dart)
+	verifyHasString(t, `Maybe = ((json["Maybe"] as List<dynamic>?) ?? []).map<int?>((e) => e == null ? null : (e as num).toInt()).toList();`, dart)
+	verifyHasString(t, `Homes = ((json["Homes"] as Map<String, dynamic>?) ?? {}).map<String, Address?>((k, e) => MapEntry(k, e == null ? null : Address.fromJson(e as Map<String, dynamic>)));`, dart)
+	verifyHasString(t, `"Homes": Homes.map((k, e) => MapEntry(k, e?.toJson())),`, dart)
+
+	holder := NewSimpleTypeHolder()
+	holder.Add("Profile", &Profile{})
+	ts := wrappedTypeScriptCodeGen(holder, "/rest/")
+	verifyHasString(t, "Nick?: string | null;", ts.String())
+	verifyHasString(t, "Scores: { [key: string]: number };", ts.String())
+	verifyHasString(t, "Maybe: (number | null)[];", ts.String())
+	src, err := GenerateGoClient(holder, "/rest/", "api")
+	if err != nil {
+		t.Fatalf("generated go doesn't parse: %s", err)
+	}
+	verifyHasString(t, "Nick   *seven5.String255", string(src))
+	verifyHasString(t, "Homes  map[seven5.String255]*Address", string(src))
+
+	s := WireTypeSchema(f)
+	if strings.Join(s.Required, ",") != "Id,Scores,Maybe,Homes" {
+		t.Errorf("optional fields should not be required: %v", s.Required)
+	}
+	if n := s.Properties["Nick"]; len(n.AnyOf) != 2 || n.AnyOf[1].Type != "null" || *n.AnyOf[0].MaxLength != 255 {
+		t.Errorf("bad optional schema: %+v", n)
+	}
+	if h := s.Properties["Homes"]; h.Type != "object" || h.AdditionalProperties.Ref != "#/$defs/Address" {
+		t.Errorf("bad map schema: %+v", h)
+	}
+}
+
+/*-------------------------------------------------------------------------------*/
+func TestNullInWireType(t *testing.T) {
+	io := NewRawIOHook(&JsonDecoder{}, &JsonEncoder{}, nil)
+	raw := NewRawDispatcher(io, nil, nil, NewSimpleTypeHolder(), "/rest")
+	raw.Rez(&Profile{}, &profileEcho{})
+	mux := NewServeMux()
+	mux.Dispatch("/rest/", raw)
+	post := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/rest/profile", strings.NewReader(body)))
+		return w
+	}
+
+	w := post(`{"Id":0,"Nick":null,"Born":1.5,"Scores":{"a":1},"Maybe":[null,2],"Homes":{"h":{"Street":"Main"}}}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected optional nulls to be accepted but got %d: %s", w.Code, w.Body.String())
+	}
+	var p Profile
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil {
+		t.Fatalf("bad result: %s", err)
+	}
+	if p.Nick != nil || *p.Born != 1.5 || p.Scores["a"] != 1 || p.Maybe[0] != nil || *p.Maybe[1] != 2 || p.Homes["h"].Street != "Main" {
+		t.Errorf("fields did not survive the round trip: %+v", p)
+	}
+	for _, body := range []string{`{"Id":null}`, `{"Scores":{"a":null}}`, `{"Homes":{"h":{"Street":null}}}`, `{"homes":{"h":{"street":null}}}`} {
+		if w := post(body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected null to be refused in %s but got %d", body, w.Code)
+		}
+	}
+	if w := post(`{"Homes":{"h":null},"Extra":null}`); w.Code != http.StatusCreated {
+		t.Errorf("expected null struct and unknown key to be accepted but got %d: %s", w.Code, w.Body.String())
+	}
+
+	//a wire type that is not registered decodes null as zero, even if it has optional fields
+	raw.Rez(&Draft{}, &profileEcho{})
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/rest/draft", strings.NewReader(`{"Id":0,"Title":null,"Count":null}`)))
+	if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), `"Count": 0`) {
+		t.Errorf("expected null to be zero in a wire type that is not registered but got %d: %s", w.Code, w.Body.String())
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("expected registering a non-pointer to be refused")
+			}
+		}()
+		RegisterNullChecks(Draft{})
+	}()
+}